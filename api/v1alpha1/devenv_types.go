@@ -16,6 +16,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -50,6 +51,34 @@ type DevEnvSpec struct {
 	RoleName        string `json:"roleName"`
 
 	BuilderName string `json:"builderName,omitempty"`
+
+	// Access to the DevEnv, the owner (UserEmail) is always allowed
+	AllowedEmails       []string `json:"allowedEmails,omitempty"`
+	AllowedEmailDomains []string `json:"allowedEmailDomains,omitempty"`
+	// AllowedGroups users need to be member of one of, in addition to an allowed email. The group of the DevEnv,
+	// which the owner and the collaborators are member of, is always allowed. Only the shared realm of Keycloak
+	// supplies groups, DevEnvs of other OAUTH providers or realm modes with allowedGroups are rejected.
+	AllowedGroups []string `json:"allowedGroups,omitempty"`
+
+	// Collaborators get access to the DevEnv with users of their own
+	Collaborators []Collaborator `json:"collaborators,omitempty"`
+}
+
+// CollaboratorRole is the access a collaborator gets
+type CollaboratorRole string
+
+const (
+	// CollaboratorRoleEditor has the same access as the owner
+	CollaboratorRoleEditor CollaboratorRole = "editor"
+	// CollaboratorRoleViewer has access to the IDE, but not to the terminal
+	CollaboratorRoleViewer CollaboratorRole = "viewer"
+)
+
+// Collaborator is a further user of a DevEnv
+type Collaborator struct {
+	Email string `json:"email"`
+	// +kubebuilder:validation:Enum=editor;viewer
+	Role CollaboratorRole `json:"role"`
 }
 
 // BuildPhase is the status of build phases
@@ -68,6 +97,31 @@ const (
 	BuildPhaseRunning = "Running"
 )
 
+// DevEnvConditionType is the type of a condition of a DevEnv
+type DevEnvConditionType string
+
+const (
+	// DevEnvConditionOauthReady realm, client and user of the OAUTH provider match the DevEnv
+	DevEnvConditionOauthReady DevEnvConditionType = "OauthReady"
+	// DevEnvConditionDeleting the DevEnv is being deleted, the reason is the current step
+	DevEnvConditionDeleting DevEnvConditionType = "Deleting"
+	// DevEnvConditionCertificateReady the cert-manager Certificate of the Ingresses is ready,
+	// reason and message are those of the Certificate
+	DevEnvConditionCertificateReady DevEnvConditionType = "CertificateReady"
+	// DevEnvConditionRouteAccepted the Gateway accepted the HTTPRoute of the DevEnv, reason and message are
+	// those of its Accepted condition. Only set with the Gateway API.
+	DevEnvConditionRouteAccepted DevEnvConditionType = "RouteAccepted"
+)
+
+// DevEnvCondition describes the state of one aspect of a DevEnv
+type DevEnvCondition struct {
+	Type               DevEnvConditionType    `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+}
+
 // DevEnvStatus defines the observed state of DevEnv
 type DevEnvStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
@@ -76,6 +130,50 @@ type DevEnvStatus struct {
 	Realm string     `json:"realm"`
 	User  string     `json:"user"`
 	Build BuildPhase `json:"build"`
+
+	Conditions []DevEnvCondition `json:"conditions,omitempty"`
+}
+
+// GetCondition returns the condition of the given type, nil if there is none
+func (s *DevEnvStatus) GetCondition(t DevEnvConditionType) *DevEnvCondition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == t {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition adds or updates a condition and reports if anything changed.
+// LastTransitionTime is only set if the status of the condition changes.
+func (s *DevEnvStatus) SetCondition(c DevEnvCondition) bool {
+	existing := s.GetCondition(c.Type)
+	if existing == nil {
+		c.LastTransitionTime = metav1.Now()
+		s.Conditions = append(s.Conditions, c)
+		return true
+	}
+	if existing.Status == c.Status && existing.Reason == c.Reason && existing.Message == c.Message {
+		return false
+	}
+	if existing.Status != c.Status {
+		existing.LastTransitionTime = metav1.Now()
+	}
+	existing.Status = c.Status
+	existing.Reason = c.Reason
+	existing.Message = c.Message
+	return true
+}
+
+// RemoveCondition removes the condition of the given type and reports if there was one
+func (s *DevEnvStatus) RemoveCondition(t DevEnvConditionType) bool {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == t {
+			s.Conditions = append(s.Conditions[:i], s.Conditions[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
 
 // +kubebuilder:object:root=true
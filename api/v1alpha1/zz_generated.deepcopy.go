@@ -113,13 +113,28 @@ func (in *BuilderStatus) DeepCopy() *BuilderStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Collaborator) DeepCopyInto(out *Collaborator) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Collaborator.
+func (in *Collaborator) DeepCopy() *Collaborator {
+	if in == nil {
+		return nil
+	}
+	out := new(Collaborator)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DevEnv) DeepCopyInto(out *DevEnv) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DevEnv.
@@ -140,6 +155,22 @@ func (in *DevEnv) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DevEnvCondition) DeepCopyInto(out *DevEnvCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DevEnvCondition.
+func (in *DevEnvCondition) DeepCopy() *DevEnvCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(DevEnvCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DevEnvList) DeepCopyInto(out *DevEnvList) {
 	*out = *in
@@ -175,6 +206,26 @@ func (in *DevEnvList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DevEnvSpec) DeepCopyInto(out *DevEnvSpec) {
 	*out = *in
+	if in.AllowedEmails != nil {
+		in, out := &in.AllowedEmails, &out.AllowedEmails
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowedEmailDomains != nil {
+		in, out := &in.AllowedEmailDomains, &out.AllowedEmailDomains
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowedGroups != nil {
+		in, out := &in.AllowedGroups, &out.AllowedGroups
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Collaborators != nil {
+		in, out := &in.Collaborators, &out.Collaborators
+		*out = make([]Collaborator, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DevEnvSpec.
@@ -190,6 +241,13 @@ func (in *DevEnvSpec) DeepCopy() *DevEnvSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DevEnvStatus) DeepCopyInto(out *DevEnvStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]DevEnvCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DevEnvStatus.
@@ -8,7 +8,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func (r *DevEnvReconciler) buildPodForDevEnv(cr *cndev1alpha1.DevEnv, b *cndev1alpha1.Builder) *corev1.Pod {
+func (r *devEnvConfig) buildPodForDevEnv(cr *cndev1alpha1.DevEnv, b *cndev1alpha1.Builder) *corev1.Pod {
 	labels := labelsForDevEnv(cr.Name)
 
 	podSpec := b.Spec.Template
@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// reasons of condition CertificateReady besides those of the Certificate
+	certificatePending = "Pending"
+	certificateUnknown = "CertificateUnknown"
+)
+
+// certificateKind is served by cert-manager since 1.0, the client-go of the operator does not know it
+var certificateKind = schema.GroupVersionKind{Group: "cert-manager.io", Version: "v1", Kind: "Certificate"}
+
+// TLSIssuerFromEnv returns kind and name of the cert-manager issuer of CNDE_TLS_ISSUER, an Issuer in the manager
+// namespace, or of CNDE_TLS_CLUSTER_ISSUER. The name is empty if neither is set.
+func TLSIssuerFromEnv() (kind, name string, err error) {
+	issuer, clusterIssuer := os.Getenv("CNDE_TLS_ISSUER"), os.Getenv("CNDE_TLS_CLUSTER_ISSUER")
+	switch {
+	case issuer != "" && clusterIssuer != "":
+		return "", "", fmt.Errorf("CNDE_TLS_ISSUER and CNDE_TLS_CLUSTER_ISSUER are both set")
+	case issuer != "":
+		return "Issuer", issuer, nil
+	case clusterIssuer != "":
+		return "ClusterIssuer", clusterIssuer, nil
+	}
+	return "", "", nil
+}
+
+// managesCertificate reports whether the operator creates the Certificate of the Ingresses, the Gateway
+// terminates TLS itself
+func (r *devEnvConfig) managesCertificate() bool {
+	return r.tlsIssuerName != "" && r.exposure != ExposureGateway
+}
+
+// certificateForDevEnv requests the certificate of the host of the DevEnv from the issuer, cert-manager stores
+// it in the Secret all Ingresses of the DevEnv use for TLS
+func (r *devEnvConfig) certificateForDevEnv(cr *cndev1alpha1.DevEnv) *unstructured.Unstructured {
+	cert := newUnstructured(certificateKind)
+	cert.Object["spec"] = map[string]interface{}{
+		"secretName": r.tlsSecretName,
+		"dnsNames":   []interface{}{r.ingressHost},
+		"issuerRef": map[string]interface{}{
+			"group": certificateKind.Group,
+			"kind":  r.tlsIssuerKind,
+			"name":  r.tlsIssuerName,
+		},
+	}
+	cert.SetName(r.tlsSecretName)
+	cert.SetNamespace(r.ManagerNamespace)
+	cert.SetLabels(labelsForDevEnv(cr.Name))
+
+	controllerutil.SetControllerReference(cr, cert, r.scheme)
+	return cert
+}
+
+// reconcileCertificate creates or updates the Certificate and reports its Ready condition as condition
+// CertificateReady of the DevEnv. cert-manager updating the Certificate triggers the next reconcile.
+func (r *DevEnvReconciler) reconcileCertificate(ctx context.Context, devenv *cndev1alpha1.DevEnv) error {
+	if !r.managesCertificate() {
+		return nil
+	}
+	desired := r.certificateForDevEnv(devenv)
+	if err := r.reconcileUnstructured(ctx, devenv, desired); err != nil {
+		return err
+	}
+
+	cert := newUnstructured(certificateKind)
+	if err := r.Get(ctx, types.NamespacedName{Name: desired.GetName(), Namespace: desired.GetNamespace()}, cert); err != nil {
+		r.Log.Error(err, "Failed to get Certificate.")
+		return err
+	}
+	status, reason, message := certificateReady(cert)
+	previous := devenv.Status.GetCondition(cndev1alpha1.DevEnvConditionCertificateReady)
+	transition := previous == nil || previous.Status != status
+	changed := devenv.Status.SetCondition(cndev1alpha1.DevEnvCondition{
+		Type:    cndev1alpha1.DevEnvConditionCertificateReady,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+	if !changed {
+		return nil
+	}
+	name := objectName(cert.GetNamespace(), cert.GetName())
+	if transition && status == corev1.ConditionTrue {
+		r.eventf(devenv, corev1.EventTypeNormal, reasonCertificateReady, "Certificate %s is ready", name)
+	} else if status == corev1.ConditionFalse {
+		r.eventf(devenv, corev1.EventTypeWarning, reasonCertificateNotReady, "Certificate %s is not ready: %s: %s", name, reason, message)
+	}
+	err := r.Status().Update(ctx, devenv)
+	if err != nil {
+		r.Log.Error(err, "Failed to update User Environment Conditions")
+	}
+	return err
+}
+
+// certificateReady returns status, reason and message of the Ready condition of the Certificate
+func certificateReady(cert *unstructured.Unstructured) (corev1.ConditionStatus, string, string) {
+	conditions, _, _ := unstructured.NestedSlice(cert.Object, "status", "conditions")
+	if status, reason, message, ok := findCondition(conditions, "Ready"); ok {
+		if reason == "" {
+			reason = certificateUnknown
+		}
+		return status, reason, message
+	}
+	return corev1.ConditionUnknown, certificatePending, "cert-manager has not issued the certificate yet"
+}
+
+// findCondition returns status, reason and message of the condition of type t in the conditions of an
+// unstructured object
+func findCondition(conditions []interface{}, t string) (status corev1.ConditionStatus, reason, message string, found bool) {
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != t {
+			continue
+		}
+		s, _ := condition["status"].(string)
+		reason, _ = condition["reason"].(string)
+		message, _ = condition["message"].(string)
+		return corev1.ConditionStatus(s), reason, message, true
+	}
+	return "", "", "", false
+}
@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCertificateReady(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions []interface{}
+		wantStatus corev1.ConditionStatus
+		wantReason string
+	}{
+		{"not yet issued", nil, corev1.ConditionUnknown, certificatePending},
+		{"ready", []interface{}{
+			map[string]interface{}{"type": "Issuing", "status": "False"},
+			map[string]interface{}{"type": "Ready", "status": "True", "reason": "Ready", "message": "Certificate is up to date and has not expired"},
+		}, corev1.ConditionTrue, "Ready"},
+		{"failed", []interface{}{
+			map[string]interface{}{"type": "Ready", "status": "False", "reason": "DoesNotExist", "message": "Issuing certificate as Secret does not exist"},
+		}, corev1.ConditionFalse, "DoesNotExist"},
+		{"without reason", []interface{}{
+			map[string]interface{}{"type": "Ready", "status": "Unknown"},
+		}, corev1.ConditionUnknown, certificateUnknown},
+	}
+	for _, tt := range tests {
+		cert := newUnstructured(certificateKind)
+		if tt.conditions != nil {
+			cert.Object["status"] = map[string]interface{}{"conditions": tt.conditions}
+		}
+		status, reason, _ := certificateReady(cert)
+		if status != tt.wantStatus || reason != tt.wantReason {
+			t.Errorf("%s: got %s %s, want %s %s", tt.name, status, reason, tt.wantStatus, tt.wantReason)
+		}
+	}
+}
+
+func TestTLSIssuerFromEnv(t *testing.T) {
+	tests := []struct {
+		issuer, clusterIssuer string
+		wantKind, wantName    string
+		wantErr               bool
+	}{
+		{"", "", "", "", false},
+		{"internal-ca", "", "Issuer", "internal-ca", false},
+		{"", "letsencrypt", "ClusterIssuer", "letsencrypt", false},
+		{"internal-ca", "letsencrypt", "", "", true},
+	}
+	defer setRenderEnv(t, nil)
+	for _, tt := range tests {
+		setRenderEnv(t, map[string]string{"CNDE_TLS_ISSUER": tt.issuer, "CNDE_TLS_CLUSTER_ISSUER": tt.clusterIssuer})
+		kind, name, err := TLSIssuerFromEnv()
+		if (err != nil) != tt.wantErr || kind != tt.wantKind || name != tt.wantName {
+			t.Errorf("%q, %q: got %s %s %v, want %s %s error %v", tt.issuer, tt.clusterIssuer, kind, name, err, tt.wantKind, tt.wantName, tt.wantErr)
+		}
+	}
+}
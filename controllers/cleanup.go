@@ -0,0 +1,276 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// reasons of condition Deleting, one for each step of the deletion of a DevEnv
+const (
+	deletingOauth   = "DeletingOauth"
+	deletingObjects = "DeletingObjects"
+	waitingObjects  = "WaitingForObjects"
+)
+
+// requeue interval while objects of a deleted DevEnv still exist
+const cleanupRequeue = 2 * time.Second
+
+// cleanupList is a kind of objects labelled with the DevEnv that are deleted with it
+type cleanupList struct {
+	kind string
+	list runtime.Object
+	// clusterScoped objects are listed once, the others in every namespace of the DevEnv
+	clusterScoped bool
+	// volume objects are kept unless spec.deleteVolumes is set
+	volume bool
+}
+
+// cleanupLists returns the kinds deleted with a DevEnv, those of CRDs only if the exposure backend creates
+// them as the CRDs may be missing otherwise
+func (r *DevEnvReconciler) cleanupLists() []cleanupList {
+	var lists []cleanupList
+	for _, kind := range r.exposureKinds() {
+		lists = append(lists, cleanupList{kind: kind.Kind, list: newUnstructuredList(kind)})
+	}
+	return append(lists, []cleanupList{
+		{kind: "Ingress", list: newIngressList(r.IngressAPI)},
+		{kind: "StatefulSet", list: &appsv1.StatefulSetList{}},
+		{kind: "Deployment", list: &appsv1.DeploymentList{}},
+		{kind: "Pod", list: &corev1.PodList{}},
+		{kind: "Service", list: &corev1.ServiceList{}},
+		{kind: "Secret", list: &corev1.SecretList{}},
+		{kind: "RoleBinding", list: &rbacv1.RoleBindingList{}},
+		{kind: "ServiceAccount", list: &corev1.ServiceAccountList{}},
+		{kind: "PersistentVolumeClaim", list: &corev1.PersistentVolumeClaimList{}, volume: true},
+		{kind: "ClusterRoleBinding", list: &rbacv1.ClusterRoleBindingList{}, clusterScoped: true},
+		{kind: "Namespace", list: &corev1.NamespaceList{}, clusterScoped: true, volume: true},
+	}...)
+}
+
+// finalizeDevEnv deletes everything the DevEnv consists of, step by step as reported by condition Deleting,
+// and removes the finalizer of the operator afterwards. Finalizers of others are kept.
+func (r *DevEnvReconciler) finalizeDevEnv(ctx context.Context, devenv *cndev1alpha1.DevEnv) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(devenv, finalizerName) {
+		return ctrl.Result{}, nil
+	}
+
+	if err := r.setDeletingCondition(ctx, devenv, deletingOauth, "deleting user, client and realm of the OAUTH provider"); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.deleteOauth(ctx, devenv); err != nil {
+		if uerr := r.setDeletingCondition(ctx, devenv, deletingOauth, err.Error()); uerr != nil {
+			r.Log.Error(uerr, "Failed to update User Environment Conditions")
+		}
+		return ctrl.Result{}, err
+	}
+
+	if err := r.setDeletingCondition(ctx, devenv, deletingObjects, "deleting the objects labelled with the DevEnv"); err != nil {
+		return ctrl.Result{}, err
+	}
+	remaining, err := r.deleteLabelled(ctx, devenv)
+	if err != nil {
+		if uerr := r.setDeletingCondition(ctx, devenv, deletingObjects, err.Error()); uerr != nil {
+			r.Log.Error(uerr, "Failed to update User Environment Conditions")
+		}
+		return ctrl.Result{}, err
+	}
+	if len(remaining) > 0 {
+		r.Log.Info("Waiting for objects of the DevEnv to be deleted.", "objects", remaining)
+		if err := r.setDeletingCondition(ctx, devenv, waitingObjects, "waiting for "+strings.Join(remaining, ", ")); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: cleanupRequeue}, nil
+	}
+
+	r.Log.Info("Removing finalizer, all objects of the DevEnv are deleted.", "DevEnv", devenv.Name)
+	controllerutil.RemoveFinalizer(devenv, finalizerName)
+	if err := r.Update(ctx, devenv); err != nil {
+		r.Log.Error(err, "Failed to update User Environment Finalizers")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// deleteOauth deletes user, client and realm of the DevEnv, missing ones are ignored
+func (r *DevEnvReconciler) deleteOauth(ctx context.Context, devenv *cndev1alpha1.DevEnv) error {
+	steps := []struct {
+		kind string
+		del  func(context.Context, *cndev1alpha1.DevEnv) error
+	}{
+		{"user", r.oauth.DeleteUser},
+		{"client", r.oauth.DeleteClient},
+		{"realm", r.oauth.DeleteRealm},
+	}
+	for _, step := range steps {
+		if err := step.del(ctx, devenv); err != nil && !errors.IsNotFound(err) {
+			r.eventf(devenv, corev1.EventTypeWarning, reasonDeleteFailed, "Failed to delete OAUTH %s: %v", step.kind, err)
+			return fmt.Errorf("deleting OAUTH %s: %v", step.kind, err)
+		}
+	}
+	r.eventf(devenv, corev1.EventTypeNormal, reasonOauthDeleted, "Deleted user, client and realm of the OAUTH provider")
+	return nil
+}
+
+// deleteLabelled deletes the objects labelled with the DevEnv in its namespaces and the cluster scoped ones.
+// It returns the objects that still exist and are not terminating yet.
+func (r *DevEnvReconciler) deleteLabelled(ctx context.Context, devenv *cndev1alpha1.DevEnv) ([]string, error) {
+	selector := client.MatchingLabelsSelector{Selector: selectorForDevEnv(devenv.Name)}
+	namespaces := uniqueStrings(r.ManagerNamespace, r.DevEnvNamespace, r.initialPasswordNamespace)
+
+	var deleted []string
+	// build Pods of former versions have no labels
+	buildPod := &corev1.Pod{}
+	err := r.Get(ctx, types.NamespacedName{Name: r.buildName, Namespace: r.ManagerNamespace}, buildPod)
+	if err == nil && buildPod.DeletionTimestamp == nil {
+		r.Log.Info("Deleting Build Pod")
+		if err = r.Delete(ctx, buildPod); err != nil && !errors.IsNotFound(err) {
+			r.eventf(devenv, corev1.EventTypeWarning, reasonDeleteFailed, "Failed to delete Build Pod %s: %v", buildPod.Name, err)
+			return nil, fmt.Errorf("deleting Build Pod: %v", err)
+		}
+	} else if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	for _, c := range r.cleanupLists() {
+		if c.volume && !devenv.Spec.DeleteVolumes {
+			continue
+		}
+		listNamespaces := namespaces
+		if c.clusterScoped {
+			listNamespaces = []string{""}
+		}
+		for _, ns := range listNamespaces {
+			if err := r.List(ctx, c.list, selector, client.InNamespace(ns)); err != nil {
+				return nil, fmt.Errorf("listing %s: %v", c.kind, err)
+			}
+			items, err := meta.ExtractList(c.list)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				obj, err := meta.Accessor(item)
+				if err != nil {
+					return nil, err
+				}
+				if obj.GetDeletionTimestamp() != nil {
+					continue
+				}
+				name := c.kind + " " + objectName(obj.GetNamespace(), obj.GetName())
+				r.Log.Info("Deleting object of the DevEnv.", "object", name)
+				err = r.Delete(ctx, item, client.PropagationPolicy(metav1.DeletePropagationBackground))
+				if err != nil && !errors.IsNotFound(err) {
+					r.eventf(devenv, corev1.EventTypeWarning, reasonDeleteFailed, "Failed to delete %s: %v", name, err)
+					return nil, fmt.Errorf("deleting %s: %v", name, err)
+				}
+				if err == nil {
+					deleted = append(deleted, name)
+				}
+			}
+		}
+	}
+	if len(deleted) > 0 {
+		r.eventf(devenv, corev1.EventTypeNormal, reasonObjectsDeleted, "Deleted %d objects of the DevEnv", len(deleted))
+	}
+	return r.existingLabelled(ctx, devenv, deleted)
+}
+
+// existingLabelled returns those of the deleted objects that neither are gone nor terminating
+func (r *DevEnvReconciler) existingLabelled(ctx context.Context, devenv *cndev1alpha1.DevEnv, deleted []string) ([]string, error) {
+	if len(deleted) == 0 {
+		return nil, nil
+	}
+	selector := client.MatchingLabelsSelector{Selector: selectorForDevEnv(devenv.Name)}
+	wanted := map[string]bool{}
+	for _, name := range deleted {
+		wanted[name] = true
+	}
+
+	var remaining []string
+	for _, c := range r.cleanupLists() {
+		if err := r.List(ctx, c.list, selector); err != nil {
+			return nil, fmt.Errorf("listing %s: %v", c.kind, err)
+		}
+		items, err := meta.ExtractList(c.list)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			obj, err := meta.Accessor(item)
+			if err != nil {
+				return nil, err
+			}
+			name := c.kind + " " + objectName(obj.GetNamespace(), obj.GetName())
+			if wanted[name] && obj.GetDeletionTimestamp() == nil {
+				remaining = append(remaining, name)
+			}
+		}
+	}
+	return remaining, nil
+}
+
+func (r *DevEnvReconciler) setDeletingCondition(ctx context.Context, devenv *cndev1alpha1.DevEnv, reason, message string) error {
+	changed := devenv.Status.SetCondition(cndev1alpha1.DevEnvCondition{
+		Type:    cndev1alpha1.DevEnvConditionDeleting,
+		Status:  corev1.ConditionTrue,
+		Reason:  reason,
+		Message: message,
+	})
+	if !changed {
+		return nil
+	}
+	err := r.Status().Update(ctx, devenv)
+	if err != nil {
+		r.Log.Error(err, "Failed to update User Environment Conditions")
+	}
+	return err
+}
+
+// devEnvApps are the values of label app of the objects of a DevEnv, oauth2-proxy has labels of its own
+var devEnvApps = []string{"code-server", "oauth2-proxy"}
+
+// selectorForDevEnv selects the objects the operator created for the DevEnv, for any DevEnv if name is empty
+func selectorForDevEnv(name string) labels.Selector {
+	op, values := selection.Exists, []string(nil)
+	if name != "" {
+		op, values = selection.Equals, []string{name}
+	}
+	nameReq, err := labels.NewRequirement(userenvnameLabel, op, values)
+	if err != nil {
+		panic(err)
+	}
+	appReq, err := labels.NewRequirement("app", selection.In, devEnvApps)
+	if err != nil {
+		panic(err)
+	}
+	return labels.NewSelector().Add(*nameReq, *appReq)
+}
+
+// uniqueStrings returns the non-empty strings without duplicates in their order
+func uniqueStrings(values ...string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, v := range values {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
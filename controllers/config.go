@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"time"
+
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// devEnvConfig holds everything the manifests of a DevEnv depend on besides the DevEnv itself. It is derived
+// from the DevEnv, the environment of the manager and the OAUTH provider by initStruct. The builders in k8s.go
+// and build.go are methods of devEnvConfig and pure functions of it and the DevEnv.
+type devEnvConfig struct {
+	scheme *runtime.Scheme
+
+	serviceAccountName       string
+	resourceName             string
+	buildName                string
+	initName                 string
+	homeVolumeName           string
+	vmVolumeName             string
+	dockerVolumeName         string
+	dockerVolumeSize         string
+	homeVolumeSize           string
+	ingressHost              string
+	ingressUIName            string
+	ingressTerminalName      string
+	ingressOauthName         string
+	proxyPodName             string
+	initialPasswordName      string
+	initialPasswordNamespace string
+	clusterDomain            string
+	DevEnvNamespace          string
+	ManagerNamespace         string
+
+	dockerImg     string
+	devEnvImg     string
+	kubeConfigImg string
+	configureImg  string
+	oauthProxyImg string
+	alpineImage   string
+
+	// Ingresses are created in ingressAPI with class ingressClassName and the extra annotations
+	ingressAPI              IngressAPI
+	ingressClassName        string
+	extraIngressAnnotations map[string]string
+
+	// the Ingresses use the TLS certificate of Secret tlsSecretName, with tlsIssuerName the operator requests it
+	// by a Certificate of the cert-manager issuer
+	tlsSecretName string
+	tlsIssuerKind string
+	tlsIssuerName string
+
+	// the Ingresses are protected as ingressAuth selects, with exposure gateway an HTTPRoute attached
+	// to gatewayNamespace/gatewayName replaces them
+	exposure         Exposure
+	ingressAuth      IngressAuth
+	gatewayNamespace string
+	gatewayName      string
+	gatewayAuth      GatewayAuth
+
+	memRequestIDE    resource.Quantity
+	memRequestDocker resource.Quantity
+
+	// settings of oauth2-proxy, given by the OAUTH provider and the RealmPolicy
+	oauthClientID      string
+	oauthIssuerURL     string
+	oauthAllowedGroups []string
+	policy             *oauth.RealmPolicy
+	// ConfigMap with the CA bundle oauth2-proxy verifies the issuer with, empty for the system CAs
+	oauthCAConfigMap string
+
+	// secrets of oauth2-proxy, the time they were rotated at and the hash of its Secret, set while reconciling
+	oauthClientSecret string
+	oauthCookieSecret string
+	secretsRotated    time.Time
+	proxySecretHash   string
+}
@@ -17,25 +17,28 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"time"
 
 	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	extv1beta1 "k8s.io/api/extensions/v1beta1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"cnde-operator.cloud-native-coding.dev/api/v1alpha1"
 	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
 	"cnde-operator.cloud-native-coding.dev/oauth"
-	"cnde-operator.cloud-native-coding.dev/oauth/keycloak"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 )
 
@@ -45,7 +48,11 @@ const (
 	// used by Reconciler to identify where to find CR
 	namespaceLabel   = "user-env-ns"
 	userenvnameLabel = "user-env-name"
+	componentLabel   = "user-env-component"
 	imageTagName     = "IMAGE_TAG"
+
+	// failureRecordedAnnotation on a failed build or init Pod marks its failure as recorded by Event and metrics
+	failureRecordedAnnotation = "c-n-d-e.kube-platform.dev/failure-recorded"
 )
 
 // DevEnvReconciler reconciles a DevEnv object
@@ -54,38 +61,30 @@ type DevEnvReconciler struct {
 	Log    logr.Logger
 	Scheme *runtime.Scheme
 
-	serviceAccountName string
-	resourceName       string
-	buildName          string
-	initName           string
-	homeVolumeName     string
-	vmVolumeName       string
-	dockerVolumeName   string
-	dockerVolumeSize   string
-	homeVolumeSize     string
-	ingressHost        string
-	ingressUIName      string
-	ingressOauthName   string
-	proxyPodName       string
-	DevEnvPodIP        string
-	DevEnvNamespace    string
-	ManagerNamespace   string
-
-	dockerImg     string
-	devEnvImg     string
-	kubeConfigImg string
-	configureImg  string
-	oauthProxyImg string
-	alpineImage   string
-
-	memRequestIDE    resource.Quantity
-	memRequestDocker resource.Quantity
-
-	oauth             oauth.OAUTHProvider
-	oauthClientSecret string
-	oauthClientID     string
-
-	oauthProviderName string
+	// Federation declares identity providers and user federations of the realms, loaded at startup
+	Federation *oauth.FederationConfig
+	// RealmPolicy of the realms, loaded at startup, nil for oauth.DefaultRealmPolicy
+	RealmPolicy *oauth.RealmPolicy
+	// OAUTH is used for all DevEnvs instead of the provider named by CNDE_OAUTH_PROVIDERNAME, e.g. a fake in tests
+	OAUTH oauth.OAUTHProvider
+	// Recorder records the lifecycle of DevEnvs and builds as Events, nil records nothing
+	Recorder record.EventRecorder
+	// IngressAPI the Ingresses are created with, discovered at startup, empty for extensions/v1beta1
+	IngressAPI IngressAPI
+	// Exposure of the DevEnvs, read from CNDE_EXPOSURE at startup, empty for Ingresses
+	Exposure Exposure
+	// IngressAuth protecting the Ingresses, read from CNDE_INGRESS_AUTH at startup, empty for nginx
+	IngressAuth IngressAuth
+
+	devEnvConfig
+
+	oauth oauth.OAUTHProvider
+
+	oauthProviderName   string
+	oauthDriftPolicy    string
+	oauthVerifyInterval time.Duration
+
+	secretRotationInterval time.Duration
 
 	hasBuilder bool
 }
@@ -103,50 +102,62 @@ func ignoreNotFound(err error) error {
 // +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=services;persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="apps",resources=statefulsets;deployments,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="extensions",resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="networking.k8s.io",resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="gateway.networking.k8s.io",resources=httproutes;referencegrants,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="traefik.io",resources=middlewares,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="cert-manager.io",resources=certificates,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="rbac.authorization.k8s.io",resources=rolebindings,verbs=*
 // +kubebuilder:rbac:groups="rbac.authorization.k8s.io",resources=clusterrolebindings,verbs=*
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
-func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, err error) {
 	ctx := context.Background()
 	_ = r.Log.WithValues("DevEnv", req.NamespacedName)
 
 	// Fetch the DevEnv instance
 	devenv := &cndev1alpha1.DevEnv{}
-	err := r.Get(ctx, req.NamespacedName, devenv)
+	err = r.Get(ctx, req.NamespacedName, devenv)
 	if err != nil {
 		return ctrl.Result{}, ignoreNotFound(err)
 	}
 
-	r.initStruct(devenv)
+	// each stage of the reconcile is a span, the OAUTH calls of a stage are its children
+	tr := startReconcileTrace(ctx, devenv)
+	defer func() { tr.end(err) }()
+
+	ctx = tr.startStage("Init")
+	if err = r.initStruct(devenv); err != nil {
+		return ctrl.Result{}, err
+	}
 
 	// --------------------------------------------
 	// Check if the APP CR was marked to be deleted
 	// --------------------------------------------
 	isUserEnvMarkedToBeDeleted := devenv.GetDeletionTimestamp() != nil
 	if isUserEnvMarkedToBeDeleted {
+		ctx = tr.startStage("Delete")
+		return r.finalizeDevEnv(ctx, devenv)
+	}
 
-		err = r.oauth.DeleteRealm(devenv)
-		if err != nil && !errors.IsNotFound(err) {
-			return ctrl.Result{}, err
-		}
-
-		buildPod := &corev1.Pod{}
-		if err = r.Get(ctx, types.NamespacedName{Name: r.buildName, Namespace: r.ManagerNamespace}, buildPod); err == nil {
-			r.Log.Info("Deleting Build Pod")
-			err = r.Delete(ctx, buildPod)
-			if err != nil {
-				r.Log.Error(err, "Failed to delete Build Pod")
-			}
-		}
+	if err = r.checkAllowedGroups(devenv); err != nil {
+		r.eventf(devenv, corev1.EventTypeWarning, reasonAllowedGroupsRejected, "%v", err)
+		return ctrl.Result{}, err
+	}
 
-		devenv.SetFinalizers(nil)
-		err := r.Update(ctx, devenv)
+	if !controllerutil.ContainsFinalizer(devenv, finalizerName) {
+		controllerutil.AddFinalizer(devenv, finalizerName)
+		err = r.Update(ctx, devenv)
 		if err != nil {
+			r.Log.Error(err, "Failed to update User Environment Finalizers")
 			return ctrl.Result{}, err
 		}
-		return ctrl.Result{}, nil
 	}
 
+	ctx = tr.startStage("Namespace")
 	r.hasBuilder = false
 	builder := &cndev1alpha1.Builder{}
 	if devenv.Spec.BuilderName != "" {
@@ -156,6 +167,7 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 				return ctrl.Result{}, err
 			}
 			if devenv.Spec.BuilderName != "" {
+				r.eventf(devenv, corev1.EventTypeWarning, reasonBuilderNotFound, "Builder %s not found in namespace %s", devenv.Spec.BuilderName, r.ManagerNamespace)
 				return ctrl.Result{}, fmt.Errorf("BuilderName: %v configured but not found", devenv.Spec.BuilderName)
 			}
 		} else {
@@ -163,59 +175,7 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		}
 	}
 
-	// -----------------------------------
-	// keycloak stuff
-	// -----------------------------------
-
-	if devenv.Status.Realm == "" {
-		name, err := r.oauth.NewRealm(devenv)
-		if err != nil {
-			r.Log.Error(err, "Failed to create new Realm.")
-			return ctrl.Result{}, err
-		}
-
-		devenv.Status.Realm = name
-		err = r.Status().Update(ctx, devenv)
-		if err != nil {
-			r.Log.Error(err, "Failed to update User Environment Status")
-			return ctrl.Result{}, err
-		}
-
-		devenv.SetFinalizers([]string{finalizerName})
-		err = r.Update(ctx, devenv)
-		if err != nil {
-			r.Log.Error(err, "Failed to update User Environment Finalizers")
-			return ctrl.Result{}, err
-		}
-	}
-
-	r.oauthClientSecret, err = r.oauth.CreateClient(devenv)
-	if err != nil {
-		return ctrl.Result{}, err
-	}
-	if r.oauthClientSecret == "" {
-		return ctrl.Result{RequeueAfter: 2 * time.Second}, nil // some time for keycloak
-	}
-
-	if devenv.Status.User == "" {
-		name, err := r.oauth.CreateUser(devenv)
-		if err != nil {
-			r.Log.Error(err, "Failed to create new User.")
-			return ctrl.Result{}, err
-		}
-
-		devenv.Status.User = name
-		err = r.Status().Update(ctx, devenv)
-		if err != nil {
-			r.Log.Error(err, "Failed to update User Environment User")
-			return ctrl.Result{}, err
-		}
-		return ctrl.Result{Requeue: true}, nil // wait for status udpate
-	}
-
-	// --------------------------------------------
-	// --------------------------------------------
-
+	// the namespace is needed before the user is created, it holds the Secret of the initial password
 	namespace := &corev1.Namespace{}
 	err = r.Get(ctx, types.NamespacedName{Name: r.resourceName}, namespace)
 	if err != nil && errors.IsNotFound(err) {
@@ -225,11 +185,14 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		if err != nil {
 			if errors.IsForbidden(err) {
 				r.Log.Info("Forbidden to create Namespace, may be terminating? - waiting")
+				r.eventf(devenv, corev1.EventTypeWarning, reasonNamespaceForbidden, "Forbidden to create Namespace %s, it may be terminating", ns.Name)
 				return ctrl.Result{RequeueAfter: 2 * time.Second}, nil
 			}
 			r.Log.Error(err, "Failed to create new Namespace.", "Namespace.Name", ns.Name)
+			r.recordCreate(devenv, "Namespace", ns.Name, err)
 			return ctrl.Result{}, err
 		}
+		r.recordCreate(devenv, "Namespace", ns.Name, nil)
 		// resetting status if new Namespace
 		if r, err := r.setDevEnvStatus(ctx, devenv, v1alpha1.BuildPhaseInitial); err != nil {
 			return r, err
@@ -240,12 +203,26 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, err
 	}
 
+	// -----------------------------------
+	// keycloak stuff
+	// -----------------------------------
+
+	ctx = tr.startStage("Oauth")
+	if res, err := r.reconcileOauth(ctx, devenv); err != nil || res.Requeue || res.RequeueAfter > 0 {
+		return res, err
+	}
+
+	// --------------------------------------------
+	// --------------------------------------------
+
+	ctx = tr.startStage("RBAC")
 	serviceaccount := &corev1.ServiceAccount{}
 	err = r.Get(ctx, types.NamespacedName{Name: r.serviceAccountName, Namespace: r.DevEnvNamespace}, serviceaccount)
 	if err != nil && errors.IsNotFound(err) {
 		sa := r.serviceAccountForDevEnv(devenv)
 		r.Log.Info("Creating a new ServiceAccount.", "ServiceAccount.Namespace", sa.Namespace, "ServiceAccount.Name", sa.Name)
 		err = r.Create(ctx, sa)
+		r.recordCreate(devenv, "ServiceAccount", objectName(sa.Namespace, sa.Name), err)
 		if err != nil {
 			r.Log.Error(err, "Failed to create new ServiceAccount.", "ServiceAccount.Namespace", sa.Namespace, "ServiceAccount.Name", sa.Name)
 			return ctrl.Result{}, err
@@ -261,6 +238,7 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		rb := r.rbacRBForDevEnv(devenv)
 		r.Log.Info("Creating a new rb for User.", "rb.Namespace", rb.Namespace, "rb.Name", rb.Name)
 		err = r.Create(ctx, rb)
+		r.recordCreate(devenv, "RoleBinding", objectName(rb.Namespace, rb.Name), err)
 		if err != nil {
 			r.Log.Error(err, "Failed to create new rb.", "rb.Namespace", rb.Namespace, "rb.Name", rb.Name)
 			return ctrl.Result{}, err
@@ -276,6 +254,7 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		crb := r.rbacCRBForDevEnv(devenv)
 		r.Log.Info("Creating a new crb for User.", "crb.Namespace", crb.Namespace, "crb.Name", crb.Name)
 		err = r.Create(ctx, crb)
+		r.recordCreate(devenv, "ClusterRoleBinding", objectName(crb.Namespace, crb.Name), err)
 		if err != nil {
 			r.Log.Error(err, "Failed to create new crb.", "crb.Namespace", crb.Namespace, "crb.Name", crb.Name)
 			return ctrl.Result{}, err
@@ -285,12 +264,14 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, err
 	}
 
+	ctx = tr.startStage("Volumes")
 	persistenceVM := &corev1.PersistentVolumeClaim{}
 	err = r.Get(ctx, types.NamespacedName{Name: r.vmVolumeName, Namespace: r.DevEnvNamespace}, persistenceVM)
 	if err != nil && errors.IsNotFound(err) {
 		pvcVM := r.pvcVMForDevEnv(devenv)
 		r.Log.Info("Creating a new VM pvc.", "pvc.Namespace", pvcVM.Namespace, "pvc.Name", pvcVM.Name)
 		err = r.Create(ctx, pvcVM)
+		r.recordCreate(devenv, "PersistentVolumeClaim", objectName(pvcVM.Namespace, pvcVM.Name), err)
 		if err != nil {
 			r.Log.Error(err, "Failed to create new VM pvc.", "pvc.Namespace", pvcVM.Namespace, "pvc.Name", pvcVM.Name)
 			return ctrl.Result{}, err
@@ -306,6 +287,7 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		pvcHome := r.pvcHomeForDevEnv(devenv)
 		r.Log.Info("Creating a new Home pvc.", "pvc.Namespace", pvcHome.Namespace, "pvc.Name", pvcHome.Name)
 		err = r.Create(ctx, pvcHome)
+		r.recordCreate(devenv, "PersistentVolumeClaim", objectName(pvcHome.Namespace, pvcHome.Name), err)
 		if err != nil {
 			r.Log.Error(err, "Failed to create new Home pvc.", "pvc.Namespace", pvcHome.Namespace, "pvc.Name", pvcHome.Name)
 			return ctrl.Result{}, err
@@ -321,6 +303,7 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		pvcDocker := r.pvcDockerForDevEnv(devenv)
 		r.Log.Info("Creating a new Docker pvc.", "pvc.Namespace", pvcDocker.Namespace, "pvc.Name", pvcDocker.Name)
 		err = r.Create(ctx, pvcDocker)
+		r.recordCreate(devenv, "PersistentVolumeClaim", objectName(pvcDocker.Namespace, pvcDocker.Name), err)
 		if err != nil {
 			r.Log.Error(err, "Failed to create new Docker pvc.", "pvc.Namespace", pvcDocker.Namespace, "pvc.Name", pvcDocker.Name)
 			return ctrl.Result{}, err
@@ -334,6 +317,7 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	*** Processing Build
 	**/
 
+	ctx = tr.startStage("Build")
 	if r.hasBuilder {
 		switch devenv.Status.Build {
 
@@ -346,8 +330,11 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 					return ctrl.Result{RequeueAfter: 5 * time.Second}, r.Delete(ctx, buildPod)
 				}
 				r.Log.Error(err, "Failed to create Build Pod.")
+				r.eventf(devenv, corev1.EventTypeWarning, reasonBuildFailed, "Failed to create Build Pod %s: %v", buildPod.Name, err)
 				return ctrl.Result{}, err
 			}
+			r.eventf(devenv, corev1.EventTypeNormal, reasonBuildStarted, "Started build of %s with Builder %s", r.devEnvImg, builder.Name)
+			r.eventf(builder, corev1.EventTypeNormal, reasonBuildStarted, "Started build of DevEnv %s", devenv.Name)
 
 			if r, err := r.setDevEnvStatus(ctx, devenv, v1alpha1.BuildPhaseBuilding); err != nil {
 				return r, err
@@ -359,6 +346,7 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 			err = r.Get(ctx, types.NamespacedName{Name: r.buildName, Namespace: r.ManagerNamespace}, buildPod)
 			if err != nil {
 				r.Log.Error(err, "Failed to find Build Pod in state Building. Resetting DevEnv status")
+				r.eventf(devenv, corev1.EventTypeWarning, reasonBuildPodLost, "Build Pod %s is gone, restarting the build", r.buildName)
 				if r, err := r.setDevEnvStatus(ctx, devenv, v1alpha1.BuildPhaseInitial); err != nil {
 					return r, err
 				}
@@ -376,8 +364,18 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 					return ctrl.Result{}, err
 				}
 				r.Log.Info("Build succeeded, creating a new DevEnv Pod.")
+				r.eventf(devenv, corev1.EventTypeNormal, reasonBuildSucceeded, "Built %s with Builder %s", r.devEnvImg, builder.Name)
+				r.eventf(builder, corev1.EventTypeNormal, reasonBuildSucceeded, "Built DevEnv %s", devenv.Name)
+				buildDuration.WithLabelValues(builder.Name, "succeeded").Observe(podDuration(buildPod).Seconds())
 			case corev1.PodFailed:
 				r.Log.Info("Build failed")
+				if first, err := r.markFailureRecorded(ctx, buildPod); err != nil || !first {
+					return ctrl.Result{}, err
+				}
+				r.eventf(devenv, corev1.EventTypeWarning, reasonBuildFailed, "Build Pod %s failed, see its logs", objectName(buildPod.Namespace, buildPod.Name))
+				r.eventf(builder, corev1.EventTypeWarning, reasonBuildFailed, "Build of DevEnv %s failed", devenv.Name)
+				buildDuration.WithLabelValues(builder.Name, "failed").Observe(podDuration(buildPod).Seconds())
+				buildFailures.WithLabelValues(builder.Name).Inc()
 				return ctrl.Result{}, nil
 			}
 			return ctrl.Result{RequeueAfter: 5 * time.Second}, nil // wait for build POD to finish
@@ -396,6 +394,7 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	*** Initialization
 	**/
 
+	ctx = tr.startStage("Initialization")
 	switch devenv.Status.Build {
 
 	case v1alpha1.BuildPhaseWaitForInitializion:
@@ -407,8 +406,10 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 				return ctrl.Result{RequeueAfter: 5 * time.Second}, r.Delete(ctx, initPod)
 			}
 			r.Log.Error(err, "Failed to create Initializing Pod.")
+			r.eventf(devenv, corev1.EventTypeWarning, reasonInitFailed, "Failed to create Initialization Pod %s: %v", initPod.Name, err)
 			return ctrl.Result{}, err
 		}
+		r.eventf(devenv, corev1.EventTypeNormal, reasonInitStarted, "Started initialization of the volumes from %s", r.devEnvImg)
 		if r, err := r.setDevEnvStatus(ctx, devenv, v1alpha1.BuildPhaseInitializing); err != nil {
 			return r, err
 		}
@@ -419,6 +420,7 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		err = r.Get(ctx, types.NamespacedName{Name: r.initName, Namespace: r.DevEnvNamespace}, initPod)
 		if err != nil {
 			r.Log.Error(err, "Failed to find Initialization Pod in state Initializing. Resetting DevEnv status")
+			r.eventf(devenv, corev1.EventTypeWarning, reasonInitPodLost, "Initialization Pod %s is gone, restarting the initialization", r.initName)
 			if r, err := r.setDevEnvStatus(ctx, devenv, v1alpha1.BuildPhaseWaitForInitializion); err != nil {
 				return r, err
 			}
@@ -435,175 +437,150 @@ func (r *DevEnvReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 				return ctrl.Result{}, err
 			}
 			r.Log.Info("Initialization succeeded, creating a new DevEnv Pod.")
+			r.eventf(devenv, corev1.EventTypeNormal, reasonInitSucceeded, "Initialized the volumes")
+			initDuration.WithLabelValues("succeeded").Observe(podDuration(initPod).Seconds())
 		case corev1.PodFailed:
 			r.Log.Info("Build failed")
+			if first, err := r.markFailureRecorded(ctx, initPod); err != nil || !first {
+				return ctrl.Result{}, err
+			}
+			r.eventf(devenv, corev1.EventTypeWarning, reasonInitFailed, "Initialization Pod %s failed, see its logs", objectName(initPod.Namespace, initPod.Name))
+			initDuration.WithLabelValues("failed").Observe(podDuration(initPod).Seconds())
 			return ctrl.Result{Requeue: false}, nil
 		}
 		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
 	}
 
-	found := &corev1.Pod{}
-	err = r.Get(ctx, types.NamespacedName{Name: r.resourceName, Namespace: r.DevEnvNamespace}, found)
-	if err != nil && errors.IsNotFound(err) {
-		pod := r.podForDevEnv(devenv)
-		r.Log.Info("Creating a new DevEnv Pod.", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
-		err = r.Create(ctx, pod)
-		if err != nil {
-			return ctrl.Result{}, err
-		}
-		// Requeueing because of PodIP, that is needed below
-		return ctrl.Result{Requeue: true}, nil
-	} else if err != nil {
-		r.Log.Error(err, "Failed to get DevEnv Pod.")
-		return ctrl.Result{}, err
-	}
-
-	// check if POD is created and has an IP that is needed for creating an instance of Endpoint
-	r.DevEnvPodIP = found.Status.PodIP
-	if r.DevEnvPodIP == "" {
-		return ctrl.Result{Requeue: true}, nil
+	ctx = tr.startStage("DevEnvPod")
+	if res, err := r.reconcileDevEnvWorkload(ctx, devenv); err != nil || res.Requeue || res.RequeueAfter > 0 {
+		return res, err
 	}
 
-	proxyService := &corev1.Service{}
-	err = r.Get(ctx, types.NamespacedName{Name: r.resourceName, Namespace: r.ManagerNamespace}, proxyService)
-	if err != nil && errors.IsNotFound(err) {
-		ser := r.serviceProxyForDevEnv(devenv)
-		r.Log.Info("Creating a new Proxy Service.", "Service.Namespace", ser.Namespace, "Service.Name", ser.Name)
-		err = r.Create(ctx, ser)
-		if err != nil {
-			r.Log.Error(err, "Failed to create new Service.", "Service.Namespace", ser.Namespace, "Service.Name", ser.Name)
-			return ctrl.Result{}, err
-		}
-	} else if err != nil {
-		r.Log.Error(err, "Failed to get Service.")
+	ctx = tr.startStage("Exposure")
+	if err = r.reconcileDevEnvServices(ctx, devenv); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	// TODO Endpoint has to be recreated if the Pod is reconciled
-	// **********************************************************
-
-	proxyEndpoint := &corev1.Endpoints{}
-	err = r.Get(ctx, types.NamespacedName{Name: r.resourceName, Namespace: r.ManagerNamespace}, proxyEndpoint)
-	if err != nil && errors.IsNotFound(err) {
-		ep := r.endpointProxyForDevEnv(devenv)
-		r.Log.Info("Creating a new Proxy Endpoint.", "Endpoint.Namespace", ep.Namespace, "Endpoint.Name", ep.Name)
-		err = r.Create(ctx, ep)
-		if err != nil {
-			r.Log.Error(err, "Failed to create new Proxy Endpoint.", "Service.Endpoint", ep.Namespace, "Endpoint.Name", ep.Name)
-			return ctrl.Result{}, err
-		}
-	} else if err != nil {
-		r.Log.Error(err, "Failed to get Proxy Endpoint.")
+	if err = r.reconcileExposure(ctx, devenv); err != nil {
 		return ctrl.Result{}, err
-	} else if proxyEndpoint.Subsets[0].Addresses[0].IP != r.DevEnvPodIP {
-		ep := r.endpointProxyForDevEnv(devenv)
-		r.Log.Info("Updating Proxy Endpoint.", "Endpoint.Namespace", ep.Namespace, "Endpoint.Name", ep.Name)
-		err = r.Update(ctx, ep)
-		if err != nil {
-			r.Log.Error(err, "Failed to update Proxy Endpoint.")
-		}
 	}
 
-	uiIngress := &extv1beta1.Ingress{}
-	err = r.Get(ctx, types.NamespacedName{Name: r.ingressUIName, Namespace: r.ManagerNamespace}, uiIngress)
-	if err != nil && errors.IsNotFound(err) {
-		ingUI := r.ingressUIForDevEnv(devenv)
-		r.Log.Info("Creating a new UI Ingress.", "Ingress.Namespace", ingUI.Namespace, "Ingress.Name", ingUI.Name)
-		err = r.Create(ctx, ingUI)
-		if err != nil {
-			r.Log.Error(err, "Failed to create new UI Ingress.", "Ingress.Namespace", ingUI.Namespace, "Ingress.Name", ingUI.Name)
-			return ctrl.Result{}, err
-		}
-	} else if err != nil {
-		r.Log.Error(err, "Failed to get UI Ingress.")
+	if err = r.reconcileRouteAccepted(ctx, devenv); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	oauthIngress := &extv1beta1.Ingress{}
-	err = r.Get(ctx, types.NamespacedName{Name: r.ingressOauthName, Namespace: r.ManagerNamespace}, oauthIngress)
-	if err != nil && errors.IsNotFound(err) {
-		ingOauth := r.ingressOauthForDevEnv(devenv)
-		r.Log.Info("Creating a new OAUTH Ingress.", "Ingress.Namespace", ingOauth.Namespace, "Ingress.Name", ingOauth.Name)
-		err = r.Create(ctx, ingOauth)
-		if err != nil {
-			r.Log.Error(err, "Failed to create new OAUTH Ingress.", "Ingress.Namespace", ingOauth.Namespace, "Ingress.Name", ingOauth.Name)
-			return ctrl.Result{}, err
-		}
-	} else if err != nil {
-		r.Log.Error(err, "Failed to get OAUTH Ingress.")
+	if err = r.reconcileCertificate(ctx, devenv); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	proxyPod := &corev1.Pod{}
-	err = r.Get(ctx, types.NamespacedName{Name: r.proxyPodName, Namespace: r.ManagerNamespace}, proxyPod)
-	if err != nil && errors.IsNotFound(err) {
-		ppod := r.podOauthProxyForDevEnv(devenv)
-		r.Log.Info("Creating a new OAUTH Proxy Pod.", "Pod.Namespace", ppod.Namespace, "Pod.Name", ppod.Name)
-		err = r.Create(ctx, ppod)
-		if err != nil {
-			r.Log.Error(err, "Failed to create new OAUTH Proxy Pod.", "Pod.Namespace", ppod.Namespace, "Pod.Name", ppod.Name)
-			return ctrl.Result{}, err
-		}
-	} else if err != nil {
-		r.Log.Error(err, "Failed to get OAUTH Proxy Pod.")
-		return ctrl.Result{}, err
+	ctx = tr.startStage("OauthProxy")
+	if res, err := r.reconcileProxySecret(ctx, devenv); err != nil || res.Requeue || res.RequeueAfter > 0 {
+		return res, err
 	}
 
-	proxySecret := &corev1.Secret{}
-	err = r.Get(ctx, types.NamespacedName{Name: r.proxyPodName, Namespace: r.ManagerNamespace}, proxySecret)
-	if err != nil && errors.IsNotFound(err) {
-		proxysec := r.secretOauthProxyForDevEnv(devenv)
-		r.Log.Info("Creating a new OAUTH Proxy Secret.", "Secret.Namespace", proxysec.Namespace, "Secret.Name", proxysec.Name)
-		err = r.Create(ctx, proxysec)
-		if err != nil {
-			r.Log.Error(err, "Failed to create new OAUTH Proxy Secret.", "Secret.Namespace", proxysec.Namespace, "Secret.Name", proxysec.Name)
-			return ctrl.Result{}, err
-		}
-	} else if err != nil {
-		r.Log.Error(err, "Failed to get OAUTH Proxy Secret.")
-		return ctrl.Result{}, err
+	if res, err := r.reconcileProxyDeployment(ctx, devenv); err != nil || res.Requeue || res.RequeueAfter > 0 {
+		return res, err
 	}
 
-	oauthProxyService := &corev1.Service{}
-	err = r.Get(ctx, types.NamespacedName{Name: r.proxyPodName, Namespace: r.ManagerNamespace}, oauthProxyService)
-	if err != nil && errors.IsNotFound(err) {
-		psrv := r.serviceOauthProxyForDevEnv(devenv)
-		r.Log.Info("Creating a new OAUTH Proxy Service.", "Service.Namespace", psrv.Namespace, "Service.Name", psrv.Name)
-		err = r.Create(ctx, psrv)
-		if err != nil {
-			r.Log.Error(err, "Failed to create new OAUTH Proxy Service.", "Service.Namespace", psrv.Namespace, "Service.Name", psrv.Name)
-			return ctrl.Result{}, err
-		}
-	} else if err != nil {
-		r.Log.Error(err, "Failed to get OAUTH Proxy Service.")
+	if err = r.reconcileProxyService(ctx, devenv); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, nil
+	return ctrl.Result{RequeueAfter: r.requeueAfter()}, nil
 }
 
 func (r *DevEnvReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	if err := registerDevEnvCollector(mgr.GetClient()); err != nil {
+		return err
+	}
+	b := ctrl.NewControllerManagedBy(mgr)
+	for _, kind := range r.exposureKinds() {
+		b = b.Watches(&source.Kind{Type: newUnstructured(kind)}, enqueueDevEnvForLabels)
+	}
+	return b.
 		For(&cndev1alpha1.DevEnv{}).
-		Owns(&corev1.Pod{}).
-		Owns(&corev1.Service{}).
-		Owns(&corev1.Endpoints{}).
+		Watches(&source.Kind{Type: &appsv1.StatefulSet{}}, enqueueDevEnvForLabels).
+		Watches(&source.Kind{Type: &appsv1.Deployment{}}, enqueueDevEnvForLabels).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, enqueueDevEnvForLabels).
+		Watches(&source.Kind{Type: &corev1.Service{}}, enqueueDevEnvForLabels).
+		Watches(&source.Kind{Type: &corev1.PersistentVolumeClaim{}}, enqueueDevEnvForLabels).
+		Watches(&source.Kind{Type: newIngress(r.IngressAPI)}, enqueueDevEnvForLabels).
 		Owns(&corev1.Secret{}).
 		Owns(&corev1.ServiceAccount{}).
-		Owns(&corev1.PersistentVolumeClaim{}).
 		Owns(&corev1.Namespace{}).
 		Owns(&rbacv1.RoleBinding{}).
 		Owns(&rbacv1.ClusterRoleBinding{}).
-		Owns(&extv1beta1.Ingress{}).
 		Complete(r)
 }
 
+// realmPolicy returns the RealmPolicy the realms and oauth2-proxy are configured with
+func (r *DevEnvReconciler) realmPolicy() *oauth.RealmPolicy {
+	if r.RealmPolicy == nil {
+		return oauth.DefaultRealmPolicy()
+	}
+	return r.RealmPolicy
+}
+
+// oauthConfigFromEnv returns the name and the configuration of the OAUTH provider shared by all DevEnvs
+func (r *DevEnvReconciler) oauthConfigFromEnv() (string, *oauth.OAUTHProviderConfig, error) {
+	oauthProviderName, exists := os.LookupEnv("CNDE_OAUTH_PROVIDERNAME")
+	if !exists {
+		oauthProviderName = "keycloak"
+	}
+
+	oauthConfig := &oauth.OAUTHProviderConfig{
+		Log:                r.Log,
+		OauthAdminName:     os.Getenv("CNDE_OAUTH_ADMIN_NAME"),
+		OauthAdminPassword: os.Getenv("CNDE_OAUTH_ADMIN_PASSWORD"),
+		OauthAdminRealm:    os.Getenv("CNDE_OAUTH_ADMIN_REALM"),
+		OauthURL:           os.Getenv("CNDE_OAUTH_URL"),
+		OauthIssuerURL:     os.Getenv("CNDE_OAUTH_ISSUER_URL"),
+		OauthRealmMode:     oauth.RealmModePerDevEnv,
+		OauthSharedRealm:   os.Getenv("CNDE_OAUTH_SHARED_REALM"),
+		Timeout:            oauth.DefaultTimeout,
+		CallTimeout:        oauth.DefaultCallTimeout,
+		Client:             r.Client,
+		Namespace:          os.Getenv("CNDE_MANAGER_NAMESPACE"),
+		Federation:         r.Federation,
+		RealmPolicy:        r.realmPolicy(),
+	}
+
+	if realmMode, exists := os.LookupEnv("CNDE_OAUTH_REALM_MODE"); exists {
+		oauthConfig.OauthRealmMode = realmMode
+	}
+
+	if timeout, exists := os.LookupEnv("CNDE_OAUTH_TIMEOUT"); exists {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return "", nil, fmt.Errorf("CNDE_OAUTH_TIMEOUT: %v", err)
+		}
+		oauthConfig.Timeout = d
+	}
+
+	if timeout, exists := os.LookupEnv("CNDE_OAUTH_CALL_TIMEOUT"); exists {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return "", nil, fmt.Errorf("CNDE_OAUTH_CALL_TIMEOUT: %v", err)
+		}
+		oauthConfig.CallTimeout = d
+	}
+
+	if dexNamespace, exists := os.LookupEnv("CNDE_DEX_NAMESPACE"); exists {
+		oauthConfig.Namespace = dexNamespace
+	}
+	return oauthProviderName, oauthConfig, nil
+}
+
 // init local structure
-func (r *DevEnvReconciler) initStruct(userenv *cndev1alpha1.DevEnv) {
+func (r *DevEnvReconciler) initStruct(userenv *cndev1alpha1.DevEnv) error {
 
+	r.devEnvConfig = devEnvConfig{scheme: r.Scheme, policy: r.realmPolicy()}
 	r.ManagerNamespace = os.Getenv("CNDE_MANAGER_NAMESPACE")
 
 	r.serviceAccountName = "cnde"
+	if r.clusterDomain = os.Getenv("CNDE_CLUSTER_DOMAIN"); r.clusterDomain == "" {
+		r.clusterDomain = "cluster.local"
+	}
 	r.resourceName = "cnde-" + userenv.Name
 	r.ingressHost = userenv.Name + "." + userenv.Spec.UserEnvDomain
 
@@ -612,6 +589,38 @@ func (r *DevEnvReconciler) initStruct(userenv *cndev1alpha1.DevEnv) {
 		r.ingressHost = userenv.Name + "." + subDomain + "." + userenv.Spec.UserEnvDomain
 	}
 
+	r.ingressAPI = r.IngressAPI
+	r.ingressClassName = "nginx"
+	if class, exists := os.LookupEnv("CNDE_INGRESS_CLASS"); exists {
+		r.ingressClassName = class
+	}
+	if annotations, exists := os.LookupEnv("CNDE_INGRESS_ANNOTATIONS"); exists {
+		if err := json.Unmarshal([]byte(annotations), &r.extraIngressAnnotations); err != nil {
+			return fmt.Errorf("CNDE_INGRESS_ANNOTATIONS: %v", err)
+		}
+	}
+	r.tlsSecretName = r.resourceName + "-tls"
+	var err error
+	if r.tlsIssuerKind, r.tlsIssuerName, err = TLSIssuerFromEnv(); err != nil {
+		return err
+	}
+	r.oauthCAConfigMap = os.Getenv("CNDE_OAUTH_CA_CONFIGMAP")
+
+	if r.exposure = r.Exposure; r.exposure == "" {
+		r.exposure = ExposureIngress
+	}
+	if r.ingressAuth = r.IngressAuth; r.ingressAuth == "" {
+		r.ingressAuth = IngressAuthNginx
+	}
+	if r.exposure == ExposureGateway {
+		if r.gatewayNamespace, r.gatewayName, err = parseGatewayRef(os.Getenv("CNDE_GATEWAY"), r.ManagerNamespace); err != nil {
+			return fmt.Errorf("CNDE_GATEWAY: %v", err)
+		}
+		if r.gatewayAuth, err = ParseGatewayAuth(os.Getenv("CNDE_GATEWAY_AUTH")); err != nil {
+			return fmt.Errorf("CNDE_GATEWAY_AUTH: %v", err)
+		}
+	}
+
 	if memRequestIDE, exists := os.LookupEnv("CNDE_IDE_MEM_REQUEST"); exists {
 		r.memRequestIDE = resource.MustParse(memRequestIDE)
 	} else {
@@ -624,31 +633,48 @@ func (r *DevEnvReconciler) initStruct(userenv *cndev1alpha1.DevEnv) {
 		r.memRequestDocker = resource.MustParse("512Mi")
 	}
 
-	if oauthProviderName, exists := os.LookupEnv("CNDE_OAUTH_PROVIDERNAME"); exists {
-		r.oauthProviderName = oauthProviderName
-	} else {
-		r.oauthProviderName = "keycloak"
+	oauthProviderName, oauthConfig, err := r.oauthConfigFromEnv()
+	if err != nil {
+		return err
 	}
+	r.oauthProviderName = oauthProviderName
+	oauthConfig.DevEnvName = userenv.Name
+	oauthConfig.ResourceName = r.resourceName
+	oauthConfig.IngressHost = r.ingressHost
+	oauthConfig.OauthClientID = "c-n-d-e"
 
-	r.oauthClientID = "c-n-d-e"
+	if r.oauthDriftPolicy = os.Getenv("CNDE_OAUTH_DRIFT_POLICY"); r.oauthDriftPolicy == "" {
+		r.oauthDriftPolicy = driftPolicyRepair
+	}
 
-	oauthConfig := &oauth.OAUTHProviderConfig{
-		Log:                  r.Log,
-		OauthClientID:        r.oauthClientID,
-		OauthAdminName:       os.Getenv("CNDE_OAUTH_ADMIN_NAME"),
-		OauthAdminPassword:   os.Getenv("CNDE_OAUTH_ADMIN_PASSWORD"),
-		OauthAdminRealm:      os.Getenv("CNDE_OAUTH_ADMIN_REALM"),
-		OauthInitialPassword: os.Getenv("CNDE_OAUTH_INITIAL_PW"),
-		OauthURL:             os.Getenv("CNDE_OAUTH_URL"),
-		IngressHost:          r.ingressHost,
-		ResourceName:         r.resourceName,
+	r.oauthVerifyInterval = 0
+	if interval, exists := os.LookupEnv("CNDE_OAUTH_VERIFY_INTERVAL"); exists {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return fmt.Errorf("CNDE_OAUTH_VERIFY_INTERVAL: %v", err)
+		}
+		r.oauthVerifyInterval = d
 	}
 
-	switch r.oauthProviderName {
-	case "keycloak":
-		r.oauth = keycloak.NewKeycloakOAUTHProvider(oauthConfig)
+	r.secretRotationInterval = 0
+	if interval, exists := os.LookupEnv("CNDE_SECRET_ROTATION_INTERVAL"); exists {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return fmt.Errorf("CNDE_SECRET_ROTATION_INTERVAL: %v", err)
+		}
+		r.secretRotationInterval = d
 	}
 
+	if r.OAUTH != nil {
+		r.oauth = r.OAUTH
+	} else if r.oauth, err = oauth.NewOAUTHProvider(r.oauthProviderName, oauthConfig); err != nil {
+		return err
+	}
+	r.oauth = instrumentOAUTH(r.oauthProviderName, r.oauth, oauthConfig.CallTimeout)
+	r.oauthClientID = r.oauth.ClientID()
+	r.oauthIssuerURL = r.oauth.IssuerURL(userenv)
+	r.oauthAllowedGroups = r.oauth.AllowedGroups(userenv)
+
 	r.DevEnvNamespace = r.resourceName
 	r.homeVolumeName = r.resourceName + "-home-storage"
 	r.vmVolumeName = r.resourceName + "-vm-storage"
@@ -658,7 +684,13 @@ func (r *DevEnvReconciler) initStruct(userenv *cndev1alpha1.DevEnv) {
 
 	r.proxyPodName = r.resourceName + "-oauth-proxy"
 
+	r.initialPasswordName = r.resourceName + "-initial-password"
+	if r.initialPasswordNamespace = os.Getenv("CNDE_INITIAL_PASSWORD_NAMESPACE"); r.initialPasswordNamespace == "" {
+		r.initialPasswordNamespace = r.DevEnvNamespace
+	}
+
 	r.ingressUIName = r.resourceName + "-ui"
+	r.ingressTerminalName = r.resourceName + "-terminal"
 	r.ingressOauthName = r.resourceName + "-oauth"
 
 	r.dockerVolumeSize = userenv.Spec.HomeVolumeSize
@@ -679,7 +711,8 @@ func (r *DevEnvReconciler) initStruct(userenv *cndev1alpha1.DevEnv) {
 		r.configureImg = "eu.gcr.io/cloud-native-coding/code-server-example"
 	}
 	if r.oauthProxyImg = userenv.Spec.OauthProxyImg; r.oauthProxyImg == "" {
-		r.oauthProxyImg = "bitnami/oauth2-proxy:5"
+		// pinned, the terminal Ingress of the nginx auth relies on allowed_emails of /oauth2/auth
+		r.oauthProxyImg = "bitnami/oauth2-proxy:7.6.0"
 	}
 
 	r.alpineImage = "alpine:3"
@@ -692,14 +725,49 @@ func (r *DevEnvReconciler) initStruct(userenv *cndev1alpha1.DevEnv) {
 
 	// r.Log.Info("Images:", "Docker Img", r.DockerImg, "Kube Config Img", r.KubeConfigImg, "Configure Img", r.ConfigureImg,
 	// 	"Oauth Proxy Img", r.OauthProxyImg, "Alpine Image", r.AlpineImage)
+	return nil
 }
 
 func (r *DevEnvReconciler) setDevEnvStatus(ctx context.Context, devenv *cndev1alpha1.DevEnv, phase v1alpha1.BuildPhase) (ctrl.Result, error) {
+	previous := devenv.Status.Build
 	devenv.Status.Build = phase
 	err := r.Status().Update(ctx, devenv)
 	if err != nil {
 		r.Log.Error(err, "Failed to Update UserEnv Status to:", "devenv.Status.Build", devenv.Status.Build)
 		return ctrl.Result{}, err
 	}
+	if phase == v1alpha1.BuildPhaseRunning && previous != v1alpha1.BuildPhaseRunning {
+		timeToRunning.Observe(time.Since(devenv.CreationTimestamp.Time).Seconds())
+	}
 	return ctrl.Result{}, nil
 }
+
+// markFailureRecorded annotates a failed Pod, first is false if it was annotated before
+func (r *DevEnvReconciler) markFailureRecorded(ctx context.Context, pod *corev1.Pod) (first bool, err error) {
+	if _, recorded := pod.Annotations[failureRecordedAnnotation]; recorded {
+		return false, nil
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[failureRecordedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	if err = r.Update(ctx, pod); err != nil {
+		r.Log.Error(err, "Failed to annotate failed Pod.", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
+		return false, err
+	}
+	return true, nil
+}
+
+// podDuration returns the time from creation of a finished Pod until its last container terminated
+func podDuration(pod *corev1.Pod) time.Duration {
+	finished := pod.CreationTimestamp.Time
+	for _, c := range pod.Status.ContainerStatuses {
+		if t := c.State.Terminated; t != nil && t.FinishedAt.After(finished) {
+			finished = t.FinishedAt.Time
+		}
+	}
+	if finished.Equal(pod.CreationTimestamp.Time) {
+		return time.Since(finished)
+	}
+	return finished.Sub(pod.CreationTimestamp.Time)
+}
@@ -0,0 +1,571 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth/fake"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	testManagerNamespace = "cnde-system"
+	testBuilderName      = "builder"
+	// maxReconciles limits the reconciles until a DevEnv is expected to reach a phase
+	maxReconciles = 20
+	// eventBuffer is the number of Events the FakeRecorder keeps until they are read
+	eventBuffer = 1000
+)
+
+// the envtest API server keeps deleted namespaces terminating, so every DevEnv gets a name of its own
+var devEnvCount int
+
+// devEnvTest drives the DevEnvReconciler directly, pods are never scheduled by envtest,
+// so their phases and IPs are set by the test
+type devEnvTest struct {
+	ctx        context.Context
+	name       string
+	reconciler *DevEnvReconciler
+	oauth      *fake.OAUTHProvider
+	recorder   *record.FakeRecorder
+}
+
+func newDevEnvTest() *devEnvTest {
+	devEnvCount++
+	provider := fake.NewOAUTHProvider()
+	recorder := record.NewFakeRecorder(eventBuffer)
+	return &devEnvTest{
+		ctx:      context.Background(),
+		name:     fmt.Sprintf("devenv-%d", devEnvCount),
+		oauth:    provider,
+		recorder: recorder,
+		reconciler: &DevEnvReconciler{
+			Client:     k8sClient,
+			Log:        logf.Log.WithName("controllers").WithName("DevEnv"),
+			Scheme:     scheme.Scheme,
+			OAUTH:      provider,
+			Recorder:   recorder,
+			IngressAPI: ingressAPI,
+		},
+	}
+}
+
+// reasons returns "<type> <reason>" of the Events recorded since the last call
+func (t *devEnvTest) reasons() []string {
+	var reasons []string
+	for {
+		select {
+		case e := <-t.recorder.Events:
+			f := strings.Fields(e)
+			reasons = append(reasons, f[0]+" "+f[1])
+		default:
+			return reasons
+		}
+	}
+}
+
+func (t *devEnvTest) resourceName() string {
+	return "cnde-" + t.name
+}
+
+func (t *devEnvTest) create(builderName string, deleteVolumes bool) {
+	devenv := &cndev1alpha1.DevEnv{
+		ObjectMeta: metav1.ObjectMeta{Name: t.name},
+		Spec: cndev1alpha1.DevEnvSpec{
+			DockerVolumeSize: "1Gi",
+			HomeVolumeSize:   "1Gi",
+			DeleteVolumes:    deleteVolumes,
+			UserEnvDomain:    "example.com",
+			UserEmail:        t.name + "@example.com",
+			ClusterRoleName:  "view",
+			RoleName:         "edit",
+			BuilderName:      builderName,
+		},
+	}
+	Expect(k8sClient.Create(t.ctx, devenv)).To(Succeed())
+}
+
+func (t *devEnvTest) devenv() *cndev1alpha1.DevEnv {
+	devenv := &cndev1alpha1.DevEnv{}
+	Expect(k8sClient.Get(t.ctx, types.NamespacedName{Name: t.name}, devenv)).To(Succeed())
+	return devenv
+}
+
+func (t *devEnvTest) reconcile() ctrl.Result {
+	res, err := t.reconciler.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: t.name}})
+	Expect(err).NotTo(HaveOccurred())
+	return res
+}
+
+// reconcileUntil reconciles until the DevEnv is in the given phase
+func (t *devEnvTest) reconcileUntil(phase cndev1alpha1.BuildPhase) {
+	for i := 0; i < maxReconciles; i++ {
+		t.reconcile()
+		if t.devenv().Status.Build == phase {
+			return
+		}
+	}
+	Fail(fmt.Sprintf("DevEnv %s did not reach phase %q, it is in %q", t.name, phase, t.devenv().Status.Build))
+}
+
+func (t *devEnvTest) pod(name, namespace string) *corev1.Pod {
+	pod := &corev1.Pod{}
+	Expect(k8sClient.Get(t.ctx, types.NamespacedName{Name: name, Namespace: namespace}, pod)).To(Succeed())
+	return pod
+}
+
+func (t *devEnvTest) setPodStatus(name, namespace string, phase corev1.PodPhase, ip string) {
+	pod := t.pod(name, namespace)
+	pod.Status.Phase = phase
+	pod.Status.PodIP = ip
+	Expect(k8sClient.Status().Update(t.ctx, pod)).To(Succeed())
+}
+
+func (t *devEnvTest) exists(obj runtime.Object, name, namespace string) bool {
+	err := k8sClient.Get(t.ctx, types.NamespacedName{Name: name, Namespace: namespace}, obj)
+	if errors.IsNotFound(err) {
+		return false
+	}
+	Expect(err).NotTo(HaveOccurred())
+	return true
+}
+
+// expectOwnedByDevEnv verifies whether obj is garbage collected with the DevEnv
+func (t *devEnvTest) expectOwnedByDevEnv(obj metav1.Object, owned bool) {
+	refs := obj.GetOwnerReferences()
+	if !owned {
+		Expect(refs).To(BeEmpty(), "%s should outlive the DevEnv", obj.GetName())
+		return
+	}
+	Expect(refs).To(HaveLen(1), "%s should be deleted with the DevEnv", obj.GetName())
+	Expect(refs[0].Kind).To(Equal("DevEnv"))
+	Expect(refs[0].Name).To(Equal(t.name))
+}
+
+// runDevEnv creates a DevEnv and drives it to a running DevEnv StatefulSet with OAUTH Proxy
+func (t *devEnvTest) runDevEnv(builderName string, deleteVolumes bool) {
+	t.create(builderName, deleteVolumes)
+	if builderName != "" {
+		t.reconcileUntil(cndev1alpha1.BuildPhaseBuilding)
+		t.setPodStatus(t.resourceName()+"-build", testManagerNamespace, corev1.PodSucceeded, "")
+	}
+	t.reconcileUntil(cndev1alpha1.BuildPhaseInitializing)
+	t.setPodStatus(t.resourceName()+"-init", t.resourceName(), corev1.PodSucceeded, "")
+	t.reconcileUntil(cndev1alpha1.BuildPhaseRunning)
+
+	for i := 0; i < maxReconciles && !t.exists(&corev1.Service{}, t.resourceName()+"-oauth-proxy", testManagerNamespace); i++ {
+		t.reconcile()
+	}
+}
+
+var _ = Describe("DevEnv controller", func() {
+
+	BeforeEach(func() {
+		os.Setenv("CNDE_MANAGER_NAMESPACE", testManagerNamespace)
+		os.Unsetenv("CNDE_SUBDOMAIN")
+
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testManagerNamespace}}
+		if err := k8sClient.Create(context.Background(), ns); err != nil {
+			Expect(errors.IsAlreadyExists(err)).To(BeTrue())
+		}
+		builder := &cndev1alpha1.Builder{
+			ObjectMeta: metav1.ObjectMeta{Name: testBuilderName, Namespace: testManagerNamespace},
+			Spec: cndev1alpha1.BuilderSpec{
+				Template: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "build", Image: "kaniko", Args: []string{"--destination=$IMAGE_TAG"}}},
+				},
+			},
+		}
+		if err := k8sClient.Create(context.Background(), builder); err != nil {
+			Expect(errors.IsAlreadyExists(err)).To(BeTrue())
+		}
+	})
+
+	Context("without Builder", func() {
+		It("initializes and runs the DevEnv", func() {
+			t := newDevEnvTest()
+			t.create("", false)
+
+			t.reconcile()
+			Expect(t.exists(&corev1.Namespace{}, t.resourceName(), "")).To(BeTrue())
+			Expect(t.devenv().Status.Build).To(Equal(cndev1alpha1.BuildPhaseInitial))
+
+			t.reconcileUntil(cndev1alpha1.BuildPhaseWaitForInitializion)
+			devenv := t.devenv()
+			Expect(devenv.Finalizers).To(ContainElement(finalizerName))
+			Expect(devenv.Status.Realm).To(Equal(t.name))
+			Expect(devenv.Status.User).NotTo(BeEmpty())
+			Expect(t.oauth.HasRealm(t.name)).To(BeTrue())
+			Expect(t.oauth.User(devenv.Spec.UserEmail)).NotTo(BeNil())
+
+			ns := t.resourceName()
+			Expect(t.exists(&corev1.Secret{}, ns+"-initial-password", ns)).To(BeTrue())
+			Expect(t.exists(&corev1.ServiceAccount{}, "cnde", ns)).To(BeTrue())
+			Expect(t.exists(&rbacv1.RoleBinding{}, ns, ns)).To(BeTrue())
+			Expect(t.exists(&rbacv1.ClusterRoleBinding{}, ns, "")).To(BeTrue())
+			for _, pvc := range []string{"-home-storage", "-vm-storage", "-docker-storage"} {
+				Expect(t.exists(&corev1.PersistentVolumeClaim{}, ns+pvc, ns)).To(BeTrue(), pvc)
+			}
+
+			t.reconcileUntil(cndev1alpha1.BuildPhaseInitializing)
+			Expect(t.exists(&corev1.Pod{}, ns+"-init", ns)).To(BeTrue())
+			Expect(t.reasons()).To(ContainElements("Normal "+reasonCreated, "Normal "+reasonRealmCreated, "Normal "+reasonInitStarted))
+
+			// waits for the init Pod
+			t.reconcile()
+			Expect(t.devenv().Status.Build).To(Equal(cndev1alpha1.BuildPhaseInitializing))
+
+			t.setPodStatus(ns+"-init", ns, corev1.PodSucceeded, "")
+			t.reconcileUntil(cndev1alpha1.BuildPhaseRunning)
+			Expect(t.exists(&corev1.Pod{}, ns+"-init", ns)).To(BeFalse())
+			Expect(t.reasons()).To(ContainElement("Normal " + reasonInitSucceeded))
+
+			for i := 0; i < maxReconciles && !t.exists(&corev1.Service{}, ns+"-oauth-proxy", testManagerNamespace); i++ {
+				t.reconcile()
+			}
+
+			sts := &appsv1.StatefulSet{}
+			Expect(t.exists(sts, ns, ns)).To(BeTrue())
+			Expect(*sts.Spec.Replicas).To(Equal(int32(1)))
+			t.expectOwnedByDevEnv(sts, true)
+			ideService := &corev1.Service{}
+			Expect(t.exists(ideService, ns, ns)).To(BeTrue())
+			Expect(ideService.Spec.Selector).To(Equal(sts.Spec.Template.Labels))
+			Expect(ideService.Spec.Selector).To(HaveKeyWithValue(componentLabel, "ide"))
+			proxyService := &corev1.Service{}
+			Expect(t.exists(proxyService, ns, testManagerNamespace)).To(BeTrue())
+			Expect(proxyService.Spec.Type).To(Equal(corev1.ServiceTypeExternalName))
+			Expect(proxyService.Spec.ExternalName).To(Equal(ns + "." + ns + ".svc.cluster.local"))
+			Expect(t.exists(&corev1.Endpoints{}, ns, testManagerNamespace)).To(BeFalse())
+			for _, ing := range []string{"-ui", "-terminal", "-oauth"} {
+				Expect(t.exists(newIngress(ingressAPI), ns+ing, testManagerNamespace)).To(BeTrue(), ing)
+			}
+			secret := &corev1.Secret{}
+			Expect(t.exists(secret, ns+"-oauth-proxy", testManagerNamespace)).To(BeTrue())
+			clientSecret, _ := t.oauth.ClientSecret(t.name)
+			Expect(string(secret.Data["client_secret"])).To(Equal(clientSecret))
+			proxy := &appsv1.Deployment{}
+			Expect(t.exists(proxy, ns+"-oauth-proxy", testManagerNamespace)).To(BeTrue())
+			Expect(proxy.Spec.Template.Labels).To(Equal(proxy.Spec.Selector.MatchLabels))
+			Expect(t.reasons()).NotTo(ContainElement("Normal " + reasonProxyRestarted))
+
+			// a running DevEnv is stable
+			t.reconcile()
+			Expect(t.devenv().Status.Build).To(Equal(cndev1alpha1.BuildPhaseRunning))
+		})
+
+		It("recreates a deleted StatefulSet or Ingress", func() {
+			t := newDevEnvTest()
+			t.runDevEnv("", false)
+			ns := t.resourceName()
+
+			sts := &appsv1.StatefulSet{}
+			Expect(t.exists(sts, ns, ns)).To(BeTrue())
+			Expect(devEnvRequestForLabels(handler.MapObject{Meta: sts})).To(HaveLen(1))
+			Expect(k8sClient.Delete(t.ctx, sts)).To(Succeed())
+			t.reconcile()
+			Expect(t.exists(&appsv1.StatefulSet{}, ns, ns)).To(BeTrue())
+
+			ing := newIngress(ingressAPI)
+			Expect(t.exists(ing, ns+"-ui", testManagerNamespace)).To(BeTrue())
+			Expect(devEnvRequestForLabels(handler.MapObject{Meta: ing.(metav1.Object)})).To(HaveLen(1))
+			Expect(k8sClient.Delete(t.ctx, ing)).To(Succeed())
+			t.reconcile()
+			Expect(t.exists(newIngress(ingressAPI), ns+"-ui", testManagerNamespace)).To(BeTrue())
+		})
+
+		It("replaces the Pods and Service of former versions", func() {
+			t := newDevEnvTest()
+			t.create("", false)
+			t.reconcileUntil(cndev1alpha1.BuildPhaseInitializing)
+			ns := t.resourceName()
+			t.setPodStatus(ns+"-init", ns, corev1.PodSucceeded, "")
+			t.reconcileUntil(cndev1alpha1.BuildPhaseRunning)
+
+			container := []corev1.Container{{Name: "c", Image: "alpine:3"}}
+			legacy := []runtime.Object{
+				&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: ns, Namespace: ns, Labels: labelsForDevEnv(t.name)},
+					Spec: corev1.PodSpec{Containers: container}},
+				&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: ns + "-oauth-proxy", Namespace: testManagerNamespace, Labels: proxyLabelsForDevEnv(t.name)},
+					Spec: corev1.PodSpec{Containers: container}},
+				&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: ns, Namespace: testManagerNamespace, Labels: labelsForDevEnv(t.name)},
+					Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "ide", Port: idePort}}}},
+			}
+			for _, obj := range legacy {
+				Expect(k8sClient.Create(t.ctx, obj)).To(Succeed())
+			}
+
+			for i := 0; i < maxReconciles && !t.exists(&corev1.Service{}, ns+"-oauth-proxy", testManagerNamespace); i++ {
+				t.reconcile()
+			}
+			Expect(t.exists(&corev1.Pod{}, ns, ns)).To(BeFalse())
+			Expect(t.exists(&corev1.Pod{}, ns+"-oauth-proxy", testManagerNamespace)).To(BeFalse())
+			proxyService := &corev1.Service{}
+			Expect(t.exists(proxyService, ns, testManagerNamespace)).To(BeTrue())
+			Expect(proxyService.Spec.Type).To(Equal(corev1.ServiceTypeExternalName))
+			Expect(t.exists(&appsv1.StatefulSet{}, ns, ns)).To(BeTrue())
+			Expect(t.exists(&appsv1.Deployment{}, ns+"-oauth-proxy", testManagerNamespace)).To(BeTrue())
+		})
+
+		It("resets to WaitForInitializion if the init Pod is gone", func() {
+			t := newDevEnvTest()
+			t.create("", false)
+			t.reconcileUntil(cndev1alpha1.BuildPhaseInitializing)
+
+			Expect(k8sClient.Delete(t.ctx, t.pod(t.resourceName()+"-init", t.resourceName()))).To(Succeed())
+			t.reconcile()
+			Expect(t.devenv().Status.Build).To(Equal(cndev1alpha1.BuildPhaseWaitForInitializion))
+
+			t.reconcile()
+			Expect(t.devenv().Status.Build).To(Equal(cndev1alpha1.BuildPhaseInitializing))
+			Expect(t.exists(&corev1.Pod{}, t.resourceName()+"-init", t.resourceName())).To(BeTrue())
+		})
+
+		It("stops if the init Pod failed", func() {
+			t := newDevEnvTest()
+			t.create("", false)
+			t.reconcileUntil(cndev1alpha1.BuildPhaseInitializing)
+
+			t.setPodStatus(t.resourceName()+"-init", t.resourceName(), corev1.PodFailed, "")
+			Expect(t.reconcile()).To(Equal(ctrl.Result{}))
+			Expect(t.devenv().Status.Build).To(Equal(cndev1alpha1.BuildPhaseInitializing))
+			Expect(t.reasons()).To(ContainElement("Warning " + reasonInitFailed))
+		})
+	})
+
+	Context("with Builder", func() {
+		It("builds, initializes and runs the DevEnv", func() {
+			t := newDevEnvTest()
+			t.create(testBuilderName, false)
+			t.reconcileUntil(cndev1alpha1.BuildPhaseBuilding)
+
+			build := t.pod(t.resourceName()+"-build", testManagerNamespace)
+			Expect(build.Spec.RestartPolicy).To(Equal(corev1.RestartPolicyNever))
+			Expect(build.Spec.Containers[0].Args).To(ConsistOf("--destination=eu.gcr.io/cloud-native-coding/code-server-example"))
+
+			// waits for the build Pod
+			t.reconcile()
+			Expect(t.devenv().Status.Build).To(Equal(cndev1alpha1.BuildPhaseBuilding))
+
+			t.setPodStatus(t.resourceName()+"-build", testManagerNamespace, corev1.PodSucceeded, "")
+			t.reconcileUntil(cndev1alpha1.BuildPhaseWaitForInitializion)
+			Expect(t.exists(&corev1.Pod{}, t.resourceName()+"-build", testManagerNamespace)).To(BeFalse())
+			// recorded on the DevEnv and on the Builder
+			reasons := t.reasons()
+			Expect(reasons).To(ContainElement("Normal " + reasonBuildStarted))
+			Expect(reasons).To(ContainElement("Normal " + reasonBuildSucceeded))
+
+			t.reconcileUntil(cndev1alpha1.BuildPhaseInitializing)
+			t.setPodStatus(t.resourceName()+"-init", t.resourceName(), corev1.PodSucceeded, "")
+			t.reconcileUntil(cndev1alpha1.BuildPhaseRunning)
+		})
+
+		It("resets to Initial if the build Pod is gone", func() {
+			t := newDevEnvTest()
+			t.create(testBuilderName, false)
+			t.reconcileUntil(cndev1alpha1.BuildPhaseBuilding)
+
+			Expect(k8sClient.Delete(t.ctx, t.pod(t.resourceName()+"-build", testManagerNamespace))).To(Succeed())
+			t.reconcile()
+			Expect(t.devenv().Status.Build).To(Equal(cndev1alpha1.BuildPhaseInitial))
+
+			t.reconcile()
+			Expect(t.devenv().Status.Build).To(Equal(cndev1alpha1.BuildPhaseBuilding))
+			Expect(t.exists(&corev1.Pod{}, t.resourceName()+"-build", testManagerNamespace)).To(BeTrue())
+		})
+
+		It("stops if the build Pod failed", func() {
+			t := newDevEnvTest()
+			t.create(testBuilderName, false)
+			t.reconcileUntil(cndev1alpha1.BuildPhaseBuilding)
+
+			failures := testutil.ToFloat64(buildFailures.WithLabelValues(testBuilderName))
+			t.setPodStatus(t.resourceName()+"-build", testManagerNamespace, corev1.PodFailed, "")
+			Expect(t.reconcile()).To(Equal(ctrl.Result{}))
+			Expect(t.devenv().Status.Build).To(Equal(cndev1alpha1.BuildPhaseBuilding))
+			Expect(t.reasons()).To(ContainElement("Warning " + reasonBuildFailed))
+
+			// the failure is recorded once
+			t.reconcile()
+			Expect(t.reasons()).NotTo(ContainElement("Warning " + reasonBuildFailed))
+			Expect(testutil.ToFloat64(buildFailures.WithLabelValues(testBuilderName))).To(Equal(failures + 1))
+		})
+
+		It("fails if the Builder does not exist", func() {
+			t := newDevEnvTest()
+			t.create("missing", false)
+			_, err := t.reconciler.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: t.name}})
+			Expect(err).To(HaveOccurred())
+			Expect(t.reasons()).To(ContainElement("Warning " + reasonBuilderNotFound))
+		})
+	})
+
+	Context("deleting a DevEnv", func() {
+		for _, deleteVolumes := range []bool{false, true} {
+			deleteVolumes := deleteVolumes
+			It(fmt.Sprintf("cleans up with deleteVolumes %v", deleteVolumes), func() {
+				t := newDevEnvTest()
+				t.runDevEnv(testBuilderName, deleteVolumes)
+				ns := t.resourceName()
+
+				// the volumes and their namespace are garbage collected only if deleteVolumes is set
+				namespace := &corev1.Namespace{}
+				Expect(t.exists(namespace, ns, "")).To(BeTrue())
+				t.expectOwnedByDevEnv(namespace, deleteVolumes)
+				for _, name := range []string{"-home-storage", "-vm-storage", "-docker-storage"} {
+					pvc := &corev1.PersistentVolumeClaim{}
+					Expect(t.exists(pvc, ns+name, ns)).To(BeTrue())
+					t.expectOwnedByDevEnv(pvc, deleteVolumes)
+				}
+				pod := &corev1.Pod{}
+				Expect(t.exists(pod, ns, ns)).To(BeTrue())
+				t.expectOwnedByDevEnv(pod, true)
+
+				// a build Pod left over is deleted with the DevEnv
+				build := &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: ns + "-build", Namespace: testManagerNamespace},
+					Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "build", Image: "kaniko"}}},
+				}
+				Expect(k8sClient.Create(t.ctx, build)).To(Succeed())
+
+				Expect(k8sClient.Delete(t.ctx, t.devenv())).To(Succeed())
+				t.reconcile()
+
+				Expect(t.exists(&cndev1alpha1.DevEnv{}, t.name, "")).To(BeFalse())
+				Expect(t.exists(&corev1.Pod{}, ns+"-build", testManagerNamespace)).To(BeFalse())
+				// objects in the manager namespace and cluster scoped ones are deleted by the operator
+				for _, ing := range []string{"-ui", "-terminal", "-oauth"} {
+					Expect(t.exists(newIngress(ingressAPI), ns+ing, testManagerNamespace)).To(BeFalse(), ing)
+				}
+				Expect(t.exists(&appsv1.Deployment{}, ns+"-oauth-proxy", testManagerNamespace)).To(BeFalse())
+				Expect(t.exists(&corev1.Secret{}, ns+"-oauth-proxy", testManagerNamespace)).To(BeFalse())
+				Expect(t.exists(&corev1.Service{}, ns+"-oauth-proxy", testManagerNamespace)).To(BeFalse())
+				Expect(t.exists(&corev1.Service{}, ns, testManagerNamespace)).To(BeFalse())
+				Expect(t.exists(&rbacv1.ClusterRoleBinding{}, ns, "")).To(BeFalse())
+				Expect(t.exists(&appsv1.StatefulSet{}, ns, ns)).To(BeFalse())
+				Expect(t.exists(&corev1.Service{}, ns, ns)).To(BeFalse())
+				if !deleteVolumes {
+					Expect(t.exists(&corev1.PersistentVolumeClaim{}, ns+"-home-storage", ns)).To(BeTrue())
+				}
+				Expect(t.oauth.HasRealm(t.name)).To(BeFalse())
+				_, hasClient := t.oauth.ClientSecret(t.name)
+				Expect(hasClient).To(BeFalse())
+				Expect(t.oauth.User(t.name + "@example.com")).To(BeNil())
+			})
+		}
+
+		It("removes only its own finalizer", func() {
+			const otherFinalizer = "example.com/other"
+			t := newDevEnvTest()
+			t.create("", false)
+			t.reconcileUntil(cndev1alpha1.BuildPhaseWaitForInitializion)
+			devenv := t.devenv()
+			devenv.Finalizers = append(devenv.Finalizers, otherFinalizer)
+			Expect(k8sClient.Update(t.ctx, devenv)).To(Succeed())
+
+			Expect(k8sClient.Delete(t.ctx, t.devenv())).To(Succeed())
+			t.reconcile()
+			devenv = t.devenv()
+			Expect(devenv.Finalizers).To(ConsistOf(otherFinalizer))
+			Expect(devenv.Status.GetCondition(cndev1alpha1.DevEnvConditionDeleting)).NotTo(BeNil())
+			Expect(t.exists(&rbacv1.ClusterRoleBinding{}, t.resourceName(), "")).To(BeFalse())
+
+			devenv.Finalizers = nil
+			Expect(k8sClient.Update(t.ctx, devenv)).To(Succeed())
+			Expect(t.exists(&cndev1alpha1.DevEnv{}, t.name, "")).To(BeFalse())
+		})
+
+		It("keeps the finalizer if the OAUTH provider fails", func() {
+			t := newDevEnvTest()
+			t.create("", false)
+			t.reconcileUntil(cndev1alpha1.BuildPhaseWaitForInitializion)
+
+			t.oauth.SetError("DeleteRealm", fmt.Errorf("unavailable"))
+			Expect(k8sClient.Delete(t.ctx, t.devenv())).To(Succeed())
+			_, err := t.reconciler.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: t.name}})
+			Expect(err).To(HaveOccurred())
+			Expect(t.devenv().Finalizers).To(ContainElement(finalizerName))
+			Expect(t.reasons()).To(ContainElement("Warning " + reasonDeleteFailed))
+			deleting := t.devenv().Status.GetCondition(cndev1alpha1.DevEnvConditionDeleting)
+			Expect(deleting).NotTo(BeNil())
+			Expect(deleting.Reason).To(Equal(deletingOauth))
+			Expect(deleting.Message).To(ContainSubstring("unavailable"))
+
+			t.oauth.SetError("DeleteRealm", nil)
+			t.reconcile()
+			Expect(t.exists(&cndev1alpha1.DevEnv{}, t.name, "")).To(BeFalse())
+		})
+	})
+
+	Context("collecting orphans", func() {
+		It("deletes or reports objects of missing DevEnvs according to the policy", func() {
+			t := newDevEnvTest()
+			t.create("", false)
+			orphanLabels := labelsForDevEnv(t.name + "-gone")
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Name: t.name + "-gone", Namespace: testManagerNamespace, Labels: orphanLabels}}
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: t.name + "-gone", Namespace: testManagerNamespace, Labels: orphanLabels},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{
+						corev1.ResourceStorage: resource.MustParse("1Gi")}},
+				},
+			}
+			kept := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Name: t.name + "-kept", Namespace: testManagerNamespace, Labels: labelsForDevEnv(t.name)}}
+			unrelated := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Name: t.name + "-unrelated", Namespace: testManagerNamespace, Labels: map[string]string{userenvnameLabel: t.name + "-gone"}}}
+			for _, obj := range []runtime.Object{secret, pvc, kept, unrelated} {
+				Expect(k8sClient.Create(t.ctx, obj)).To(Succeed())
+			}
+			secretName := "Secret " + objectName(testManagerNamespace, secret.Name)
+			pvcName := "PersistentVolumeClaim " + objectName(testManagerNamespace, pvc.Name)
+			collector := &OrphanCollector{Reconciler: t.reconciler}
+
+			orphans, err := collector.collect(t.ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(orphans).To(ContainElement(secretName))
+			Expect(orphans).To(ContainElement(pvcName))
+			Expect(orphans).NotTo(ContainElement("Secret " + objectName(testManagerNamespace, kept.Name)))
+			Expect(orphans).NotTo(ContainElement("Secret " + objectName(testManagerNamespace, unrelated.Name)))
+			Expect(t.exists(&corev1.Secret{}, secret.Name, testManagerNamespace)).To(BeTrue())
+			Expect(testutil.ToFloat64(orphanedObjects.WithLabelValues("Secret"))).To(BeNumerically(">=", 1))
+
+			deleted := testutil.ToFloat64(orphansDeleted.WithLabelValues("Secret"))
+			collector.Policy = OrphanPolicyKeepVolumes
+			_, err = collector.collect(t.ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t.exists(&corev1.Secret{}, secret.Name, testManagerNamespace)).To(BeFalse())
+			Expect(t.exists(&corev1.PersistentVolumeClaim{}, pvc.Name, testManagerNamespace)).To(BeTrue())
+			Expect(testutil.ToFloat64(orphansDeleted.WithLabelValues("Secret"))).To(BeNumerically(">", deleted))
+
+			collector.Policy = OrphanPolicyDelete
+			orphans, err = collector.collect(t.ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(orphans).To(ContainElement(pvcName))
+			Expect(t.exists(&corev1.PersistentVolumeClaim{}, pvc.Name, testManagerNamespace)).To(BeFalse())
+			Expect(t.exists(&corev1.Secret{}, kept.Name, testManagerNamespace)).To(BeTrue())
+			Expect(t.exists(&corev1.Secret{}, unrelated.Name, testManagerNamespace)).To(BeTrue())
+		})
+	})
+})
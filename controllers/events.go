@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// reasons of the Events recorded on DevEnvs and Builders
+const (
+	reasonCreated            = "Created"
+	reasonCreateFailed       = "CreateFailed"
+	reasonNamespaceForbidden = "NamespaceForbidden"
+	reasonBuilderNotFound    = "BuilderNotFound"
+
+	reasonAllowedGroupsRejected = "AllowedGroupsRejected"
+
+	reasonRealmCreated    = "RealmCreated"
+	reasonOauthNotFound   = "OauthNotFound"
+	reasonOauthDrifted    = "OauthDrifted"
+	reasonOauthError      = "OauthProviderError"
+	reasonPasswordRotated = "PasswordRotated"
+	reasonSecretsRotated  = "SecretsRotated"
+	reasonProxyRestarted  = "ProxyRestarted"
+
+	reasonCertificateReady    = "CertificateReady"
+	reasonCertificateNotReady = "CertificateNotReady"
+	reasonRouteAccepted       = "RouteAccepted"
+	reasonRouteNotAccepted    = "RouteNotAccepted"
+
+	reasonBuildStarted   = "BuildStarted"
+	reasonBuildSucceeded = "BuildSucceeded"
+	reasonBuildFailed    = "BuildFailed"
+	reasonBuildPodLost   = "BuildPodLost"
+
+	reasonInitStarted   = "InitializationStarted"
+	reasonInitSucceeded = "Initialized"
+	reasonInitFailed    = "InitializationFailed"
+	reasonInitPodLost   = "InitPodLost"
+
+	reasonOauthDeleted   = "OauthDeleted"
+	reasonObjectsDeleted = "ObjectsDeleted"
+	reasonDeleteFailed   = "DeleteFailed"
+)
+
+// eventf records an Event on obj, a DevEnv or a Builder. Reconcilers without Recorder, e.g. of Render, record nothing.
+func (r *DevEnvReconciler) eventf(obj runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(obj, eventtype, reason, messageFmt, args...)
+}
+
+// recordCreate records whether creating the object of the DevEnv succeeded
+func (r *DevEnvReconciler) recordCreate(obj runtime.Object, kind, name string, err error) {
+	if err != nil {
+		r.eventf(obj, corev1.EventTypeWarning, reasonCreateFailed, "Failed to create %s %s: %v", kind, name, err)
+		return
+	}
+	r.eventf(obj, corev1.EventTypeNormal, reasonCreated, "Created %s %s", kind, name)
+}
+
+// recordOauthNotReady records why the OAUTH provider does not match the DevEnv
+func (r *DevEnvReconciler) recordOauthNotReady(obj runtime.Object, reason string, err error) {
+	switch reason {
+	case "NotFound":
+		r.eventf(obj, corev1.EventTypeWarning, reasonOauthNotFound, "OAUTH provider: %v", err)
+	case "Drifted":
+		r.eventf(obj, corev1.EventTypeWarning, reasonOauthDrifted, "OAUTH provider: %v", err)
+	default:
+		r.eventf(obj, corev1.EventTypeWarning, reasonOauthError, "OAUTH provider: %v", err)
+	}
+}
+
+// objectName returns namespace/name or name of cluster scoped objects for messages of Events
+func objectName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Exposure is how DevEnvs are reachable from outside of the cluster
+type Exposure string
+
+const (
+	// ExposureIngress creates the UI, terminal and OAUTH Ingresses, protected as selected by CNDE_INGRESS_AUTH
+	ExposureIngress Exposure = "ingress"
+	// ExposureGateway creates an HTTPRoute attached to the Gateway of CNDE_GATEWAY
+	ExposureGateway Exposure = "gateway"
+)
+
+// ParseExposure returns the exposure named s, ingress if s is empty
+func ParseExposure(s string) (Exposure, error) {
+	switch e := Exposure(s); e {
+	case "":
+		return ExposureIngress, nil
+	case ExposureIngress, ExposureGateway:
+		return e, nil
+	}
+	return "", fmt.Errorf("unknown exposure %q, want %s or %s", s, ExposureIngress, ExposureGateway)
+}
+
+// IngressAuth is how the Ingresses of a DevEnv enforce authentication, it depends on the ingress controller
+type IngressAuth string
+
+const (
+	// IngressAuthNginx lets ingress-nginx ask oauth2-proxy by its auth-url annotations
+	IngressAuthNginx IngressAuth = "nginx"
+	// IngressAuthTraefik lets Traefik ask oauth2-proxy by ForwardAuth Middlewares
+	IngressAuthTraefik IngressAuth = "traefik"
+	// IngressAuthProxy routes the Ingresses to oauth2-proxy, which passes requests on to the IDE.
+	// It works with every ingress controller.
+	IngressAuthProxy IngressAuth = "proxy"
+)
+
+// ParseIngressAuth returns the auth named s, nginx if s is empty
+func ParseIngressAuth(s string) (IngressAuth, error) {
+	switch a := IngressAuth(s); a {
+	case "":
+		return IngressAuthNginx, nil
+	case IngressAuthNginx, IngressAuthTraefik, IngressAuthProxy:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown ingress auth %q, want %s, %s or %s", s, IngressAuthNginx, IngressAuthTraefik, IngressAuthProxy)
+}
+
+// proxyMode is how oauth2-proxy handles the requests of a DevEnv
+type proxyMode int
+
+const (
+	// proxyModeAuthRequest answers subrequests to /oauth2/auth, the terminal is limited by their allowed_emails
+	proxyModeAuthRequest proxyMode = iota
+	// proxyModeApprove answers requests forwarded for approval with 202 if admitted, a terminal container
+	// admits the owner and editors only
+	proxyModeApprove
+	// proxyModeUpstream passes admitted requests on to the IDE, a terminal container those of the owner
+	// and editors to the terminal
+	proxyModeUpstream
+)
+
+// exposureBackend exposes a DevEnv and protects it by oauth2-proxy the way an ingress controller or gateway supports
+type exposureBackend interface {
+	// proxyMode is how oauth2-proxy handles the requests of the DevEnv
+	proxyMode() proxyMode
+	// objects returns the objects exposing the DevEnv, in the order they are created
+	objects(cr *cndev1alpha1.DevEnv) []runtime.Object
+	// kinds returns the kinds of the objects besides Ingresses, they are watched and deleted with the DevEnv
+	kinds() []schema.GroupVersionKind
+}
+
+// exposureBackend returns the backend selected by exposure, ingressAuth and gatewayAuth
+func (r *devEnvConfig) exposureBackend() exposureBackend {
+	switch {
+	case r.exposure == ExposureGateway:
+		return gatewayBackend{r}
+	case r.ingressAuth == IngressAuthTraefik:
+		return traefikBackend{r}
+	case r.ingressAuth == IngressAuthProxy:
+		return proxyBackend{r}
+	}
+	return nginxBackend{r}
+}
+
+// exposureKinds returns the kinds of the exposure backend besides Ingresses and the Certificate if the operator
+// requests it, known before initStruct
+func (r *DevEnvReconciler) exposureKinds() []schema.GroupVersionKind {
+	c := &devEnvConfig{exposure: r.Exposure, ingressAuth: r.IngressAuth}
+	c.tlsIssuerKind, c.tlsIssuerName, _ = TLSIssuerFromEnv()
+	kinds := c.exposureBackend().kinds()
+	if c.managesCertificate() {
+		kinds = append(kinds, certificateKind)
+	}
+	return kinds
+}
+
+// proxyBackend routes the Ingresses to oauth2-proxy, the terminal to its terminal container
+type proxyBackend struct{ *devEnvConfig }
+
+func (b proxyBackend) proxyMode() proxyMode { return proxyModeUpstream }
+
+func (b proxyBackend) kinds() []schema.GroupVersionKind { return nil }
+
+func (b proxyBackend) objects(cr *cndev1alpha1.DevEnv) []runtime.Object {
+	return []runtime.Object{
+		b.ingressUIForDevEnv(cr, b.ManagerNamespace, b.proxyPodName, proxyPort, map[string]string{}),
+		b.ingressTerminalForDevEnv(cr, b.ManagerNamespace, b.proxyPodName, proxyTerminalPort, map[string]string{}),
+		b.ingressOauthForDevEnv(cr),
+	}
+}
+
+// isIngress reports whether obj is an Ingress of either API
+func isIngress(obj runtime.Object) bool {
+	u, ok := obj.(*unstructured.Unstructured)
+	return !ok || u.GroupVersionKind() == networkingV1Ingress
+}
+
+// reconcileExposure creates or updates the objects of the exposure backend and deletes the Ingresses of the
+// DevEnv which the backend does not create, e.g. after switching to the Gateway
+func (r *DevEnvReconciler) reconcileExposure(ctx context.Context, devenv *cndev1alpha1.DevEnv) error {
+	ingresses := map[string]bool{}
+	for _, obj := range r.exposureBackend().objects(devenv) {
+		var err error
+		if isIngress(obj) {
+			meta := obj.(metav1.Object)
+			ingresses[objectName(meta.GetNamespace(), meta.GetName())] = true
+			err = r.reconcileIngress(ctx, devenv, obj)
+		} else {
+			err = r.reconcileUnstructured(ctx, devenv, obj.(*unstructured.Unstructured))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// the Ingresses of Traefik live in the DevEnv namespace, those of the other backends in the manager namespace
+	for _, namespace := range []string{r.ManagerNamespace, r.DevEnvNamespace} {
+		for _, name := range []string{r.ingressUIName, r.ingressTerminalName, r.ingressOauthName} {
+			if ingresses[objectName(namespace, name)] {
+				continue
+			}
+			ing := newIngress(r.ingressAPI)
+			err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, ing)
+			if errors.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			r.Log.Info("Deleting Ingress, the exposure of the DevEnv changed.", "Ingress.Namespace", namespace, "Ingress.Name", name)
+			if err = r.Delete(ctx, ing); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reconcileUnstructured creates an object of a kind the client-go of the operator does not know or updates
+// its spec and labels if they differ from the desired ones
+func (r *DevEnvReconciler) reconcileUnstructured(ctx context.Context, devenv *cndev1alpha1.DevEnv, desired *unstructured.Unstructured) error {
+	kind := desired.GetKind()
+	found := newUnstructured(desired.GroupVersionKind())
+	err := r.Get(ctx, types.NamespacedName{Name: desired.GetName(), Namespace: desired.GetNamespace()}, found)
+	if err != nil && errors.IsNotFound(err) {
+		r.Log.Info("Creating a new "+kind+".", kind+".Namespace", desired.GetNamespace(), kind+".Name", desired.GetName())
+		err = r.Create(ctx, desired)
+		r.recordCreate(devenv, kind, objectName(desired.GetNamespace(), desired.GetName()), err)
+		if err != nil {
+			r.Log.Error(err, "Failed to create new "+kind+".", kind+".Namespace", desired.GetNamespace(), kind+".Name", desired.GetName())
+		}
+		return err
+	} else if err != nil {
+		r.Log.Error(err, "Failed to get "+kind+".")
+		return err
+	}
+
+	if equality.Semantic.DeepEqual(found.Object["spec"], desired.Object["spec"]) && reflect.DeepEqual(found.GetLabels(), desired.GetLabels()) {
+		return nil
+	}
+	r.Log.Info("Updating "+kind+".", kind+".Namespace", found.GetNamespace(), kind+".Name", found.GetName())
+	found.Object["spec"] = desired.Object["spec"]
+	found.SetLabels(desired.GetLabels())
+	if err = r.Update(ctx, found); err != nil {
+		r.Log.Error(err, "Failed to update "+kind+".")
+	}
+	return err
+}
+
+// newUnstructured returns an empty object of the kind
+func newUnstructured(gvk schema.GroupVersionKind) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(gvk)
+	return u
+}
+
+// newUnstructuredList returns an empty list of the kind
+func newUnstructuredList(gvk schema.GroupVersionKind) *unstructured.UnstructuredList {
+	u := &unstructured.UnstructuredList{}
+	u.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	return u
+}
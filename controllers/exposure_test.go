@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestExposureBackend(t *testing.T) {
+	tests := []struct {
+		name        string
+		exposure    Exposure
+		ingressAuth IngressAuth
+		gatewayAuth GatewayAuth
+		want        exposureBackend
+		wantMode    proxyMode
+		wantKinds   []schema.GroupVersionKind
+	}{
+		{"default", "", "", "", nginxBackend{}, proxyModeAuthRequest, nil},
+		{"nginx", ExposureIngress, IngressAuthNginx, "", nginxBackend{}, proxyModeAuthRequest, nil},
+		{"traefik", ExposureIngress, IngressAuthTraefik, "", traefikBackend{}, proxyModeApprove, []schema.GroupVersionKind{middlewareKind}},
+		{"proxy in front", ExposureIngress, IngressAuthProxy, "", proxyBackend{}, proxyModeUpstream, nil},
+		{"gateway through proxy", ExposureGateway, IngressAuthTraefik, GatewayAuthProxy, gatewayBackend{}, proxyModeUpstream,
+			[]schema.GroupVersionKind{httpRouteKind, referenceGrantKind}},
+		{"gateway with external auth", ExposureGateway, "", GatewayAuthExternal, gatewayBackend{}, proxyModeApprove,
+			[]schema.GroupVersionKind{httpRouteKind, referenceGrantKind}},
+	}
+	for _, tt := range tests {
+		b := (&devEnvConfig{exposure: tt.exposure, ingressAuth: tt.ingressAuth, gatewayAuth: tt.gatewayAuth}).exposureBackend()
+		if reflect.TypeOf(b) != reflect.TypeOf(tt.want) {
+			t.Errorf("%s: got backend %T, want %T", tt.name, b, tt.want)
+			continue
+		}
+		if b.proxyMode() != tt.wantMode {
+			t.Errorf("%s: got proxy mode %d, want %d", tt.name, b.proxyMode(), tt.wantMode)
+		}
+		if !reflect.DeepEqual(b.kinds(), tt.wantKinds) {
+			t.Errorf("%s: got kinds %v, want %v", tt.name, b.kinds(), tt.wantKinds)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// GatewayAuth is how the HTTPRoute of a DevEnv enforces authentication
+type GatewayAuth string
+
+const (
+	// GatewayAuthProxy routes all requests to oauth2-proxy, which passes them on to the IDE
+	GatewayAuthProxy GatewayAuth = "proxy"
+	// GatewayAuthExternal routes requests to the IDE, an ExternalAuth filter asks oauth2-proxy first. The filter
+	// is part of the experimental channel of the Gateway API, with the CRDs of the standard channel the
+	// HTTPRoute is not accepted.
+	GatewayAuthExternal GatewayAuth = "external-auth"
+
+	// routePending is the reason of condition RouteAccepted until the Gateway reports on the HTTPRoute
+	routePending = "Pending"
+)
+
+// ParseGatewayAuth returns the auth named s, proxy if s is empty
+func ParseGatewayAuth(s string) (GatewayAuth, error) {
+	switch a := GatewayAuth(s); a {
+	case "":
+		return GatewayAuthProxy, nil
+	case GatewayAuthProxy, GatewayAuthExternal:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown gateway auth %q, want %s or %s (needs the experimental CRDs of the Gateway API)", s, GatewayAuthProxy, GatewayAuthExternal)
+}
+
+// parseGatewayRef returns namespace and name of CNDE_GATEWAY, given as <namespace>/<name> or <name> for
+// a Gateway in the manager namespace
+func parseGatewayRef(s, defaultNamespace string) (namespace, name string, err error) {
+	parts := strings.Split(s, "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return defaultNamespace, parts[0], nil
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("invalid gateway %q, want <namespace>/<name>", s)
+}
+
+// The client-go of the operator does not know the Gateway API, its objects are unstructured
+var (
+	httpRouteKind      = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1", Kind: "HTTPRoute"}
+	referenceGrantKind = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1beta1", Kind: "ReferenceGrant"}
+)
+
+// pathPrefix matches the requests of the HTTPRoute starting with path
+func pathPrefix(path string) []interface{} {
+	return []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": path}}}
+}
+
+// backendRef refers to the port of a Service, in the namespace of the HTTPRoute if namespace is empty
+func backendRef(name, namespace string, port int64) map[string]interface{} {
+	ref := map[string]interface{}{"name": name, "port": port}
+	if namespace != "" {
+		ref["namespace"] = namespace
+	}
+	return ref
+}
+
+// httpRouteForDevEnv routes the requests to the host of the DevEnv. /oauth2 always reaches oauth2-proxy. With auth
+// proxy the IDE and the terminal are reached through oauth2-proxy and its terminal container, which admits
+// the owner and editors only. With external-auth they are reached directly after an ExternalAuth filter
+// asked oauth2-proxy or its terminal container.
+func (r *devEnvConfig) httpRouteForDevEnv(cr *cndev1alpha1.DevEnv) *unstructured.Unstructured {
+	terminal := map[string]interface{}{
+		"matches":     pathPrefix("/terminal/"),
+		"backendRefs": []interface{}{backendRef(r.proxyPodName, "", proxyTerminalPort)},
+	}
+	ide := map[string]interface{}{
+		"matches":     pathPrefix("/"),
+		"backendRefs": []interface{}{backendRef(r.proxyPodName, "", proxyPort)},
+	}
+	if r.gatewayAuth == GatewayAuthExternal {
+		terminal["backendRefs"] = []interface{}{backendRef(r.resourceName, r.DevEnvNamespace, ttydPort)}
+		terminal["filters"] = externalAuthFilter(r.proxyPodName, proxyTerminalPort)
+		ide["backendRefs"] = []interface{}{backendRef(r.resourceName, r.DevEnvNamespace, idePort)}
+		ide["filters"] = externalAuthFilter(r.proxyPodName, proxyPort)
+	}
+
+	route := newUnstructured(httpRouteKind)
+	route.Object["spec"] = map[string]interface{}{
+		"parentRefs": []interface{}{map[string]interface{}{"name": r.gatewayName, "namespace": r.gatewayNamespace}},
+		"hostnames":  []interface{}{r.ingressHost},
+		"rules": []interface{}{
+			map[string]interface{}{
+				"matches":     pathPrefix("/oauth2"),
+				"backendRefs": []interface{}{backendRef(r.proxyPodName, "", proxyPort)},
+			},
+			terminal,
+			ide,
+		},
+	}
+	route.SetName(r.resourceName)
+	route.SetNamespace(r.ManagerNamespace)
+	route.SetLabels(labelsForDevEnv(cr.Name))
+
+	controllerutil.SetControllerReference(cr, route, r.scheme)
+	return route
+}
+
+// externalAuthFilter asks the port of oauth2-proxy whether to admit a request
+func externalAuthFilter(proxy string, port int64) []interface{} {
+	return []interface{}{map[string]interface{}{
+		"type": "ExternalAuth",
+		"externalAuth": map[string]interface{}{
+			"protocol":   "HTTP",
+			"backendRef": backendRef(proxy, "", port),
+		},
+	}}
+}
+
+// referenceGrantForDevEnv allows the HTTPRoute in the manager namespace to route to the Service of the IDE,
+// it is only needed with auth external-auth
+func (r *devEnvConfig) referenceGrantForDevEnv(cr *cndev1alpha1.DevEnv) *unstructured.Unstructured {
+	grant := newUnstructured(referenceGrantKind)
+	grant.Object["spec"] = map[string]interface{}{
+		"from": []interface{}{map[string]interface{}{
+			"group":     httpRouteKind.Group,
+			"kind":      httpRouteKind.Kind,
+			"namespace": r.ManagerNamespace,
+		}},
+		"to": []interface{}{map[string]interface{}{
+			"group": "",
+			"kind":  "Service",
+			"name":  r.resourceName,
+		}},
+	}
+	grant.SetName(r.resourceName)
+	grant.SetNamespace(r.DevEnvNamespace)
+	grant.SetLabels(labelsForDevEnv(cr.Name))
+
+	controllerutil.SetControllerReference(cr, grant, r.scheme)
+	return grant
+}
+
+// gatewayBackend routes the HTTPRoute to oauth2-proxy with auth proxy, or to the IDE and asks oauth2-proxy
+// by ExternalAuth filters with auth external-auth
+type gatewayBackend struct{ *devEnvConfig }
+
+func (b gatewayBackend) proxyMode() proxyMode {
+	if b.gatewayAuth == GatewayAuthExternal {
+		return proxyModeApprove
+	}
+	return proxyModeUpstream
+}
+
+func (b gatewayBackend) kinds() []schema.GroupVersionKind {
+	return []schema.GroupVersionKind{httpRouteKind, referenceGrantKind}
+}
+
+func (b gatewayBackend) objects(cr *cndev1alpha1.DevEnv) []runtime.Object {
+	if b.gatewayAuth == GatewayAuthExternal {
+		return []runtime.Object{b.referenceGrantForDevEnv(cr), b.httpRouteForDevEnv(cr)}
+	}
+	return []runtime.Object{b.httpRouteForDevEnv(cr)}
+}
+
+// reconcileRouteAccepted reports whether the Gateway accepted the HTTPRoute as condition RouteAccepted of the
+// DevEnv, e.g. an ExternalAuth filter is rejected with the CRDs of the standard channel. The Gateway updating
+// the HTTPRoute triggers the next reconcile. Without the Gateway API the condition is removed.
+func (r *DevEnvReconciler) reconcileRouteAccepted(ctx context.Context, devenv *cndev1alpha1.DevEnv) error {
+	var changed, transition bool
+	var status corev1.ConditionStatus
+	var reason, message string
+	if r.exposure != ExposureGateway {
+		changed = devenv.Status.RemoveCondition(cndev1alpha1.DevEnvConditionRouteAccepted)
+	} else {
+		route := newUnstructured(httpRouteKind)
+		if err := r.Get(ctx, types.NamespacedName{Name: r.resourceName, Namespace: r.ManagerNamespace}, route); err != nil {
+			r.Log.Error(err, "Failed to get HTTPRoute.")
+			return err
+		}
+		status, reason, message = routeAccepted(route, r.gatewayNamespace, r.gatewayName)
+		previous := devenv.Status.GetCondition(cndev1alpha1.DevEnvConditionRouteAccepted)
+		transition = previous == nil || previous.Status != status
+		changed = devenv.Status.SetCondition(cndev1alpha1.DevEnvCondition{
+			Type:    cndev1alpha1.DevEnvConditionRouteAccepted,
+			Status:  status,
+			Reason:  reason,
+			Message: message,
+		})
+	}
+	if !changed {
+		return nil
+	}
+	name := objectName(r.ManagerNamespace, r.resourceName)
+	if transition && status == corev1.ConditionTrue {
+		r.eventf(devenv, corev1.EventTypeNormal, reasonRouteAccepted, "HTTPRoute %s is accepted by its Gateway", name)
+	} else if status == corev1.ConditionFalse {
+		r.eventf(devenv, corev1.EventTypeWarning, reasonRouteNotAccepted, "HTTPRoute %s is not accepted by its Gateway: %s: %s", name, reason, message)
+	}
+	err := r.Status().Update(ctx, devenv)
+	if err != nil {
+		r.Log.Error(err, "Failed to update User Environment Conditions")
+	}
+	return err
+}
+
+// routeAccepted returns status, reason and message of the Accepted condition the Gateway set on the HTTPRoute
+func routeAccepted(route *unstructured.Unstructured, gatewayNamespace, gatewayName string) (corev1.ConditionStatus, string, string) {
+	parents, _, _ := unstructured.NestedSlice(route.Object, "status", "parents")
+	for _, p := range parents {
+		parent, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(parent, "parentRef", "name")
+		namespace, _, _ := unstructured.NestedString(parent, "parentRef", "namespace")
+		if name != gatewayName || (namespace != "" && namespace != gatewayNamespace) {
+			continue
+		}
+		conditions, _, _ := unstructured.NestedSlice(parent, "conditions")
+		if status, reason, message, ok := findCondition(conditions, "Accepted"); ok {
+			return status, reason, message
+		}
+	}
+	return corev1.ConditionUnknown, routePending, "the Gateway has not reported on the HTTPRoute yet"
+}
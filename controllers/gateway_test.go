@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParseGatewayRef(t *testing.T) {
+	tests := []struct {
+		gateway       string
+		wantNamespace string
+		wantName      string
+		wantErr       bool
+	}{
+		{"infra/public", "infra", "public", false},
+		{"public", "cnde-system", "public", false},
+		{"", "", "", true},
+		{"infra/", "", "", true},
+		{"/public", "", "", true},
+		{"infra/public/https", "", "", true},
+	}
+	for _, tt := range tests {
+		namespace, name, err := parseGatewayRef(tt.gateway, "cnde-system")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error %v", tt.gateway, err, tt.wantErr)
+			continue
+		}
+		if namespace != tt.wantNamespace || name != tt.wantName {
+			t.Errorf("%q: got %s/%s, want %s/%s", tt.gateway, namespace, name, tt.wantNamespace, tt.wantName)
+		}
+	}
+}
+
+func TestRouteAccepted(t *testing.T) {
+	parent := func(namespace, name, status, reason string) interface{} {
+		return map[string]interface{}{
+			"parentRef":      map[string]interface{}{"name": name, "namespace": namespace},
+			"controllerName": "example.com/gateway-controller",
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "ResolvedRefs", "status": "True", "reason": "ResolvedRefs"},
+				map[string]interface{}{"type": "Accepted", "status": status, "reason": reason, "message": reason},
+			},
+		}
+	}
+	tests := []struct {
+		name       string
+		parents    []interface{}
+		wantStatus corev1.ConditionStatus
+		wantReason string
+	}{
+		{"no status yet", nil, corev1.ConditionUnknown, routePending},
+		{"accepted", []interface{}{parent("infra", "public", "True", "Accepted")}, corev1.ConditionTrue, "Accepted"},
+		{"ExternalAuth filter of the experimental channel", []interface{}{parent("infra", "public", "False", "UnsupportedValue")},
+			corev1.ConditionFalse, "UnsupportedValue"},
+		{"other Gateway", []interface{}{parent("infra", "internal", "True", "Accepted")}, corev1.ConditionUnknown, routePending},
+	}
+	for _, tt := range tests {
+		route := newUnstructured(httpRouteKind)
+		if tt.parents != nil {
+			route.Object["status"] = map[string]interface{}{"parents": tt.parents}
+		}
+		status, reason, _ := routeAccepted(route, "infra", "public")
+		if status != tt.wantStatus || reason != tt.wantReason {
+			t.Errorf("%s: got %s %s, want %s %s", tt.name, status, reason, tt.wantStatus, tt.wantReason)
+		}
+	}
+}
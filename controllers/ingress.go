@@ -0,0 +1,252 @@
+package controllers
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/discovery"
+)
+
+// IngressAPI is the API the Ingresses of DevEnvs are created with
+type IngressAPI string
+
+const (
+	// IngressAPIExtensionsV1beta1 is served by clusters up to 1.21, the class is set by annotation
+	IngressAPIExtensionsV1beta1 IngressAPI = "extensions/v1beta1"
+	// IngressAPINetworkingV1 is served by clusters since 1.19, the class is set by spec.ingressClassName
+	IngressAPINetworkingV1 IngressAPI = "networking.k8s.io/v1"
+
+	// ingressClassAnnotation sets the class of extensions/v1beta1 Ingresses
+	ingressClassAnnotation = "kubernetes.io/ingress.class"
+	// tlsAcmeAnnotation lets the ingress-shim of cert-manager request the certificate of an Ingress
+	tlsAcmeAnnotation = "kubernetes.io/tls-acme"
+)
+
+// networkingV1Ingress is the kind of networking.k8s.io/v1 Ingresses. The client-go of the operator does not know
+// the API, its Ingresses are unstructured.
+var networkingV1Ingress = schema.GroupVersionKind{Group: "networking.k8s.io", Version: "v1", Kind: "Ingress"}
+
+// DiscoverIngressAPI returns networking.k8s.io/v1 if the cluster serves its Ingresses, extensions/v1beta1 otherwise
+func DiscoverIngressAPI(dc discovery.ServerResourcesInterface) (IngressAPI, error) {
+	resources, err := dc.ServerResourcesForGroupVersion(networkingV1Ingress.GroupVersion().String())
+	if errors.IsNotFound(err) {
+		return IngressAPIExtensionsV1beta1, nil
+	} else if err != nil {
+		return "", err
+	}
+	for _, res := range resources.APIResources {
+		if res.Name == "ingresses" {
+			return IngressAPINetworkingV1, nil
+		}
+	}
+	return IngressAPIExtensionsV1beta1, nil
+}
+
+// newIngress returns an empty Ingress of the API
+func newIngress(api IngressAPI) runtime.Object {
+	if api == IngressAPINetworkingV1 {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(networkingV1Ingress)
+		return u
+	}
+	return &extv1beta1.Ingress{}
+}
+
+// newIngressList returns an empty list of Ingresses of the API
+func newIngressList(api IngressAPI) runtime.Object {
+	if api == IngressAPINetworkingV1 {
+		u := &unstructured.UnstructuredList{}
+		u.SetGroupVersionKind(networkingV1Ingress.GroupVersion().WithKind("IngressList"))
+		return u
+	}
+	return &extv1beta1.IngressList{}
+}
+
+// ingressForAPI returns the Ingress built by the builders in the API of the cluster with the configured class
+func (r *devEnvConfig) ingressForAPI(ing *extv1beta1.Ingress) runtime.Object {
+	if r.ingressAPI != IngressAPINetworkingV1 {
+		if r.ingressClassName != "" {
+			ing.Annotations[ingressClassAnnotation] = r.ingressClassName
+		}
+		return ing
+	}
+
+	var rules []interface{}
+	for _, rule := range ing.Spec.Rules {
+		var paths []interface{}
+		for _, p := range rule.HTTP.Paths {
+			port := map[string]interface{}{"number": int64(p.Backend.ServicePort.IntValue())}
+			if p.Backend.ServicePort.Type == intstr.String {
+				port = map[string]interface{}{"name": p.Backend.ServicePort.StrVal}
+			}
+			paths = append(paths, map[string]interface{}{
+				"path":     p.Path,
+				"pathType": "Prefix",
+				"backend": map[string]interface{}{
+					"service": map[string]interface{}{"name": p.Backend.ServiceName, "port": port},
+				},
+			})
+		}
+		rules = append(rules, map[string]interface{}{
+			"host": rule.Host,
+			"http": map[string]interface{}{"paths": paths},
+		})
+	}
+	spec := map[string]interface{}{"rules": rules}
+	if r.ingressClassName != "" {
+		spec["ingressClassName"] = r.ingressClassName
+	}
+	var tls []interface{}
+	for _, t := range ing.Spec.TLS {
+		var hosts []interface{}
+		for _, h := range t.Hosts {
+			hosts = append(hosts, h)
+		}
+		entry := map[string]interface{}{"hosts": hosts}
+		if t.SecretName != "" {
+			entry["secretName"] = t.SecretName
+		}
+		tls = append(tls, entry)
+	}
+	if len(tls) > 0 {
+		spec["tls"] = tls
+	}
+
+	u := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	u.SetGroupVersionKind(networkingV1Ingress)
+	u.SetName(ing.Name)
+	u.SetNamespace(ing.Namespace)
+	u.SetLabels(ing.Labels)
+	u.SetAnnotations(ing.Annotations)
+	u.SetOwnerReferences(ing.OwnerReferences)
+	return u
+}
+
+// reconcileIngress creates the Ingress or updates its annotations, rules and TLS if they differ from the desired ones
+func (r *DevEnvReconciler) reconcileIngress(ctx context.Context, devenv *cndev1alpha1.DevEnv, desired runtime.Object) error {
+	meta := desired.(metav1.Object)
+	found := newIngress(r.ingressAPI)
+	err := r.Get(ctx, types.NamespacedName{Name: meta.GetName(), Namespace: meta.GetNamespace()}, found)
+	if err != nil && errors.IsNotFound(err) {
+		r.Log.Info("Creating a new Ingress.", "Ingress.Namespace", meta.GetNamespace(), "Ingress.Name", meta.GetName())
+		err = r.Create(ctx, desired)
+		r.recordCreate(devenv, "Ingress", objectName(meta.GetNamespace(), meta.GetName()), err)
+		if err != nil {
+			r.Log.Error(err, "Failed to create new Ingress.", "Ingress.Namespace", meta.GetNamespace(), "Ingress.Name", meta.GetName())
+		}
+		return err
+	} else if err != nil {
+		r.Log.Error(err, "Failed to get Ingress.", "Ingress.Name", meta.GetName())
+		return err
+	}
+
+	if !updateIngress(found, desired) {
+		return nil
+	}
+	r.Log.Info("Updating Ingress.", "Ingress.Namespace", meta.GetNamespace(), "Ingress.Name", meta.GetName())
+	err = r.Update(ctx, found)
+	if err != nil {
+		r.Log.Error(err, "Failed to update Ingress.", "Ingress.Name", meta.GetName())
+	}
+	return err
+}
+
+// updateIngress copies the annotations of the operator, rules and TLS of desired to found, the spec of
+// networking.k8s.io/v1 Ingresses as a whole. Annotations of others, e.g. cert-manager or kubectl, are kept.
+// It reports whether found changed.
+func updateIngress(found, desired runtime.Object) bool {
+	if u, ok := found.(*unstructured.Unstructured); ok {
+		d := desired.(*unstructured.Unstructured)
+		annotations, changed := mergeIngressAnnotations(u.GetAnnotations(), d.GetAnnotations())
+		if !changed && equality.Semantic.DeepEqual(u.Object["spec"], d.Object["spec"]) {
+			return false
+		}
+		u.SetAnnotations(annotations)
+		u.Object["spec"] = d.Object["spec"]
+		return true
+	}
+
+	f, d := found.(*extv1beta1.Ingress), desired.(*extv1beta1.Ingress)
+	annotations, changed := mergeIngressAnnotations(f.Annotations, d.Annotations)
+	if !changed && reflect.DeepEqual(f.Spec.Rules, d.Spec.Rules) && reflect.DeepEqual(f.Spec.TLS, d.Spec.TLS) {
+		return false
+	}
+	f.Annotations = annotations
+	f.Spec.Rules = d.Spec.Rules
+	f.Spec.TLS = d.Spec.TLS
+	return true
+}
+
+// backendIngressAnnotations are the annotations exposure backends and TLS set on some Ingresses only, they are
+// removed from Ingresses which no longer want them, e.g. after switching the backend
+func backendIngressAnnotations() []string {
+	keys := []string{traefikMiddlewaresAnnotation, tlsAcmeAnnotation}
+	for k := range nginxAuthAnnotations("") {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// mergeIngressAnnotations sets the desired annotations on a copy of found and removes the backend annotations
+// that are not desired. It reports whether the annotations changed.
+func mergeIngressAnnotations(found, desired map[string]string) (map[string]string, bool) {
+	merged := make(map[string]string, len(found)+len(desired))
+	for k, v := range found {
+		merged[k] = v
+	}
+	changed := false
+	for _, k := range backendIngressAnnotations() {
+		if _, ok := desired[k]; ok {
+			continue
+		}
+		if _, ok := merged[k]; ok {
+			delete(merged, k)
+			changed = true
+		}
+	}
+	for k, v := range desired {
+		if old, ok := merged[k]; !ok || old != v {
+			merged[k] = v
+			changed = true
+		}
+	}
+	return merged, changed
+}
+
+// nginxBackend lets ingress-nginx ask oauth2-proxy by subrequests to /oauth2/auth, those of the terminal
+// admit the editors by allowed_emails
+type nginxBackend struct{ *devEnvConfig }
+
+func (b nginxBackend) proxyMode() proxyMode { return proxyModeAuthRequest }
+
+func (b nginxBackend) kinds() []schema.GroupVersionKind { return nil }
+
+func (b nginxBackend) objects(cr *cndev1alpha1.DevEnv) []runtime.Object {
+	return []runtime.Object{
+		b.ingressUIForDevEnv(cr, b.ManagerNamespace, b.resourceName, idePort, nginxAuthAnnotations("https://$host/oauth2/auth")),
+		b.ingressTerminalForDevEnv(cr, b.ManagerNamespace, b.resourceName, ttydPort,
+			nginxAuthAnnotations("https://$host/oauth2/auth?allowed_emails="+url.QueryEscape(editorEmails(cr, ",")))),
+		b.ingressOauthForDevEnv(cr),
+	}
+}
+
+// nginxAuthAnnotations ask authURL of oauth2-proxy and redirect to its sign in if it refuses
+func nginxAuthAnnotations(authURL string) map[string]string {
+	return map[string]string{
+		"nginx.ingress.kubernetes.io/auth-response-headers": "X-Auth-Request-User, X-Auth-Request-Email",
+		"nginx.ingress.kubernetes.io/auth-signin":           "https://$host/oauth2/start?rd=$request_uri",
+		"nginx.ingress.kubernetes.io/auth-url":              authURL,
+		"nginx.ingress.kubernetes.io/proxy-buffer-size":     "16k",
+	}
+}
@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+)
+
+// fakeDiscovery serves the resource lists, missing group versions are not found like by an API server
+type fakeDiscovery struct {
+	discovery.ServerResourcesInterface
+	resources []*metav1.APIResourceList
+	err       error
+}
+
+func (d *fakeDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	for _, l := range d.resources {
+		if l.GroupVersion == groupVersion {
+			return l, nil
+		}
+	}
+	return nil, errors.NewNotFound(schema.GroupResource{}, groupVersion)
+}
+
+func TestDiscoverIngressAPI(t *testing.T) {
+	ingresses := []metav1.APIResource{{Name: "ingresses", Kind: "Ingress"}}
+	tests := []struct {
+		name      string
+		resources []*metav1.APIResourceList
+		err       error
+		want      IngressAPI
+	}{
+		{"networking.k8s.io/v1", []*metav1.APIResourceList{
+			{GroupVersion: "extensions/v1beta1", APIResources: ingresses},
+			{GroupVersion: "networking.k8s.io/v1", APIResources: ingresses},
+		}, nil, IngressAPINetworkingV1},
+		{"NetworkPolicies only", []*metav1.APIResourceList{
+			{GroupVersion: "extensions/v1beta1", APIResources: ingresses},
+			{GroupVersion: "networking.k8s.io/v1", APIResources: []metav1.APIResource{{Name: "networkpolicies"}}},
+		}, nil, IngressAPIExtensionsV1beta1},
+		{"extensions/v1beta1", []*metav1.APIResourceList{
+			{GroupVersion: "extensions/v1beta1", APIResources: ingresses},
+		}, nil, IngressAPIExtensionsV1beta1},
+		{"unavailable", nil, fmt.Errorf("unavailable"), ""},
+	}
+	for _, tt := range tests {
+		got, err := DiscoverIngressAPI(&fakeDiscovery{resources: tt.resources, err: tt.err})
+		if (err != nil) != (tt.err != nil) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateIngress(t *testing.T) {
+	// found was protected by ingress-nginx before the backend changed to Traefik, others annotated it too
+	found := map[string]string{
+		"cert-manager.io/issue-temporary-certificate":      "true",
+		"external-dns.alpha.kubernetes.io/hostname":        "thedeep.example.com",
+		"kubectl.kubernetes.io/last-applied-configuration": "{}",
+		"nginx.ingress.kubernetes.io/auth-url":             "https://$host/oauth2/auth",
+		"nginx.ingress.kubernetes.io/auth-signin":          "https://$host/oauth2/start?rd=$request_uri",
+		"kubernetes.io/tls-acme":                           "true",
+		"example.com/team":                                 "old",
+	}
+	desired := map[string]string{
+		"traefik.ingress.kubernetes.io/router.middlewares": "cnde-system-cnde-thedeep-auth@kubernetescrd",
+		"example.com/team": "infra",
+	}
+	want := map[string]string{
+		"cert-manager.io/issue-temporary-certificate":      "true",
+		"external-dns.alpha.kubernetes.io/hostname":        "thedeep.example.com",
+		"kubectl.kubernetes.io/last-applied-configuration": "{}",
+		"traefik.ingress.kubernetes.io/router.middlewares": "cnde-system-cnde-thedeep-auth@kubernetescrd",
+		"example.com/team": "infra",
+	}
+
+	for _, api := range []IngressAPI{IngressAPIExtensionsV1beta1, IngressAPINetworkingV1} {
+		r := &devEnvConfig{ingressAPI: api}
+		ingress := func(annotations map[string]string) runtime.Object {
+			copied := map[string]string{}
+			for k, v := range annotations {
+				copied[k] = v
+			}
+			return r.ingressForAPI(&extv1beta1.Ingress{
+				ObjectMeta: metav1.ObjectMeta{Name: "cnde-thedeep", Namespace: "cnde-system", Annotations: copied},
+			})
+		}
+		f := ingress(found)
+		if !updateIngress(f, ingress(desired)) {
+			t.Errorf("%s: updateIngress reported no change", api)
+		}
+		if got := f.(metav1.Object).GetAnnotations(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got annotations %v, want %v", api, got, want)
+		}
+		if updateIngress(f, ingress(desired)) {
+			t.Errorf("%s: updateIngress of an updated Ingress reported a change", api)
+		}
+	}
+}
@@ -1,12 +1,22 @@
 package controllers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
 	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	extv1beta1 "k8s.io/api/extensions/v1beta1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
@@ -14,13 +24,39 @@ import (
 const (
 	idePort  = 8080
 	ttydPort = 7681
+
+	// proxyPort of oauth2-proxy, proxyTerminalPort of its terminal container
+	proxyPort         = 4180
+	proxyTerminalPort = 4181
+
+	// authenticatedEmailsKey of the OAUTH Proxy Secret lists the emails allowed to access the DevEnv
+	authenticatedEmailsKey  = "authenticated_emails"
+	authenticatedEmailsPath = "/etc/oauth2-proxy/authenticated-emails"
+	// editorEmailsKey lists the emails allowed to access the terminal, if oauth2-proxy has a terminal container
+	editorEmailsKey  = "editor_emails"
+	editorEmailsPath = "/etc/oauth2-proxy/editor-emails"
+	// oauthCAKey of the ConfigMap of CNDE_OAUTH_CA_CONFIGMAP holds the CA bundle oauth2-proxy verifies the issuer with
+	oauthCAKey  = "ca.crt"
+	oauthCAPath = "/etc/oauth2-proxy-ca/ca.crt"
 )
 
 func labelsForDevEnv(name string) map[string]string {
 	return map[string]string{userenvnameLabel: name, "app": "code-server"}
 }
 
-func (r *DevEnvReconciler) rbacCRBForDevEnv(cr *cndev1alpha1.DevEnv) *rbacv1.ClusterRoleBinding {
+// ideLabelsForDevEnv selects the IDE Pod, the init and build Pods carry labelsForDevEnv too
+func ideLabelsForDevEnv(name string) map[string]string {
+	labels := labelsForDevEnv(name)
+	labels[componentLabel] = "ide"
+	return labels
+}
+
+// proxyLabelsForDevEnv selects the oauth2-proxy Pods
+func proxyLabelsForDevEnv(name string) map[string]string {
+	return map[string]string{userenvnameLabel: name, "app": "oauth2-proxy"}
+}
+
+func (r *devEnvConfig) rbacCRBForDevEnv(cr *cndev1alpha1.DevEnv) *rbacv1.ClusterRoleBinding {
 	labels := labelsForDevEnv(cr.Name)
 
 	crb := &rbacv1.ClusterRoleBinding{
@@ -42,11 +78,11 @@ func (r *DevEnvReconciler) rbacCRBForDevEnv(cr *cndev1alpha1.DevEnv) *rbacv1.Clu
 		},
 	}
 
-	controllerutil.SetControllerReference(cr, crb, r.Scheme)
+	controllerutil.SetControllerReference(cr, crb, r.scheme)
 	return crb
 }
 
-func (r *DevEnvReconciler) rbacRBForDevEnv(cr *cndev1alpha1.DevEnv) *rbacv1.RoleBinding {
+func (r *devEnvConfig) rbacRBForDevEnv(cr *cndev1alpha1.DevEnv) *rbacv1.RoleBinding {
 	labels := labelsForDevEnv(cr.Name)
 
 	rb := &rbacv1.RoleBinding{
@@ -68,11 +104,11 @@ func (r *DevEnvReconciler) rbacRBForDevEnv(cr *cndev1alpha1.DevEnv) *rbacv1.Role
 		},
 	}
 
-	controllerutil.SetControllerReference(cr, rb, r.Scheme)
+	controllerutil.SetControllerReference(cr, rb, r.scheme)
 	return rb
 }
 
-func (r *DevEnvReconciler) pvcDockerForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.PersistentVolumeClaim {
+func (r *devEnvConfig) pvcDockerForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.PersistentVolumeClaim {
 	labels := labelsForDevEnv(cr.Name)
 
 	pvc := &corev1.PersistentVolumeClaim{
@@ -93,12 +129,12 @@ func (r *DevEnvReconciler) pvcDockerForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.P
 		},
 	}
 	if cr.Spec.DeleteVolumes {
-		controllerutil.SetControllerReference(cr, pvc, r.Scheme)
+		controllerutil.SetControllerReference(cr, pvc, r.scheme)
 	}
 	return pvc
 }
 
-func (r *DevEnvReconciler) pvcHomeForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.PersistentVolumeClaim {
+func (r *devEnvConfig) pvcHomeForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.PersistentVolumeClaim {
 	labels := labelsForDevEnv(cr.Name)
 
 	pvc := &corev1.PersistentVolumeClaim{
@@ -119,12 +155,12 @@ func (r *DevEnvReconciler) pvcHomeForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Per
 		},
 	}
 	if cr.Spec.DeleteVolumes {
-		controllerutil.SetControllerReference(cr, pvc, r.Scheme)
+		controllerutil.SetControllerReference(cr, pvc, r.scheme)
 	}
 	return pvc
 }
 
-func (r *DevEnvReconciler) pvcVMForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.PersistentVolumeClaim {
+func (r *devEnvConfig) pvcVMForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.PersistentVolumeClaim {
 	labels := labelsForDevEnv(cr.Name)
 
 	pvc := &corev1.PersistentVolumeClaim{
@@ -145,13 +181,13 @@ func (r *DevEnvReconciler) pvcVMForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Persi
 		},
 	}
 	if cr.Spec.DeleteVolumes {
-		controllerutil.SetControllerReference(cr, pvc, r.Scheme)
+		controllerutil.SetControllerReference(cr, pvc, r.scheme)
 	}
 	return pvc
 }
 
 //
-func (r *DevEnvReconciler) serviceAccountForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.ServiceAccount {
+func (r *devEnvConfig) serviceAccountForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.ServiceAccount {
 	labels := labelsForDevEnv(cr.Name)
 
 	sa := &corev1.ServiceAccount{
@@ -161,12 +197,12 @@ func (r *DevEnvReconciler) serviceAccountForDevEnv(cr *cndev1alpha1.DevEnv) *cor
 			Labels:    labels,
 		},
 	}
-	controllerutil.SetControllerReference(cr, sa, r.Scheme)
+	controllerutil.SetControllerReference(cr, sa, r.scheme)
 	return sa
 }
 
 //
-func (r *DevEnvReconciler) podForInitializingDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Pod {
+func (r *devEnvConfig) podForInitializingDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Pod {
 	TRUE := true
 
 	labels := labelsForDevEnv(cr.Name)
@@ -255,71 +291,83 @@ func (r *DevEnvReconciler) podForInitializingDevEnv(cr *cndev1alpha1.DevEnv) *co
 	return pod
 }
 
-func (r *DevEnvReconciler) podForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Pod {
+// statefulSetForDevEnv runs the IDE. The StatefulSet recreates its Pod after eviction or loss of the node
+// and never runs two Pods on the volumes at once.
+func (r *devEnvConfig) statefulSetForDevEnv(cr *cndev1alpha1.DevEnv) *appsv1.StatefulSet {
 	TRUE := true
+	replicas := int32(1)
 
 	labels := labelsForDevEnv(cr.Name)
-	pod := &corev1.Pod{
+	podLabels := ideLabelsForDevEnv(cr.Name)
+	sts := &appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      r.resourceName,
 			Namespace: r.DevEnvNamespace,
 			Labels:    labels,
 		},
-		Spec: corev1.PodSpec{
-			ServiceAccountName: r.serviceAccountName,
-			InitContainers: []corev1.Container{
-				{
-					Name:    "create-kubeconfig",
-					Image:   r.kubeConfigImg,
-					Command: []string{"/bin/sh", "-c"},
-					Args:    []string{"/create_kubeconfig.sh; chown -R 1000.1000 /kube"},
-					SecurityContext: &corev1.SecurityContext{
-						Privileged: &TRUE,
-					},
-					Resources: corev1.ResourceRequirements{
-						Requests: map[corev1.ResourceName]resource.Quantity{
-							corev1.ResourceMemory: resource.MustParse("8Mi"),
-						},
-					},
-					VolumeMounts: []corev1.VolumeMount{
-						{
-							Name:      "home-storage",
-							MountPath: "/kube",
-							SubPath:   ".kube",
-						},
-					},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			ServiceName: r.resourceName,
+			Selector:    &metav1.LabelSelector{MatchLabels: podLabels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: podLabels,
 				},
-			},
-			Containers: []corev1.Container{
-				{
-					Name:  "docker-daemon",
-					Image: r.dockerImg,
-					Env: []corev1.EnvVar{
+				Spec: corev1.PodSpec{
+					ServiceAccountName: r.serviceAccountName,
+					InitContainers: []corev1.Container{
 						{
-							Name: "DOCKER_TLS_CERTDIR",
-						},
-					},
-					SecurityContext: &corev1.SecurityContext{
-						Privileged: &TRUE,
-					},
-					Resources: corev1.ResourceRequirements{
-						Requests: map[corev1.ResourceName]resource.Quantity{
-							corev1.ResourceMemory: r.memRequestDocker,
+							Name:    "create-kubeconfig",
+							Image:   r.kubeConfigImg,
+							Command: []string{"/bin/sh", "-c"},
+							Args:    []string{"/create_kubeconfig.sh; chown -R 1000.1000 /kube"},
+							SecurityContext: &corev1.SecurityContext{
+								Privileged: &TRUE,
+							},
+							Resources: corev1.ResourceRequirements{
+								Requests: map[corev1.ResourceName]resource.Quantity{
+									corev1.ResourceMemory: resource.MustParse("8Mi"),
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "home-storage",
+									MountPath: "/kube",
+									SubPath:   ".kube",
+								},
+							},
 						},
 					},
-					VolumeMounts: []corev1.VolumeMount{
+					Containers: []corev1.Container{
 						{
-							Name:      "docker-storage",
-							MountPath: "/var/lib/docker",
+							Name:  "docker-daemon",
+							Image: r.dockerImg,
+							Env: []corev1.EnvVar{
+								{
+									Name: "DOCKER_TLS_CERTDIR",
+								},
+							},
+							SecurityContext: &corev1.SecurityContext{
+								Privileged: &TRUE,
+							},
+							Resources: corev1.ResourceRequirements{
+								Requests: map[corev1.ResourceName]resource.Quantity{
+									corev1.ResourceMemory: r.memRequestDocker,
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "docker-storage",
+									MountPath: "/var/lib/docker",
+								},
+							},
 						},
-					},
-				},
-				{
-					Name:    "code-server",
-					Image:   r.alpineImage,
-					Command: []string{"/bin/sh", "-c"},
-					Args: []string{
-						`mount -t proc /proc /home/cnde/proc/; 
+						{
+							Name:    "code-server",
+							Image:   r.alpineImage,
+							Command: []string{"/bin/sh", "-c"},
+							Args: []string{
+								`mount -t proc /proc /home/cnde/proc/; 
 						mount --rbind /sys /home/cnde/sys/; 
 						mount --rbind /dev /home/cnde/dev/; 
 						cp /etc/resolv.conf /home/cnde/etc/; 
@@ -329,49 +377,51 @@ func (r *DevEnvReconciler) podForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Pod {
 						echo "export ENTRYPOINT=$ENTRYPOINT" >> /home/cnde/etc/environment; 
 						echo starting application with: $ENTRYPOINT; 
 						exec chroot /home/cnde su cnde -c 'cd /home/cnde; $ENTRYPOINT'`,
-					},
-					SecurityContext: &corev1.SecurityContext{
-						Privileged: &TRUE,
-					},
-					Resources: corev1.ResourceRequirements{
-						Requests: map[corev1.ResourceName]resource.Quantity{
-							corev1.ResourceMemory: r.memRequestIDE,
+							},
+							SecurityContext: &corev1.SecurityContext{
+								Privileged: &TRUE,
+							},
+							Resources: corev1.ResourceRequirements{
+								Requests: map[corev1.ResourceName]resource.Quantity{
+									corev1.ResourceMemory: r.memRequestIDE,
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "vm-storage",
+									MountPath: "/home/cnde",
+								},
+								{
+									Name:      "home-storage",
+									MountPath: "/home/cnde/home/cnde",
+								},
+							},
 						},
 					},
-					VolumeMounts: []corev1.VolumeMount{
+					Volumes: []corev1.Volume{
 						{
-							Name:      "vm-storage",
-							MountPath: "/home/cnde",
+							Name:         "vm-storage",
+							VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: r.vmVolumeName}},
 						},
 						{
-							Name:      "home-storage",
-							MountPath: "/home/cnde/home/cnde",
+							Name:         "home-storage",
+							VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: r.homeVolumeName}},
+						},
+						{
+							Name:         "docker-storage",
+							VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: r.dockerVolumeName}},
 						},
 					},
 				},
 			},
-			Volumes: []corev1.Volume{
-				{
-					Name:         "vm-storage",
-					VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: r.vmVolumeName}},
-				},
-				{
-					Name:         "home-storage",
-					VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: r.homeVolumeName}},
-				},
-				{
-					Name:         "docker-storage",
-					VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: r.dockerVolumeName}},
-				},
-			},
 		},
 	}
 
-	controllerutil.SetControllerReference(cr, pod, r.Scheme)
-	return pod
+	controllerutil.SetControllerReference(cr, sts, r.scheme)
+	return sts
 }
 
-// func (r *DevEnvReconciler) podForDevEnvLimited(cr *cndev1alpha1.DevEnv) *corev1.Pod {
+// func (r *devEnvConfig) podForDevEnvLimited(cr *cndev1alpha1.DevEnv) *corev1.Pod {
 // 	TRUE := true
 // 	uid := int64(1000)
 // 	sshsecretName := cr.Spec.SSHSecret
@@ -488,25 +538,23 @@ func (r *DevEnvReconciler) podForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Pod {
 // 		},
 // 	}
 
-// 	controllerutil.SetControllerReference(cr, pod, r.Scheme)
+// 	controllerutil.SetControllerReference(cr, pod, r.scheme)
 // 	return pod
 // }
 
 //------------------------------------------------------------------------
 //------------------------------------------------------------------------
 
-func (r *DevEnvReconciler) ingressOauthForDevEnv(cr *cndev1alpha1.DevEnv) *extv1beta1.Ingress {
+func (r *devEnvConfig) ingressOauthForDevEnv(cr *cndev1alpha1.DevEnv) runtime.Object {
 	labels := labelsForDevEnv(cr.Name)
 	ingOauth := &extv1beta1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      r.ingressOauthName,
 			Namespace: r.ManagerNamespace,
 			Labels:    labels,
-			Annotations: map[string]string{
-				"kubernetes.io/ingress.class":                   "nginx",
-				"kubernetes.io/tls-acme":                        "true",
+			Annotations: r.ingressAnnotations(r.tlsAnnotations(map[string]string{
 				"nginx.ingress.kubernetes.io/proxy-buffer-size": "16k",
-			},
+			})),
 		},
 		Spec: extv1beta1.IngressSpec{
 			Rules: []extv1beta1.IngressRule{
@@ -519,7 +567,7 @@ func (r *DevEnvReconciler) ingressOauthForDevEnv(cr *cndev1alpha1.DevEnv) *extv1
 									Path: "/oauth2",
 									Backend: extv1beta1.IngressBackend{
 										ServiceName: r.proxyPodName,
-										ServicePort: intstr.FromInt(4180),
+										ServicePort: intstr.FromInt(proxyPort),
 									},
 								},
 							},
@@ -527,35 +575,24 @@ func (r *DevEnvReconciler) ingressOauthForDevEnv(cr *cndev1alpha1.DevEnv) *extv1
 					},
 				},
 			},
-			TLS: []extv1beta1.IngressTLS{
-				{
-					Hosts: []string{
-						r.ingressHost,
-					},
-					SecretName: r.resourceName + "-tls",
-				},
-			},
+			TLS: r.ingressTLS(r.ManagerNamespace),
 		},
 	}
 
-	controllerutil.SetControllerReference(cr, ingOauth, r.Scheme)
-	return ingOauth
+	controllerutil.SetControllerReference(cr, ingOauth, r.scheme)
+	return r.ingressForAPI(ingOauth)
 }
 
-func (r *DevEnvReconciler) ingressUIForDevEnv(cr *cndev1alpha1.DevEnv) *extv1beta1.Ingress {
+// ingressUIForDevEnv routes to the port of the Service in the namespace, the IDE or oauth2-proxy in front of it.
+// The exposure backend gives the annotations protecting it.
+func (r *devEnvConfig) ingressUIForDevEnv(cr *cndev1alpha1.DevEnv, namespace, service string, port int, annotations map[string]string) runtime.Object {
 	labels := labelsForDevEnv(cr.Name)
 	ingUI := &extv1beta1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      r.ingressUIName,
-			Namespace: r.ManagerNamespace,
-			Labels:    labels,
-			Annotations: map[string]string{
-				"kubernetes.io/ingress.class":                       "nginx",
-				"nginx.ingress.kubernetes.io/auth-response-headers": "X-Auth-Request-User, X-Auth-Request-Email",
-				"nginx.ingress.kubernetes.io/auth-signin":           "https://$host/oauth2/start?rd=$request_uri",
-				"nginx.ingress.kubernetes.io/auth-url":              "https://$host/oauth2/auth",
-				"nginx.ingress.kubernetes.io/proxy-buffer-size":     "16k",
-			},
+			Name:        r.ingressUIName,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: r.ingressAnnotations(annotations),
 		},
 		Spec: extv1beta1.IngressSpec{
 			Rules: []extv1beta1.IngressRule{
@@ -567,15 +604,47 @@ func (r *DevEnvReconciler) ingressUIForDevEnv(cr *cndev1alpha1.DevEnv) *extv1bet
 								{
 									Path: "/",
 									Backend: extv1beta1.IngressBackend{
-										ServiceName: r.resourceName,
-										ServicePort: intstr.FromInt(idePort),
+										ServiceName: service,
+										ServicePort: intstr.FromInt(port),
 									},
 								},
+							},
+						},
+					},
+				},
+			},
+			TLS: r.ingressTLS(namespace),
+		},
+	}
+
+	controllerutil.SetControllerReference(cr, ingUI, r.scheme)
+	return r.ingressForAPI(ingUI)
+}
+
+// ingressTerminalForDevEnv routes to the port of the Service like ingressUIForDevEnv. The annotations of the
+// exposure backend or the terminal container of oauth2-proxy admit the owner and editors only, viewers are
+// limited to the IDE.
+func (r *devEnvConfig) ingressTerminalForDevEnv(cr *cndev1alpha1.DevEnv, namespace, service string, port int, annotations map[string]string) runtime.Object {
+	labels := labelsForDevEnv(cr.Name)
+	ingTerm := &extv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        r.ingressTerminalName,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: r.ingressAnnotations(annotations),
+		},
+		Spec: extv1beta1.IngressSpec{
+			Rules: []extv1beta1.IngressRule{
+				{
+					Host: r.ingressHost,
+					IngressRuleValue: extv1beta1.IngressRuleValue{
+						HTTP: &extv1beta1.HTTPIngressRuleValue{
+							Paths: []extv1beta1.HTTPIngressPath{
 								{
 									Path: "/terminal/",
 									Backend: extv1beta1.IngressBackend{
-										ServiceName: r.resourceName,
-										ServicePort: intstr.FromInt(ttydPort),
+										ServiceName: service,
+										ServicePort: intstr.FromInt(port),
 									},
 								},
 							},
@@ -583,119 +652,278 @@ func (r *DevEnvReconciler) ingressUIForDevEnv(cr *cndev1alpha1.DevEnv) *extv1bet
 					},
 				},
 			},
+			TLS: r.ingressTLS(namespace),
 		},
 	}
 
-	controllerutil.SetControllerReference(cr, ingUI, r.Scheme)
-	return ingUI
+	controllerutil.SetControllerReference(cr, ingTerm, r.scheme)
+	return r.ingressForAPI(ingTerm)
 }
 
-func (r *DevEnvReconciler) podOauthProxyForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Pod {
-	labels := map[string]string{"user-env-name": cr.Name, "app": "oauth2-proxy"}
-	pod := &corev1.Pod{
+// ingressAnnotations adds the annotations of CNDE_INGRESS_ANNOTATIONS, they override the ones of the operator
+func (r *devEnvConfig) ingressAnnotations(annotations map[string]string) map[string]string {
+	for k, v := range r.extraIngressAnnotations {
+		annotations[k] = v
+	}
+	return annotations
+}
+
+// tlsAnnotations adds the annotation requesting the certificate of the Ingress by ACME, unless the operator
+// requests it by a Certificate of the issuer of CNDE_TLS_ISSUER or CNDE_TLS_CLUSTER_ISSUER
+func (r *devEnvConfig) tlsAnnotations(annotations map[string]string) map[string]string {
+	if !r.managesCertificate() {
+		annotations[tlsAcmeAnnotation] = "true"
+	}
+	return annotations
+}
+
+// ingressTLS serves the host of the DevEnv with the certificate of its TLS Secret in the manager namespace.
+// Ingresses in other namespaces name no Secret, Traefik serves them the certificate of the oauth Ingress.
+func (r *devEnvConfig) ingressTLS(namespace string) []extv1beta1.IngressTLS {
+	tls := extv1beta1.IngressTLS{
+		Hosts: []string{
+			r.ingressHost,
+		},
+	}
+	if namespace == r.ManagerNamespace {
+		tls.SecretName = r.tlsSecretName
+	}
+	return []extv1beta1.IngressTLS{tls}
+}
+
+// deploymentOauthProxyForDevEnv runs oauth2-proxy, with a terminal container admitting the owner and editors
+// only if the exposure needs it. The hash of its Secret and args is an annotation of the Pod template,
+// so a changed Secret or changed args roll out new Pods.
+func (r *devEnvConfig) deploymentOauthProxyForDevEnv(cr *cndev1alpha1.DevEnv) *appsv1.Deployment {
+	labels := proxyLabelsForDevEnv(cr.Name)
+	replicas := int32(1)
+
+	upstream, terminalUpstream := r.proxyUpstreams()
+	args := r.oauthProxyArgs(cr, authenticatedEmailsPath, proxyPort, upstream)
+	containers := []corev1.Container{r.oauthProxyContainer("oauth2-proxy", args, proxyPort)}
+	emailItems := []corev1.KeyToPath{{Key: authenticatedEmailsKey, Path: path.Base(authenticatedEmailsPath)}}
+	hashedArgs := args
+	if r.terminalProxy() {
+		terminalArgs := r.oauthProxyArgs(cr, editorEmailsPath, proxyTerminalPort, terminalUpstream)
+		containers = append(containers, r.oauthProxyContainer("oauth2-proxy-terminal", terminalArgs, proxyTerminalPort))
+		emailItems = append(emailItems, corev1.KeyToPath{Key: editorEmailsKey, Path: path.Base(editorEmailsPath)})
+		hashedArgs = append(append([]string{}, args...), terminalArgs...)
+	}
+
+	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      r.proxyPodName,
 			Namespace: r.ManagerNamespace,
 			Labels:    labels,
 		},
-		Spec: corev1.PodSpec{
-			Containers: []corev1.Container{
-				{
-					Name:  "oauth2-proxy",
-					Image: r.oauthProxyImg,
-					Args: []string{
-						"--cookie-name=auth",
-						"--cookie-refresh=23h",
-						"--cookie-secure=true",
-						"--email-domain=*",
-						"--http-address=0.0.0.0:4180",
-						"--oidc-issuer-url=https://keycloak." + cr.Spec.UserEnvDomain + "/auth/realms/" + r.resourceName,
-						"--pass-access-token=true",
-						"--provider=oidc",
-						"--set-xauthrequest=true",
-						"--tls-cert-file=",
-						"--upstream=file:///dev/null",
-						// remove for prod cluster issuer
-						"--ssl-insecure-skip-verify=true",
-					},
-					Ports: []corev1.ContainerPort{
-						{
-							Name:          "http",
-							ContainerPort: 4180,
-							Protocol:      corev1.ProtocolTCP,
-						},
-					},
-					Resources: corev1.ResourceRequirements{
-						Requests: corev1.ResourceList{
-							corev1.ResourceCPU:    resource.MustParse("10m"),
-							corev1.ResourceMemory: resource.MustParse("8Mi"),
-						},
-					},
-					Env: []corev1.EnvVar{
-						{
-							Name: "OAUTH2_PROXY_CLIENT_ID",
-							ValueFrom: &corev1.EnvVarSource{
-								SecretKeyRef: &corev1.SecretKeySelector{
-									Key: "client_id",
-									LocalObjectReference: corev1.LocalObjectReference{
-										Name: r.proxyPodName,
-									},
-								},
-							},
-						},
-						{
-							Name: "OAUTH2_PROXY_CLIENT_SECRET",
-							ValueFrom: &corev1.EnvVarSource{
-								SecretKeyRef: &corev1.SecretKeySelector{
-									Key: "client_secret",
-									LocalObjectReference: corev1.LocalObjectReference{
-										Name: r.proxyPodName,
-									},
-								},
-							},
-						},
-						{
-							Name: "OAUTH2_PROXY_COOKIE_SECRET",
-							ValueFrom: &corev1.EnvVarSource{
-								SecretKeyRef: &corev1.SecretKeySelector{
-									Key: "cookie_secret",
-									LocalObjectReference: corev1.LocalObjectReference{
-										Name: r.proxyPodName,
-									},
-								},
-							},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      labels,
+					Annotations: map[string]string{configHashAnnotation: configHash(r.proxySecretHash, hashedArgs)},
+				},
+				Spec: corev1.PodSpec{
+					Containers: containers,
+					Volumes:    r.oauthProxyVolumes(emailItems),
+				},
+			},
+		},
+	}
+
+	controllerutil.SetControllerReference(cr, deployment, r.scheme)
+	return deployment
+}
+
+// terminalProxy reports whether oauth2-proxy has a terminal container, the nginx Ingress asks oauth2-proxy
+// with allowed_emails instead
+func (r *devEnvConfig) terminalProxy() bool {
+	return r.exposureBackend().proxyMode() != proxyModeAuthRequest
+}
+
+// proxyUpstreams returns where oauth2-proxy and its terminal container pass admitted requests on to
+func (r *devEnvConfig) proxyUpstreams() (ide, terminal string) {
+	switch r.exposureBackend().proxyMode() {
+	case proxyModeAuthRequest:
+		return "file:///dev/null", ""
+	case proxyModeApprove:
+		// the ingress controller or gateway passes the request on if oauth2-proxy accepts it
+		return "static://202", "static://202"
+	}
+	service := fmt.Sprintf("http://%s.%s.svc.%s", r.resourceName, r.DevEnvNamespace, r.clusterDomain)
+	return fmt.Sprintf("%s:%d/", service, idePort), fmt.Sprintf("%s:%d/terminal/", service, ttydPort)
+}
+
+// checkAllowedGroups rejects allowedGroups if the OAUTH provider puts the owner in no group, e.g. Dex or a realm
+// per DevEnv. oauth2-proxy requires membership of one of the groups in addition to an allowed email and would
+// lock out the owner and the collaborators.
+func (r *devEnvConfig) checkAllowedGroups(cr *cndev1alpha1.DevEnv) error {
+	if len(cr.Spec.AllowedGroups) == 0 || len(r.oauthAllowedGroups) > 0 {
+		return nil
+	}
+	return fmt.Errorf("allowedGroups %v: the OAUTH provider puts the owner in no group, only the shared realm of Keycloak supports allowedGroups", cr.Spec.AllowedGroups)
+}
+
+// oauthProxyArgs returns the args of an oauth2-proxy listening on port, admitting the emails of emailsFile
+// and passing requests on to upstream
+func (r *devEnvConfig) oauthProxyArgs(cr *cndev1alpha1.DevEnv, emailsFile string, port int, upstream string) []string {
+	policy := r.policy
+	args := []string{
+		"--cookie-name=auth",
+		"--cookie-refresh=" + policy.CookieRefresh().String(),
+		"--cookie-secure=true",
+		"--authenticated-emails-file=" + emailsFile,
+		fmt.Sprintf("--http-address=0.0.0.0:%d", port),
+		"--oidc-issuer-url=" + r.oauthIssuerURL,
+		"--pass-access-token=true",
+		"--provider=oidc",
+		"--set-xauthrequest=true",
+		"--tls-cert-file=",
+		"--upstream=" + upstream,
+	}
+	if r.oauthCAConfigMap != "" {
+		args = append(args, "--provider-ca-file="+oauthCAPath)
+	}
+	for _, domain := range cr.Spec.AllowedEmailDomains {
+		args = append(args, "--email-domain="+domain)
+	}
+	if expire := policy.CookieExpire(); expire > 0 {
+		args = append(args, "--cookie-expire="+expire.String())
+	}
+	for _, group := range r.oauthAllowedGroups {
+		args = append(args, "--allowed-group="+group)
+	}
+	for _, group := range cr.Spec.AllowedGroups {
+		args = append(args, "--allowed-group="+group)
+	}
+	if r.exposureBackend().proxyMode() != proxyModeAuthRequest {
+		// oauth2-proxy redirects to the sign in itself, the nginx Ingress does by annotation
+		args = append(args, "--reverse-proxy=true", "--skip-provider-button=true")
+	}
+	return args
+}
+
+// oauthProxyVolumes returns the emails files of the Secret and the CA bundle of CNDE_OAUTH_CA_CONFIGMAP
+func (r *devEnvConfig) oauthProxyVolumes(emailItems []corev1.KeyToPath) []corev1.Volume {
+	volumes := []corev1.Volume{
+		{
+			Name: "authenticated-emails",
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+				SecretName: r.proxyPodName,
+				Items:      emailItems,
+			}},
+		},
+	}
+	if r.oauthCAConfigMap != "" {
+		volumes = append(volumes, corev1.Volume{
+			Name: "oauth-ca",
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: r.oauthCAConfigMap},
+				Items:                []corev1.KeyToPath{{Key: oauthCAKey, Path: path.Base(oauthCAPath)}},
+			}},
+		})
+	}
+	return volumes
+}
+
+func (r *devEnvConfig) oauthProxyVolumeMounts() []corev1.VolumeMount {
+	mounts := []corev1.VolumeMount{
+		{
+			Name:      "authenticated-emails",
+			MountPath: path.Dir(authenticatedEmailsPath),
+			ReadOnly:  true,
+		},
+	}
+	if r.oauthCAConfigMap != "" {
+		mounts = append(mounts, corev1.VolumeMount{Name: "oauth-ca", MountPath: path.Dir(oauthCAPath), ReadOnly: true})
+	}
+	return mounts
+}
+
+// oauthProxyContainer runs oauth2-proxy with the args, its port is named after the container
+func (r *devEnvConfig) oauthProxyContainer(name string, args []string, port int32) corev1.Container {
+	portName := "http"
+	if port != proxyPort {
+		portName = "terminal"
+	}
+	return corev1.Container{
+		Name:  name,
+		Image: r.oauthProxyImg,
+		Args:  args,
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          portName,
+				ContainerPort: port,
+				Protocol:      corev1.ProtocolTCP,
+			},
+		},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("10m"),
+				corev1.ResourceMemory: resource.MustParse("8Mi"),
+			},
+		},
+		Env: []corev1.EnvVar{
+			{
+				Name: "OAUTH2_PROXY_CLIENT_ID",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						Key: "client_id",
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: r.proxyPodName,
 						},
 					},
-					LivenessProbe: &corev1.Probe{
-						Handler: corev1.Handler{
-							HTTPGet: &corev1.HTTPGetAction{
-								Path:   "/ping",
-								Port:   intstr.FromString("http"),
-								Scheme: corev1.URISchemeHTTP,
-							},
+				},
+			},
+			{
+				Name: "OAUTH2_PROXY_CLIENT_SECRET",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						Key: "client_secret",
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: r.proxyPodName,
 						},
-						InitialDelaySeconds: 30,
 					},
-					ReadinessProbe: &corev1.Probe{
-						Handler: corev1.Handler{
-							HTTPGet: &corev1.HTTPGetAction{
-								Path:   "/ping",
-								Port:   intstr.FromString("http"),
-								Scheme: corev1.URISchemeHTTP,
-							},
+				},
+			},
+			{
+				Name: "OAUTH2_PROXY_COOKIE_SECRET",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						Key: "cookie_secret",
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: r.proxyPodName,
 						},
 					},
 				},
 			},
 		},
+		VolumeMounts: r.oauthProxyVolumeMounts(),
+		LivenessProbe: &corev1.Probe{
+			Handler: corev1.Handler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path:   "/ping",
+					Port:   intstr.FromString(portName),
+					Scheme: corev1.URISchemeHTTP,
+				},
+			},
+			InitialDelaySeconds: 30,
+		},
+		ReadinessProbe: &corev1.Probe{
+			Handler: corev1.Handler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path:   "/ping",
+					Port:   intstr.FromString(portName),
+					Scheme: corev1.URISchemeHTTP,
+				},
+			},
+		},
 	}
-
-	controllerutil.SetControllerReference(cr, pod, r.Scheme)
-	return pod
 }
 
-func (r *DevEnvReconciler) serviceOauthProxyForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Service {
-	labels := map[string]string{"user-env-name": cr.Name, "app": "oauth2-proxy"}
+func (r *devEnvConfig) serviceOauthProxyForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Service {
+	labels := proxyLabelsForDevEnv(cr.Name)
 	ser := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      r.proxyPodName,
@@ -706,37 +934,116 @@ func (r *DevEnvReconciler) serviceOauthProxyForDevEnv(cr *cndev1alpha1.DevEnv) *
 			Selector: labels,
 			Ports: []corev1.ServicePort{
 				{
-					Port: 4180,
+					Port: proxyPort,
 					Name: "http",
 				},
 			},
 		},
 	}
+	if r.terminalProxy() {
+		ser.Spec.Ports = append(ser.Spec.Ports, corev1.ServicePort{Port: proxyTerminalPort, Name: "terminal"})
+	}
 
-	controllerutil.SetControllerReference(cr, ser, r.Scheme)
+	controllerutil.SetControllerReference(cr, ser, r.scheme)
 	return ser
 }
 
-func (r *DevEnvReconciler) secretOauthProxyForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Secret {
+func (r *devEnvConfig) secretOauthProxyForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Secret {
 	labels := labelsForDevEnv(cr.Name)
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      r.proxyPodName,
-			Namespace: r.ManagerNamespace,
-			Labels:    labels,
+			Name:        r.proxyPodName,
+			Namespace:   r.ManagerNamespace,
+			Labels:      labels,
+			Annotations: map[string]string{secretsRotatedAnnotation: r.secretsRotated.UTC().Format(time.RFC3339)},
 		},
 		StringData: map[string]string{
 			"client_id":     r.oauthClientID,
 			"client_secret": r.oauthClientSecret,
-			"cookie_secret": `WhatEver123456888888`,
+			"cookie_secret": r.oauthCookieSecret,
+		},
+	}
+	for k, v := range r.proxyEmails(cr) {
+		secret.StringData[k] = v
+	}
+
+	controllerutil.SetControllerReference(cr, secret, r.scheme)
+	return secret
+}
+
+// initialPasswordSecretName returns the name of the Secret of the initial password of the owner or a collaborator
+func (r *devEnvConfig) initialPasswordSecretName(cr *cndev1alpha1.DevEnv, username string) string {
+	if username == cr.Name || strings.EqualFold(username, cr.Spec.UserEmail) {
+		return r.initialPasswordName
+	}
+	h := sha256.Sum256([]byte(strings.ToLower(username)))
+	return r.initialPasswordName + "-" + hex.EncodeToString(h[:])[:10]
+}
+
+// authenticatedEmails returns the owner, the collaborators and the allowed emails of the DevEnv, one per line
+func authenticatedEmails(cr *cndev1alpha1.DevEnv) string {
+	all := []string{cr.Spec.UserEmail}
+	for _, c := range cr.Spec.Collaborators {
+		all = append(all, c.Email)
+	}
+	return joinEmails(append(all, cr.Spec.AllowedEmails...), "\n") + "\n"
+}
+
+// editorEmails returns the owner and the collaborators with role editor, separated by sep
+func editorEmails(cr *cndev1alpha1.DevEnv, sep string) string {
+	all := []string{cr.Spec.UserEmail}
+	for _, c := range cr.Spec.Collaborators {
+		if c.Role == cndev1alpha1.CollaboratorRoleEditor {
+			all = append(all, c.Email)
+		}
+	}
+	return joinEmails(all, sep)
+}
+
+// proxyEmails returns the emails files of the OAUTH Proxy Secret, the editors only if oauth2-proxy has a terminal container
+func (r *devEnvConfig) proxyEmails(cr *cndev1alpha1.DevEnv) map[string]string {
+	emails := map[string]string{authenticatedEmailsKey: authenticatedEmails(cr)}
+	if r.terminalProxy() {
+		emails[editorEmailsKey] = editorEmails(cr, "\n") + "\n"
+	}
+	return emails
+}
+
+// joinEmails returns the sorted, lower case and unique emails joined by sep
+func joinEmails(all []string, sep string) string {
+	seen := map[string]bool{}
+	var emails []string
+	for _, email := range all {
+		email = strings.ToLower(strings.TrimSpace(email))
+		if email == "" || seen[email] {
+			continue
+		}
+		seen[email] = true
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	return strings.Join(emails, sep)
+}
+
+func (r *devEnvConfig) secretInitialPasswordForDevEnv(cr *cndev1alpha1.DevEnv, username, password string) *corev1.Secret {
+	labels := labelsForDevEnv(cr.Name)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.initialPasswordSecretName(cr, username),
+			Namespace: r.initialPasswordNamespace,
+			Labels:    labels,
+		},
+		StringData: map[string]string{
+			"username": username,
+			"password": password,
 		},
 	}
 
-	controllerutil.SetControllerReference(cr, secret, r.Scheme)
+	controllerutil.SetControllerReference(cr, secret, r.scheme)
 	return secret
 }
 
-func (r *DevEnvReconciler) createNamespaceForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Namespace {
+func (r *devEnvConfig) createNamespaceForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Namespace {
 	labels := labelsForDevEnv(cr.Name)
 	labels[namespaceLabel] = r.ManagerNamespace
 
@@ -749,65 +1056,65 @@ func (r *DevEnvReconciler) createNamespaceForDevEnv(cr *cndev1alpha1.DevEnv) *co
 	}
 
 	if cr.Spec.DeleteVolumes {
-		controllerutil.SetControllerReference(cr, ns, r.Scheme)
+		controllerutil.SetControllerReference(cr, ns, r.scheme)
 	}
 	return ns
 }
 
-func (r *DevEnvReconciler) serviceProxyForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Service {
+// serviceForDevEnv selects the IDE Pod in the DevEnv namespace
+func (r *devEnvConfig) serviceForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Service {
 	labels := labelsForDevEnv(cr.Name)
 	ser := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      r.resourceName,
-			Namespace: r.ManagerNamespace,
+			Namespace: r.DevEnvNamespace,
 			Labels:    labels,
 		},
 		Spec: corev1.ServiceSpec{
+			Selector: ideLabelsForDevEnv(cr.Name),
 			Ports: []corev1.ServicePort{
 				{
-					Name: "ide",
-					Port: idePort,
+					Name:       "ide",
+					Port:       idePort,
+					TargetPort: intstr.FromInt(idePort),
 				},
 				{
-					Name: "terminal",
-					Port: ttydPort,
+					Name:       "terminal",
+					Port:       ttydPort,
+					TargetPort: intstr.FromInt(ttydPort),
 				},
 			},
 		},
 	}
-	controllerutil.SetControllerReference(cr, ser, r.Scheme)
+	controllerutil.SetControllerReference(cr, ser, r.scheme)
 	return ser
 }
 
-func (r *DevEnvReconciler) endpointProxyForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Endpoints {
+// serviceProxyForDevEnv is the backend of the UI and terminal Ingresses in the manager namespace,
+// it resolves to the Service of the IDE in the DevEnv namespace
+func (r *devEnvConfig) serviceProxyForDevEnv(cr *cndev1alpha1.DevEnv) *corev1.Service {
 	labels := labelsForDevEnv(cr.Name)
-	endpoint := &corev1.Endpoints{
+	ser := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      r.resourceName,
 			Namespace: r.ManagerNamespace,
 			Labels:    labels,
 		},
-		Subsets: []corev1.EndpointSubset{
-			{
-				Addresses: []corev1.EndpointAddress{
-					{
-						IP: r.DevEnvPodIP,
-					},
+		Spec: corev1.ServiceSpec{
+			Type:         corev1.ServiceTypeExternalName,
+			ExternalName: fmt.Sprintf("%s.%s.svc.%s", r.resourceName, r.DevEnvNamespace, r.clusterDomain),
+			Ports: []corev1.ServicePort{
+				{
+					Name: "ide",
+					Port: idePort,
 				},
-				Ports: []corev1.EndpointPort{
-					{
-						Name: "ide",
-						Port: idePort,
-					},
-					{
-						Name: "terminal",
-						Port: ttydPort,
-					},
+				{
+					Name: "terminal",
+					Port: ttydPort,
 				},
 			},
 		},
 	}
-	controllerutil.SetControllerReference(cr, endpoint, r.Scheme)
-
-	return endpoint
+	controllerutil.SetControllerReference(cr, ser, r.scheme)
+	return ser
 }
@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"context"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	// durationBuckets range from 10s to about 1.5h, builds and initializations pull and push images
+	durationBuckets = prometheus.ExponentialBuckets(10, 2, 10)
+
+	buildDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cnde_build_duration_seconds",
+		Help:    "Duration of builds of DevEnv images from creation of the build Pod until it succeeded or failed.",
+		Buckets: durationBuckets,
+	}, []string{"builder", "result"})
+
+	buildFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cnde_build_failures_total",
+		Help: "Number of failed builds of DevEnv images.",
+	}, []string{"builder"})
+
+	initDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cnde_initialization_duration_seconds",
+		Help:    "Duration of initializations of DevEnv volumes from creation of the init Pod until it succeeded or failed.",
+		Buckets: durationBuckets,
+	}, []string{"result"})
+
+	timeToRunning = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cnde_devenv_time_to_running_seconds",
+		Help:    "Time from creation of a DevEnv until it reached phase Running.",
+		Buckets: durationBuckets,
+	})
+
+	oauthRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cnde_oauth_request_duration_seconds",
+		Help:    "Latency of calls of the OAUTH provider by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider", "method"})
+
+	oauthRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cnde_oauth_request_errors_total",
+		Help: "Number of failed calls of the OAUTH provider by method, missing objects are not counted.",
+	}, []string{"provider", "method"})
+
+	orphanedObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cnde_orphaned_objects",
+		Help: "Number of objects labelled with a DevEnv that no longer exists found by the last orphan collection, deleted or not.",
+	}, []string{"kind"})
+
+	orphansDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cnde_orphaned_objects_deleted_total",
+		Help: "Number of orphaned objects deleted by the orphan collector.",
+	}, []string{"kind"})
+
+	orphanCollectionTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cnde_orphan_collection_last_success_timestamp_seconds",
+		Help: "Unix time the last orphan collection succeeded.",
+	})
+
+	devEnvsDesc = prometheus.NewDesc("cnde_devenvs",
+		"Number of DevEnvs by build phase.", []string{"phase"}, nil)
+
+	devEnvsSuspendedDesc = prometheus.NewDesc("cnde_devenvs_suspended",
+		"Number of DevEnvs by suspended state, a DevEnv is suspended while its IDE StatefulSet is scaled to zero replicas.",
+		[]string{"suspended"}, nil)
+)
+
+func init() {
+	metrics.Registry.MustRegister(buildDuration, buildFailures, initDuration, timeToRunning,
+		oauthRequestDuration, oauthRequestErrors, orphanedObjects, orphansDeleted, orphanCollectionTimestamp)
+}
+
+// devEnvCollector counts the DevEnvs by phase and suspended state each time the metrics are scraped
+type devEnvCollector struct {
+	client client.Reader
+}
+
+func (c *devEnvCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- devEnvsDesc
+	ch <- devEnvsSuspendedDesc
+}
+
+func (c *devEnvCollector) Collect(ch chan<- prometheus.Metric) {
+	devenvList := &cndev1alpha1.DevEnvList{}
+	if err := c.client.List(context.Background(), devenvList); err != nil {
+		ch <- prometheus.NewInvalidMetric(devEnvsDesc, err)
+		ch <- prometheus.NewInvalidMetric(devEnvsSuspendedDesc, err)
+		return
+	}
+
+	phases := map[string]int{
+		phaseLabel(cndev1alpha1.BuildPhaseInitial):             0,
+		phaseLabel(cndev1alpha1.BuildPhaseBuilding):            0,
+		phaseLabel(cndev1alpha1.BuildPhaseWaitForInitializion): 0,
+		phaseLabel(cndev1alpha1.BuildPhaseInitializing):        0,
+		phaseLabel(cndev1alpha1.BuildPhaseRunning):             0,
+	}
+	for _, d := range devenvList.Items {
+		phases[phaseLabel(d.Status.Build)]++
+	}
+	for phase, n := range phases {
+		ch <- prometheus.MustNewConstMetric(devEnvsDesc, prometheus.GaugeValue, float64(n), phase)
+	}
+
+	stsList := &appsv1.StatefulSetList{}
+	if err := c.client.List(context.Background(), stsList, client.MatchingLabelsSelector{Selector: selectorForDevEnv("")}); err != nil {
+		ch <- prometheus.NewInvalidMetric(devEnvsSuspendedDesc, err)
+		return
+	}
+	scaledDown := map[string]bool{}
+	for _, sts := range stsList.Items {
+		if sts.Spec.Replicas != nil && *sts.Spec.Replicas == 0 {
+			scaledDown[sts.Labels[userenvnameLabel]] = true
+		}
+	}
+	suspended := 0
+	for _, d := range devenvList.Items {
+		if scaledDown[d.Name] {
+			suspended++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(devEnvsSuspendedDesc, prometheus.GaugeValue, float64(suspended), "true")
+	ch <- prometheus.MustNewConstMetric(devEnvsSuspendedDesc, prometheus.GaugeValue, float64(len(devenvList.Items)-suspended), "false")
+}
+
+// phaseLabel is the value of label phase, Initial for DevEnvs without status yet
+func phaseLabel(phase cndev1alpha1.BuildPhase) string {
+	if phase == cndev1alpha1.BuildPhaseInitial {
+		return "Initial"
+	}
+	return string(phase)
+}
+
+// registerDevEnvCollector registers the devEnvCollector once, a second manager in the same process reuses it
+func registerDevEnvCollector(c client.Reader) error {
+	err := metrics.Registry.Register(&devEnvCollector{client: c})
+	if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return nil
+	}
+	return err
+}
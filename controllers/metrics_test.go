@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth/fake"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestInstrumentOAUTH(t *testing.T) {
+	provider := fake.NewOAUTHProvider()
+	p := instrumentOAUTH("test", provider, 0)
+	if instrumentOAUTH("test", p, 0) != p {
+		t.Errorf("instrumentOAUTH instrumented an instrumented provider again")
+	}
+	ctx := context.Background()
+	devenv := &cndev1alpha1.DevEnv{
+		ObjectMeta: metav1.ObjectMeta{Name: "thedeep"},
+		Spec:       cndev1alpha1.DevEnvSpec{UserEmail: "arthur@example.com", UserEnvDomain: "example.com"},
+	}
+
+	errors := func(method string) float64 {
+		return testutil.ToFloat64(oauthRequestErrors.WithLabelValues("test", method))
+	}
+
+	// a missing realm is no error of the provider
+	if _, err := p.GetRealm(ctx, devenv); err == nil {
+		t.Fatalf("GetRealm of a missing realm succeeded")
+	}
+	if n := errors("GetRealm"); n != 0 {
+		t.Errorf("%v errors of GetRealm counted for a missing realm, want 0", n)
+	}
+
+	provider.SetError("EnsureRealm", fmt.Errorf("unavailable"))
+	if _, err := p.EnsureRealm(ctx, devenv); err == nil {
+		t.Fatalf("EnsureRealm succeeded although the provider failed")
+	}
+	if n := errors("EnsureRealm"); n != 1 {
+		t.Errorf("%v errors of EnsureRealm counted, want 1", n)
+	}
+
+	provider.SetError("EnsureRealm", nil)
+	if _, err := p.EnsureRealm(ctx, devenv); err != nil {
+		t.Fatalf("EnsureRealm: %v", err)
+	}
+	if n := errors("EnsureRealm"); n != 1 {
+		t.Errorf("%v errors of EnsureRealm counted after it succeeded, want 1", n)
+	}
+	if provider.Called("EnsureRealm") != 2 {
+		t.Errorf("EnsureRealm called %d times, want 2", provider.Called("EnsureRealm"))
+	}
+}
+
+func TestDevEnvCollector(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = cndev1alpha1.AddToScheme(scheme)
+
+	devenv := func(name string, phase cndev1alpha1.BuildPhase) *cndev1alpha1.DevEnv {
+		return &cndev1alpha1.DevEnv{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     cndev1alpha1.DevEnvStatus{Build: phase},
+		}
+	}
+	statefulSet := func(name string, replicas int32) *appsv1.StatefulSet {
+		return &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "cnde-" + name, Namespace: "cnde-" + name, Labels: labelsForDevEnv(name)},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+		}
+	}
+	c := fakeclient.NewFakeClientWithScheme(scheme,
+		devenv("new", cndev1alpha1.BuildPhaseInitial),
+		devenv("thedeep", cndev1alpha1.BuildPhaseRunning),
+		devenv("magrathea", cndev1alpha1.BuildPhaseRunning),
+		statefulSet("thedeep", 1),
+		statefulSet("magrathea", 0),
+		// the StatefulSet of a deleted DevEnv is no suspended DevEnv
+		statefulSet("vogon", 0),
+	)
+
+	expected := `
+# HELP cnde_devenvs Number of DevEnvs by build phase.
+# TYPE cnde_devenvs gauge
+cnde_devenvs{phase="Building"} 0
+cnde_devenvs{phase="Initial"} 1
+cnde_devenvs{phase="Initializing"} 0
+cnde_devenvs{phase="Running"} 2
+cnde_devenvs{phase="WaitForInitializion"} 0
+# HELP cnde_devenvs_suspended Number of DevEnvs by suspended state, a DevEnv is suspended while its IDE StatefulSet is scaled to zero replicas.
+# TYPE cnde_devenvs_suspended gauge
+cnde_devenvs_suspended{suspended="false"} 2
+cnde_devenvs_suspended{suspended="true"} 1
+`
+	if err := testutil.CollectAndCompare(&devEnvCollector{client: c}, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+// deadlineOAUTH reports whether calls of GetRealm have a deadline
+type deadlineOAUTH struct {
+	*fake.OAUTHProvider
+	deadline bool
+}
+
+func (p *deadlineOAUTH) GetRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	_, p.deadline = ctx.Deadline()
+	return "", ctx.Err()
+}
+
+func TestInstrumentOAUTHCallTimeout(t *testing.T) {
+	devenv := &cndev1alpha1.DevEnv{ObjectMeta: metav1.ObjectMeta{Name: "thedeep"}}
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		provider := &deadlineOAUTH{OAUTHProvider: fake.NewOAUTHProvider()}
+		if _, err := instrumentOAUTH("test", provider, timeout).GetRealm(context.Background(), devenv); err != nil {
+			t.Fatalf("GetRealm: %v", err)
+		}
+		if provider.deadline != (timeout > 0) {
+			t.Errorf("call timeout %v: got deadline %v, want %v", timeout, provider.deadline, timeout > 0)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// driftPolicyRepair lets the OAUTH provider repair missing or drifted objects
+	driftPolicyRepair = "repair"
+	// driftPolicyReport only reports missing or drifted objects by condition OauthReady
+	driftPolicyReport = "report"
+
+	// requeue interval while the OAUTH provider does not match the DevEnv
+	oauthNotReadyRequeue = time.Minute
+
+	// rotatePasswordAnnotation on a DevEnv generates a new initial password, the annotation is removed afterwards
+	rotatePasswordAnnotation = "c-n-d-e.kube-platform.dev/rotate-password"
+	// number of random bytes of generated passwords
+	initialPasswordLength = 18
+)
+
+// reconcileOauth verifies realm, client and user of the DevEnv each time it reconciles.
+// They are always created if the DevEnv is new, afterwards the drift policy decides if they are repaired.
+func (r *DevEnvReconciler) reconcileOauth(ctx context.Context, devenv *cndev1alpha1.DevEnv) (ctrl.Result, error) {
+	repair := r.oauthDriftPolicy != driftPolicyReport
+
+	if devenv.Status.Realm == "" {
+		name, err := r.oauth.EnsureRealm(ctx, devenv)
+		if err != nil {
+			r.Log.Error(err, "Failed to create new Realm.")
+			r.recordOauthNotReady(devenv, "ProviderError", err)
+			return ctrl.Result{}, err
+		}
+		r.eventf(devenv, corev1.EventTypeNormal, reasonRealmCreated, "Created realm %s", name)
+
+		devenv.Status.Realm = name
+		err = r.Status().Update(ctx, devenv)
+		if err != nil {
+			r.Log.Error(err, "Failed to update User Environment Status")
+			return ctrl.Result{}, err
+		}
+	} else {
+		getRealm := r.oauth.GetRealm
+		if repair {
+			getRealm = r.oauth.EnsureRealm
+		}
+		if _, err := getRealm(ctx, devenv); err != nil {
+			return r.oauthNotReady(ctx, devenv, err)
+		}
+	}
+
+	// the user is created after the client, so the DevEnv is new as long as it has no user
+	isNew := devenv.Status.User == ""
+
+	getClient := r.oauth.GetClient
+	if repair || isNew {
+		getClient = r.oauth.EnsureClient
+	}
+	secret, err := getClient(ctx, devenv)
+	if err != nil {
+		return r.oauthNotReady(ctx, devenv, err)
+	}
+	if secret == "" {
+		return ctrl.Result{RequeueAfter: 2 * time.Second}, nil // some time for keycloak
+	}
+	r.oauthClientSecret = secret
+
+	var name string
+	if repair || isNew {
+		name, err = r.oauth.EnsureUser(ctx, devenv, r.initialPasswordFunc(devenv))
+	} else {
+		name, err = r.oauth.GetUser(ctx, devenv)
+	}
+	if err != nil {
+		return r.oauthNotReady(ctx, devenv, err)
+	}
+
+	if devenv.Status.User != name {
+		devenv.Status.User = name
+		err = r.Status().Update(ctx, devenv)
+		if err != nil {
+			r.Log.Error(err, "Failed to update User Environment User")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: true}, nil // wait for status udpate
+	}
+
+	err = r.oauth.EnsureCollaborators(ctx, devenv, r.initialPasswordFunc(devenv))
+	if err != nil {
+		return r.oauthNotReady(ctx, devenv, err)
+	}
+
+	if _, rotate := devenv.Annotations[rotatePasswordAnnotation]; rotate {
+		r.Log.Info("Rotating initial password.", "DevEnv", devenv.Name)
+		err = r.oauth.ResetPassword(ctx, devenv, r.initialPasswordFunc(devenv))
+		if err != nil {
+			r.Log.Error(err, "Failed to rotate initial password.")
+			r.recordOauthNotReady(devenv, "ProviderError", err)
+			return ctrl.Result{}, err
+		}
+		r.eventf(devenv, corev1.EventTypeNormal, reasonPasswordRotated, "Rotated the initial password")
+		delete(devenv.Annotations, rotatePasswordAnnotation)
+		err = r.Update(ctx, devenv)
+		if err != nil {
+			r.Log.Error(err, "Failed to remove annotation.", "annotation", rotatePasswordAnnotation)
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	return r.setOauthCondition(ctx, devenv, corev1.ConditionTrue, "InSync", "realm, client and user match the DevEnv")
+}
+
+// oauthNotReady reports errors of the OAUTH provider by condition OauthReady
+func (r *DevEnvReconciler) oauthNotReady(ctx context.Context, devenv *cndev1alpha1.DevEnv, err error) (ctrl.Result, error) {
+	reason := "ProviderError"
+	switch {
+	case oauth.IsNotFound(err):
+		reason = "NotFound"
+	case oauth.IsDrift(err):
+		reason = "Drifted"
+	}
+
+	r.recordOauthNotReady(devenv, reason, err)
+	if res, uerr := r.setOauthCondition(ctx, devenv, corev1.ConditionFalse, reason, err.Error()); uerr != nil {
+		return res, uerr
+	}
+
+	if reason == "ProviderError" {
+		r.Log.Error(err, "Failed to reconcile OAUTH provider.")
+		return ctrl.Result{}, err
+	}
+	r.Log.Info("OAUTH provider does not match DevEnv.", "reason", reason, "message", err.Error())
+	return ctrl.Result{RequeueAfter: oauthNotReadyRequeue}, nil
+}
+
+func (r *DevEnvReconciler) setOauthCondition(ctx context.Context, devenv *cndev1alpha1.DevEnv, status corev1.ConditionStatus, reason, message string) (ctrl.Result, error) {
+	changed := devenv.Status.SetCondition(cndev1alpha1.DevEnvCondition{
+		Type:    cndev1alpha1.DevEnvConditionOauthReady,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+	if !changed {
+		return ctrl.Result{}, nil
+	}
+
+	err := r.Status().Update(ctx, devenv)
+	if err != nil {
+		r.Log.Error(err, "Failed to update User Environment Conditions")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// initialPasswordFunc returns the oauth.PasswordFunc for the user of the DevEnv.
+// It generates a random password and stores it in a Secret, before the provider sets it.
+func (r *DevEnvReconciler) initialPasswordFunc(devenv *cndev1alpha1.DevEnv) oauth.PasswordFunc {
+	return func(ctx context.Context, username string) (string, error) {
+		password, err := oauth.GenerateSecret(initialPasswordLength)
+		if err != nil {
+			return "", err
+		}
+		return password, r.storeInitialPassword(ctx, devenv, username, password)
+	}
+}
+
+func (r *DevEnvReconciler) storeInitialPassword(ctx context.Context, devenv *cndev1alpha1.DevEnv, username, password string) error {
+	secret := r.secretInitialPasswordForDevEnv(devenv, username, password)
+
+	found := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: secret.Name, Namespace: secret.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		r.Log.Info("Creating a new Initial Password Secret.", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name, "User", username)
+		err = r.Create(ctx, secret)
+		if err != nil {
+			r.Log.Error(err, "Failed to create new Initial Password Secret.", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+		}
+		return err
+	} else if err != nil {
+		r.Log.Error(err, "Failed to get Initial Password Secret.")
+		return err
+	}
+
+	r.Log.Info("Updating Initial Password Secret.", "Secret.Namespace", found.Namespace, "Secret.Name", found.Name)
+	found.StringData = secret.StringData
+	err = r.Update(ctx, found)
+	if err != nil {
+		r.Log.Error(err, "Failed to update Initial Password Secret.")
+	}
+	return err
+}
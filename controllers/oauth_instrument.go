@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentedOAUTH traces the calls of an OAUTH provider and measures their latency and errors. Calls are
+// cancelled after callTimeout, so a hanging provider does not block a worker of the controller.
+type instrumentedOAUTH struct {
+	oauth.OAUTHProvider
+	provider    string
+	callTimeout time.Duration
+}
+
+// instrumentOAUTH returns the provider with calls traced, measured and limited to callTimeout, labeled with
+// its name. Calls are not limited if callTimeout is 0.
+func instrumentOAUTH(name string, p oauth.OAUTHProvider, callTimeout time.Duration) oauth.OAUTHProvider {
+	if _, ok := p.(*instrumentedOAUTH); ok {
+		return p
+	}
+	return &instrumentedOAUTH{OAUTHProvider: p, provider: name, callTimeout: callTimeout}
+}
+
+// start starts the span of a call of method, done ends it and records the call and its error
+func (p *instrumentedOAUTH) start(ctx context.Context, method string) (_ context.Context, done func(error)) {
+	start := time.Now()
+	cancel := context.CancelFunc(func() {})
+	if p.callTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.callTimeout)
+	}
+	ctx, span := tracer().Start(ctx, "OAUTH "+method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(oauthMethodKey.String(method), oauthProviderKey.String(p.provider)))
+	return ctx, func(err error) {
+		oauthRequestDuration.WithLabelValues(p.provider, method).Observe(time.Since(start).Seconds())
+		if err != nil && !oauth.IsNotFound(err) {
+			oauthRequestErrors.WithLabelValues(p.provider, method).Inc()
+			setSpanError(span, err)
+		}
+		span.End()
+		cancel()
+	}
+}
+
+func (p *instrumentedOAUTH) EnsureRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	ctx, done := p.start(ctx, "EnsureRealm")
+	name, err := p.OAUTHProvider.EnsureRealm(ctx, cr)
+	done(err)
+	return name, err
+}
+
+func (p *instrumentedOAUTH) GetRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	ctx, done := p.start(ctx, "GetRealm")
+	name, err := p.OAUTHProvider.GetRealm(ctx, cr)
+	done(err)
+	return name, err
+}
+
+func (p *instrumentedOAUTH) DeleteRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) error {
+	ctx, done := p.start(ctx, "DeleteRealm")
+	err := p.OAUTHProvider.DeleteRealm(ctx, cr)
+	done(err)
+	return err
+}
+
+func (p *instrumentedOAUTH) EnsureUser(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc) (string, error) {
+	ctx, done := p.start(ctx, "EnsureUser")
+	name, err := p.OAUTHProvider.EnsureUser(ctx, cr, password)
+	done(err)
+	return name, err
+}
+
+func (p *instrumentedOAUTH) GetUser(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	ctx, done := p.start(ctx, "GetUser")
+	name, err := p.OAUTHProvider.GetUser(ctx, cr)
+	done(err)
+	return name, err
+}
+
+func (p *instrumentedOAUTH) DeleteUser(ctx context.Context, cr *cndev1alpha1.DevEnv) error {
+	ctx, done := p.start(ctx, "DeleteUser")
+	err := p.OAUTHProvider.DeleteUser(ctx, cr)
+	done(err)
+	return err
+}
+
+func (p *instrumentedOAUTH) ResetPassword(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc) error {
+	ctx, done := p.start(ctx, "ResetPassword")
+	err := p.OAUTHProvider.ResetPassword(ctx, cr, password)
+	done(err)
+	return err
+}
+
+func (p *instrumentedOAUTH) EnsureCollaborators(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc) error {
+	ctx, done := p.start(ctx, "EnsureCollaborators")
+	err := p.OAUTHProvider.EnsureCollaborators(ctx, cr, password)
+	done(err)
+	return err
+}
+
+func (p *instrumentedOAUTH) EnsureClient(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	ctx, done := p.start(ctx, "EnsureClient")
+	secret, err := p.OAUTHProvider.EnsureClient(ctx, cr)
+	done(err)
+	return secret, err
+}
+
+func (p *instrumentedOAUTH) GetClient(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	ctx, done := p.start(ctx, "GetClient")
+	secret, err := p.OAUTHProvider.GetClient(ctx, cr)
+	done(err)
+	return secret, err
+}
+
+func (p *instrumentedOAUTH) DeleteClient(ctx context.Context, cr *cndev1alpha1.DevEnv) error {
+	ctx, done := p.start(ctx, "DeleteClient")
+	err := p.OAUTHProvider.DeleteClient(ctx, cr)
+	done(err)
+	return err
+}
+
+func (p *instrumentedOAUTH) RotateClientSecret(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	ctx, done := p.start(ctx, "RotateClientSecret")
+	secret, err := p.OAUTHProvider.RotateClientSecret(ctx, cr)
+	done(err)
+	return secret, err
+}
+
+func (p *instrumentedOAUTH) ListTagged(ctx context.Context) ([]oauth.TaggedObject, error) {
+	ctx, done := p.start(ctx, "ListTagged")
+	tagged, err := p.OAUTHProvider.ListTagged(ctx)
+	done(err)
+	return tagged, err
+}
+
+func (p *instrumentedOAUTH) DeleteTagged(ctx context.Context, obj oauth.TaggedObject) error {
+	ctx, done := p.start(ctx, "DeleteTagged")
+	err := p.OAUTHProvider.DeleteTagged(ctx, obj)
+	done(err)
+	return err
+}
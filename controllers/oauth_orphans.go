@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// OauthOrphanScanner periodically deletes realms, clients and users the OAUTH provider keeps for DevEnvs
+// which no longer exist, e.g. because the operator was not running when they were deleted.
+// Only objects tagged with oauth.DevEnvTag are considered, objects of other applications are never touched.
+type OauthOrphanScanner struct {
+	Reconciler *DevEnvReconciler
+	Interval   time.Duration
+}
+
+// Start runs the scan every Interval until stop is closed, it implements manager.Runnable
+func (s *OauthOrphanScanner) Start(stop <-chan struct{}) error {
+	wait.Until(func() {
+		if err := s.Reconciler.scanOauthOrphans(context.Background()); err != nil {
+			s.Reconciler.Log.Error(err, "Failed to scan for orphaned OAUTH objects.")
+		}
+	}, s.Interval, stop)
+	return nil
+}
+
+// scanOauthOrphans deletes the tagged objects of the OAUTH provider whose DevEnv is gone.
+// Users are kept while their email is used as owner or collaborator by an existing DevEnv.
+func (r *DevEnvReconciler) scanOauthOrphans(ctx context.Context) (err error) {
+	ctx, span := tracer().Start(ctx, "ScanOauthOrphans")
+	defer func() {
+		setSpanError(span, err)
+		span.End()
+	}()
+
+	provider := r.OAUTH
+	if provider == nil {
+		oauthProviderName, oauthConfig, err := r.oauthConfigFromEnv()
+		if err != nil {
+			return err
+		}
+		if provider, err = oauth.NewOAUTHProvider(oauthProviderName, oauthConfig); err != nil {
+			return err
+		}
+		provider = instrumentOAUTH(oauthProviderName, provider, oauthConfig.CallTimeout)
+	}
+
+	// list tagged objects first, DevEnvs created in between are listed afterwards and not considered orphaned
+	tagged, err := provider.ListTagged(ctx)
+	if err != nil {
+		return err
+	}
+
+	devenvList := &cndev1alpha1.DevEnvList{}
+	if err = r.List(ctx, devenvList); err != nil {
+		return err
+	}
+	devenvs := map[string]bool{}
+	emails := map[string]bool{}
+	for _, d := range devenvList.Items {
+		devenvs[d.Name] = true
+		emails[strings.ToLower(d.Spec.UserEmail)] = true
+		for _, c := range d.Spec.Collaborators {
+			emails[strings.ToLower(c.Email)] = true
+		}
+	}
+
+	for _, obj := range tagged {
+		if devenvs[obj.DevEnv] || (obj.Email != "" && emails[strings.ToLower(obj.Email)]) {
+			continue
+		}
+		r.Log.Info("Deleting orphaned OAUTH object.", "Kind", obj.Kind, "Name", obj.Name, "DevEnv", obj.DevEnv)
+		if err = provider.DeleteTagged(ctx, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
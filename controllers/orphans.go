@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// OrphanPolicy decides what the OrphanCollector does with the orphaned objects it finds
+type OrphanPolicy string
+
+const (
+	// OrphanPolicyDryRun only reports orphaned objects
+	OrphanPolicyDryRun OrphanPolicy = "DryRun"
+	// OrphanPolicyKeepVolumes deletes orphaned objects but Namespaces and PersistentVolumeClaims, which are reported
+	OrphanPolicyKeepVolumes OrphanPolicy = "KeepVolumes"
+	// OrphanPolicyDelete deletes all orphaned objects
+	OrphanPolicyDelete OrphanPolicy = "Delete"
+)
+
+// ParseOrphanPolicy returns the policy named s, DryRun if s is empty
+func ParseOrphanPolicy(s string) (OrphanPolicy, error) {
+	switch p := OrphanPolicy(s); p {
+	case "":
+		return OrphanPolicyDryRun, nil
+	case OrphanPolicyDryRun, OrphanPolicyKeepVolumes, OrphanPolicyDelete:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown orphan policy %q, want %s, %s or %s", s, OrphanPolicyDryRun, OrphanPolicyKeepVolumes, OrphanPolicyDelete)
+}
+
+// OrphanCollector periodically looks for objects labelled with a DevEnv which no longer exists, e.g. because
+// its deletion crashed or the operator was not running, and deletes or reports them according to Policy.
+type OrphanCollector struct {
+	Reconciler *DevEnvReconciler
+	// Reader lists the objects, nil for the client of the Reconciler. The reader of the API server
+	// of the manager avoids caching all Secrets and Pods of the cluster.
+	Reader   client.Reader
+	Interval time.Duration
+	// Policy is DryRun if empty
+	Policy OrphanPolicy
+}
+
+// Start runs the collection every Interval until stop is closed, it implements manager.Runnable
+func (c *OrphanCollector) Start(stop <-chan struct{}) error {
+	wait.Until(func() {
+		if _, err := c.collect(context.Background()); err != nil {
+			c.Reconciler.Log.Error(err, "Failed to collect orphaned objects.")
+		}
+	}, c.Interval, stop)
+	return nil
+}
+
+// collect returns the orphaned objects it found, deleted or not
+func (c *OrphanCollector) collect(ctx context.Context) (orphans []string, err error) {
+	ctx, span := tracer().Start(ctx, "CollectOrphans")
+	defer func() {
+		setSpanError(span, err)
+		span.End()
+	}()
+
+	reader := c.Reader
+	if reader == nil {
+		reader = c.Reconciler.Client
+	}
+
+	// list labelled objects first, DevEnvs created in between are listed afterwards and their objects not considered orphaned
+	type orphan struct {
+		kind   string
+		volume bool
+		obj    runtime.Object
+	}
+	var labelled []orphan
+	found := map[string]int{}
+	for _, l := range c.Reconciler.cleanupLists() {
+		found[l.kind] = 0
+		if err = reader.List(ctx, l.list, client.MatchingLabelsSelector{Selector: selectorForDevEnv("")}); err != nil {
+			return nil, fmt.Errorf("listing %s: %v", l.kind, err)
+		}
+		items, err := meta.ExtractList(l.list)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			labelled = append(labelled, orphan{kind: l.kind, volume: l.volume, obj: item})
+		}
+	}
+
+	devenvList := &cndev1alpha1.DevEnvList{}
+	if err = reader.List(ctx, devenvList); err != nil {
+		return nil, err
+	}
+	devenvs := map[string]bool{}
+	for _, d := range devenvList.Items {
+		devenvs[d.Name] = true
+	}
+
+	for _, o := range labelled {
+		obj, err := meta.Accessor(o.obj)
+		if err != nil {
+			return nil, err
+		}
+		devenv := obj.GetLabels()[userenvnameLabel]
+		if devenvs[devenv] || obj.GetDeletionTimestamp() != nil {
+			continue
+		}
+		name := o.kind + " " + objectName(obj.GetNamespace(), obj.GetName())
+		orphans = append(orphans, name)
+		found[o.kind]++
+
+		if !(c.Policy == OrphanPolicyDelete || (c.Policy == OrphanPolicyKeepVolumes && !o.volume)) {
+			c.Reconciler.Log.Info("Found orphaned object.", "object", name, "DevEnv", devenv, "policy", c.Policy)
+			continue
+		}
+		c.Reconciler.Log.Info("Deleting orphaned object.", "object", name, "DevEnv", devenv)
+		err = c.Reconciler.Delete(ctx, o.obj, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("deleting %s: %v", name, err)
+		}
+		orphansDeleted.WithLabelValues(o.kind).Inc()
+	}
+
+	for kind, n := range found {
+		orphanedObjects.WithLabelValues(kind).Set(float64(n))
+	}
+	orphanCollectionTimestamp.SetToCurrentTime()
+	return orphans, nil
+}
@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// rotateSecretsAnnotation on a DevEnv rotates cookie and client secret, the annotation is removed afterwards
+	rotateSecretsAnnotation = "c-n-d-e.kube-platform.dev/rotate-secrets"
+	// secretsRotatedAnnotation on the OAUTH Proxy Secret holds the time of the last rotation
+	secretsRotatedAnnotation = "c-n-d-e.kube-platform.dev/secrets-rotated"
+	// configHashAnnotation on the Pod template of the OAUTH Proxy Deployment holds the hash of the Secret and the args it was started with
+	configHashAnnotation = "c-n-d-e.kube-platform.dev/config-hash"
+	// number of random bytes of cookie secrets, oauth2-proxy needs 16, 24 or 32
+	cookieSecretLength = 32
+	// legacyCookieSecret was used by all DevEnvs of former versions, Secrets still having it are rotated
+	legacyCookieSecret = "WhatEver123456888888"
+)
+
+// reconcileProxySecret creates the OAUTH Proxy Secret, keeps its client secret and allowed emails in sync
+// and rotates cookie and client secret on demand or if CNDE_SECRET_ROTATION_INTERVAL elapsed.
+// r.proxySecretHash is set to the hash of the resulting Secret.
+func (r *DevEnvReconciler) reconcileProxySecret(ctx context.Context, devenv *cndev1alpha1.DevEnv) (ctrl.Result, error) {
+	proxySecret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: r.proxyPodName, Namespace: r.ManagerNamespace}, proxySecret)
+	if err != nil && errors.IsNotFound(err) {
+		if r.oauthCookieSecret, err = oauth.GenerateSecret(cookieSecretLength); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.secretsRotated = time.Now()
+		proxysec := r.secretOauthProxyForDevEnv(devenv)
+		r.Log.Info("Creating a new OAUTH Proxy Secret.", "Secret.Namespace", proxysec.Namespace, "Secret.Name", proxysec.Name)
+		err = r.Create(ctx, proxysec)
+		r.recordCreate(devenv, "Secret", objectName(proxysec.Namespace, proxysec.Name), err)
+		if err != nil {
+			r.Log.Error(err, "Failed to create new OAUTH Proxy Secret.", "Secret.Namespace", proxysec.Namespace, "Secret.Name", proxysec.Name)
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: true}, nil
+	} else if err != nil {
+		r.Log.Error(err, "Failed to get OAUTH Proxy Secret.")
+		return ctrl.Result{}, err
+	}
+
+	_, onDemand := devenv.Annotations[rotateSecretsAnnotation]
+	if onDemand || r.rotationDue(proxySecret) {
+		r.Log.Info("Rotating cookie and client secret.", "DevEnv", devenv.Name)
+		if r.oauthClientSecret, err = r.oauth.RotateClientSecret(ctx, devenv); err != nil {
+			r.Log.Error(err, "Failed to rotate client secret.")
+			r.recordOauthNotReady(devenv, "ProviderError", err)
+			return ctrl.Result{}, err
+		}
+		if r.oauthCookieSecret, err = oauth.GenerateSecret(cookieSecretLength); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.secretsRotated = time.Now()
+		desired := r.secretOauthProxyForDevEnv(devenv)
+		proxySecret.StringData = desired.StringData
+		proxySecret.Annotations = desired.Annotations
+		err = r.Update(ctx, proxySecret)
+		if err != nil {
+			r.Log.Error(err, "Failed to update OAUTH Proxy Secret.")
+			return ctrl.Result{}, err
+		}
+		r.eventf(devenv, corev1.EventTypeNormal, reasonSecretsRotated, "Rotated cookie and client secret of oauth2-proxy")
+		if onDemand {
+			delete(devenv.Annotations, rotateSecretsAnnotation)
+			err = r.Update(ctx, devenv)
+			if err != nil {
+				r.Log.Error(err, "Failed to remove annotation.", "annotation", rotateSecretsAnnotation)
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	emails := r.proxyEmails(devenv)
+	changed := string(proxySecret.Data["client_secret"]) != r.oauthClientSecret
+	for k, v := range emails {
+		changed = changed || string(proxySecret.Data[k]) != v
+	}
+	if changed {
+		r.Log.Info("Updating OAUTH Proxy Secret, the client secret or the allowed emails changed.", "Secret.Namespace", proxySecret.Namespace, "Secret.Name", proxySecret.Name)
+		proxySecret.StringData = map[string]string{"client_secret": r.oauthClientSecret}
+		for k, v := range emails {
+			proxySecret.StringData[k] = v
+		}
+		err = r.Update(ctx, proxySecret)
+		if err != nil {
+			r.Log.Error(err, "Failed to update OAUTH Proxy Secret.")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	r.proxySecretHash = secretHash(proxySecret.Data)
+	return ctrl.Result{}, nil
+}
+
+// reconcileProxyDeployment creates the Deployment of oauth2-proxy and rolls out new Pods if it was started
+// with another Secret or other args, oauth2-proxy reads the Secret at startup only. The Pod of former versions
+// is deleted, the Pods of the Deployment are named differently and take over at once.
+func (r *DevEnvReconciler) reconcileProxyDeployment(ctx context.Context, devenv *cndev1alpha1.DevEnv) (ctrl.Result, error) {
+	if _, err := r.deleteLegacyPod(ctx, devenv, r.proxyPodName, r.ManagerNamespace); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	desired := r.deploymentOauthProxyForDevEnv(devenv)
+	found := &appsv1.Deployment{}
+	err := r.Get(ctx, types.NamespacedName{Name: desired.Name, Namespace: desired.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		r.Log.Info("Creating a new OAUTH Proxy Deployment.", "Deployment.Namespace", desired.Namespace, "Deployment.Name", desired.Name)
+		err = r.Create(ctx, desired)
+		r.recordCreate(devenv, "Deployment", objectName(desired.Namespace, desired.Name), err)
+		if err != nil {
+			r.Log.Error(err, "Failed to create new OAUTH Proxy Deployment.", "Deployment.Namespace", desired.Namespace, "Deployment.Name", desired.Name)
+		}
+		return ctrl.Result{}, err
+	} else if err != nil {
+		r.Log.Error(err, "Failed to get OAUTH Proxy Deployment.")
+		return ctrl.Result{}, err
+	}
+
+	if found.Spec.Template.Annotations[configHashAnnotation] == desired.Spec.Template.Annotations[configHashAnnotation] {
+		return ctrl.Result{}, nil
+	}
+	r.Log.Info("Rolling out OAUTH Proxy, its Secret or args changed.", "Deployment.Namespace", found.Namespace, "Deployment.Name", found.Name)
+	found.Spec.Template = desired.Spec.Template
+	if err = r.Update(ctx, found); err != nil {
+		r.Log.Error(err, "Failed to update OAUTH Proxy Deployment.")
+		return ctrl.Result{}, err
+	}
+	r.eventf(devenv, corev1.EventTypeNormal, reasonProxyRestarted, "Rolled out OAUTH Proxy Deployment %s, its Secret or args changed", found.Name)
+	return ctrl.Result{}, nil
+}
+
+// reconcileProxyService creates the Service of oauth2-proxy and updates its ports, the terminal port
+// depends on the exposure
+func (r *DevEnvReconciler) reconcileProxyService(ctx context.Context, devenv *cndev1alpha1.DevEnv) error {
+	desired := r.serviceOauthProxyForDevEnv(devenv)
+	found := &corev1.Service{}
+	err := r.Get(ctx, types.NamespacedName{Name: desired.Name, Namespace: desired.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		r.Log.Info("Creating a new OAUTH Proxy Service.", "Service.Namespace", desired.Namespace, "Service.Name", desired.Name)
+		err = r.Create(ctx, desired)
+		r.recordCreate(devenv, "Service", objectName(desired.Namespace, desired.Name), err)
+		if err != nil {
+			r.Log.Error(err, "Failed to create new OAUTH Proxy Service.", "Service.Namespace", desired.Namespace, "Service.Name", desired.Name)
+		}
+		return err
+	} else if err != nil {
+		r.Log.Error(err, "Failed to get OAUTH Proxy Service.")
+		return err
+	}
+
+	if servicePortsEqual(found.Spec.Ports, desired.Spec.Ports) {
+		return nil
+	}
+	r.Log.Info("Updating ports of OAUTH Proxy Service.", "Service.Namespace", found.Namespace, "Service.Name", found.Name)
+	found.Spec.Ports = desired.Spec.Ports
+	if err = r.Update(ctx, found); err != nil {
+		r.Log.Error(err, "Failed to update OAUTH Proxy Service.")
+	}
+	return err
+}
+
+// servicePortsEqual compares name and port, the API server defaults protocol and target port
+func servicePortsEqual(a, b []corev1.ServicePort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Port != b[i].Port {
+			return false
+		}
+	}
+	return true
+}
+
+// rotationDue reports whether the secrets are older than the rotation interval
+func (r *DevEnvReconciler) rotationDue(proxySecret *corev1.Secret) bool {
+	if string(proxySecret.Data["cookie_secret"]) == legacyCookieSecret {
+		return true
+	}
+	if r.secretRotationInterval == 0 {
+		return false
+	}
+	rotated, err := time.Parse(time.RFC3339, proxySecret.Annotations[secretsRotatedAnnotation])
+	if err != nil {
+		return true
+	}
+	return time.Since(rotated) >= r.secretRotationInterval
+}
+
+// requeueAfter returns the interval running DevEnvs are reconciled in, 0 if only on changes
+func (r *DevEnvReconciler) requeueAfter() time.Duration {
+	if r.secretRotationInterval > 0 && (r.oauthVerifyInterval == 0 || r.secretRotationInterval < r.oauthVerifyInterval) {
+		return r.secretRotationInterval
+	}
+	return r.oauthVerifyInterval
+}
+
+// configHash returns the hash of the Secret and the args of the OAUTH Proxy Pod
+func configHash(secretHash string, args []string) string {
+	h := sha256.New()
+	h.Write([]byte(secretHash))
+	for _, a := range args {
+		h.Write([]byte{0})
+		h.Write([]byte(a))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// secretHash returns a stable hash of the data of a Secret
+func secretHash(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write(data[k])
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"k8s.io/apimachinery/pkg/runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+// RenderOptions are the values Render uses for what is only known while reconciling
+type RenderOptions struct {
+	// Builder of the DevEnv, nil if it has none
+	Builder *cndev1alpha1.Builder
+	// OAUTH provider giving client id, issuer and groups, nil for the one configured by the environment
+	OAUTH oauth.OAUTHProvider
+	// RealmPolicy of the manager, nil for the default one
+	RealmPolicy *oauth.RealmPolicy
+	// IngressAPI the Ingresses are rendered in
+	IngressAPI IngressAPI
+	// Exposure of the DevEnv, Ingresses if empty
+	Exposure Exposure
+	// IngressAuth protecting the Ingresses, nginx if empty
+	IngressAuth IngressAuth
+
+	ClientSecret   string
+	CookieSecret   string
+	SecretsRotated time.Time
+}
+
+// DefaultRenderOptions returns placeholders for the secrets and networking.k8s.io/v1 Ingresses
+func DefaultRenderOptions() RenderOptions {
+	return RenderOptions{
+		IngressAPI:     IngressAPINetworkingV1,
+		ClientSecret:   "<client secret>",
+		CookieSecret:   "<cookie secret>",
+		SecretsRotated: time.Now(),
+	}
+}
+
+// Render returns the manifests the operator creates for the DevEnv, in the order they are created,
+// configured by the environment like the manager. The Secrets of initial passwords are left out,
+// their users are named by the OAUTH provider when it creates them.
+func Render(devenv *cndev1alpha1.DevEnv, scheme *runtime.Scheme, opts RenderOptions) ([]runtime.Object, error) {
+	r := &DevEnvReconciler{Log: logf.NullLogger{}, Scheme: scheme, OAUTH: opts.OAUTH, RealmPolicy: opts.RealmPolicy,
+		IngressAPI: opts.IngressAPI, Exposure: opts.Exposure, IngressAuth: opts.IngressAuth}
+	if err := r.initStruct(devenv); err != nil {
+		return nil, err
+	}
+	if err := r.checkAllowedGroups(devenv); err != nil {
+		return nil, err
+	}
+	r.oauthClientSecret = opts.ClientSecret
+	r.oauthCookieSecret = opts.CookieSecret
+	r.secretsRotated = opts.SecretsRotated
+
+	proxySecret := r.secretOauthProxyForDevEnv(devenv)
+	data := map[string][]byte{}
+	for k, v := range proxySecret.StringData {
+		data[k] = []byte(v)
+	}
+	r.proxySecretHash = secretHash(data)
+
+	objs := []runtime.Object{
+		r.createNamespaceForDevEnv(devenv),
+		r.serviceAccountForDevEnv(devenv),
+		r.rbacRBForDevEnv(devenv),
+		r.rbacCRBForDevEnv(devenv),
+		r.pvcVMForDevEnv(devenv),
+		r.pvcHomeForDevEnv(devenv),
+		r.pvcDockerForDevEnv(devenv),
+	}
+	if opts.Builder != nil {
+		objs = append(objs, r.buildPodForDevEnv(devenv, opts.Builder))
+	}
+	objs = append(objs,
+		r.podForInitializingDevEnv(devenv),
+		r.statefulSetForDevEnv(devenv),
+		r.serviceForDevEnv(devenv),
+		r.serviceProxyForDevEnv(devenv),
+	)
+	objs = append(objs, r.exposureBackend().objects(devenv)...)
+	if r.managesCertificate() {
+		objs = append(objs, r.certificateForDevEnv(devenv))
+	}
+	objs = append(objs,
+		proxySecret,
+		r.deploymentOauthProxyForDevEnv(devenv),
+		r.serviceOauthProxyForDevEnv(devenv),
+	)
+
+	for _, obj := range objs {
+		if !obj.GetObjectKind().GroupVersionKind().Empty() {
+			continue
+		}
+		gvks, _, err := scheme.ObjectKinds(obj)
+		if err != nil {
+			return nil, err
+		}
+		obj.GetObjectKind().SetGroupVersionKind(gvks[0])
+	}
+	return objs, nil
+}
+
+// WriteYAML writes the objects as a stream of YAML documents
+func WriteYAML(w io.Writer, objs []runtime.Object) error {
+	for _, obj := range objs {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "---\n%s", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
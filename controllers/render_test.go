@@ -0,0 +1,235 @@
+package controllers
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	_ "cnde-operator.cloud-native-coding.dev/oauth/keycloak"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+var update = flag.Bool("update", false, "update the expected.yaml files of the golden tests")
+
+// renderEnv lists all variables of the environment initStruct reads, they are unset unless a case sets them
+var renderEnv = []string{
+	"CNDE_MANAGER_NAMESPACE", "CNDE_SUBDOMAIN", "CNDE_IDE_MEM_REQUEST", "CNDE_DOCKER_MEM_REQUEST",
+	"CNDE_INITIAL_PASSWORD_NAMESPACE", "CNDE_OAUTH_PROVIDERNAME", "CNDE_OAUTH_URL", "CNDE_OAUTH_ISSUER_URL",
+	"CNDE_OAUTH_ADMIN_NAME", "CNDE_OAUTH_ADMIN_PASSWORD", "CNDE_OAUTH_ADMIN_REALM", "CNDE_OAUTH_REALM_MODE",
+	"CNDE_OAUTH_SHARED_REALM", "CNDE_OAUTH_TIMEOUT", "CNDE_OAUTH_DRIFT_POLICY", "CNDE_OAUTH_VERIFY_INTERVAL",
+	"CNDE_SECRET_ROTATION_INTERVAL", "CNDE_DEX_NAMESPACE", "CNDE_CLUSTER_DOMAIN",
+	"CNDE_INGRESS_CLASS", "CNDE_INGRESS_ANNOTATIONS", "CNDE_TLS_CLUSTER_ISSUER", "CNDE_GATEWAY", "CNDE_GATEWAY_AUTH",
+	"CNDE_TLS_ISSUER", "CNDE_OAUTH_CA_CONFIGMAP",
+}
+
+func setRenderEnv(t *testing.T, env map[string]string) {
+	for _, name := range renderEnv {
+		if err := os.Unsetenv(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, value := range env {
+		if err := os.Setenv(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readTestYAML(t *testing.T, file string, obj interface{}) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = yaml.UnmarshalStrict(data, obj); err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+}
+
+// TestRender compares the manifests rendered for testdata/render/<case>/devenv.yaml and the optional
+// builder.yaml with expected.yaml. go test ./controllers -run TestRender -update rewrites expected.yaml.
+func TestRender(t *testing.T) {
+	s := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(s)
+	_ = cndev1alpha1.AddToScheme(s)
+
+	cases := []struct {
+		name string
+		dir  string
+		env  map[string]string
+		// ingressAPI is networking.k8s.io/v1 if empty
+		ingressAPI  IngressAPI
+		exposure    Exposure
+		ingressAuth IngressAuth
+	}{
+		{
+			name: "minimal",
+			dir:  "minimal",
+			env:  map[string]string{"CNDE_MANAGER_NAMESPACE": "cnde-system"},
+		},
+		{
+			name: "builder",
+			dir:  "builder",
+			env: map[string]string{
+				"CNDE_MANAGER_NAMESPACE":  "cnde-system",
+				"CNDE_IDE_MEM_REQUEST":    "1Gi",
+				"CNDE_DOCKER_MEM_REQUEST": "2Gi",
+				"CNDE_CLUSTER_DOMAIN":     "example.internal",
+			},
+		},
+		{
+			name: "shared realm",
+			dir:  "shared",
+			env: map[string]string{
+				"CNDE_MANAGER_NAMESPACE":          "cnde-system",
+				"CNDE_SUBDOMAIN":                  "dev",
+				"CNDE_INITIAL_PASSWORD_NAMESPACE": "cnde-system",
+				"CNDE_OAUTH_REALM_MODE":           "shared",
+				"CNDE_OAUTH_SHARED_REALM":         "cnde",
+			},
+		},
+		{
+			name: "extensions/v1beta1 Ingresses",
+			dir:  "extensions",
+			env: map[string]string{
+				"CNDE_MANAGER_NAMESPACE":   "cnde-system",
+				"CNDE_INGRESS_CLASS":       "public",
+				"CNDE_INGRESS_ANNOTATIONS": `{"nginx.ingress.kubernetes.io/proxy-body-size": "0"}`,
+				"CNDE_TLS_CLUSTER_ISSUER":  "letsencrypt",
+			},
+			ingressAPI: IngressAPIExtensionsV1beta1,
+		},
+		{
+			name: "Certificate and CA bundle",
+			dir:  "certificate",
+			env: map[string]string{
+				"CNDE_MANAGER_NAMESPACE":  "cnde-system",
+				"CNDE_TLS_ISSUER":         "internal-ca",
+				"CNDE_OAUTH_CA_CONFIGMAP": "oauth-ca",
+			},
+		},
+		{
+			name: "Traefik ForwardAuth",
+			dir:  "traefik",
+			env: map[string]string{
+				"CNDE_MANAGER_NAMESPACE": "cnde-system",
+				"CNDE_INGRESS_CLASS":     "traefik",
+			},
+			ingressAuth: IngressAuthTraefik,
+		},
+		{
+			name: "oauth2-proxy in front",
+			dir:  "proxy",
+			env: map[string]string{
+				"CNDE_MANAGER_NAMESPACE": "cnde-system",
+				"CNDE_INGRESS_CLASS":     "haproxy",
+			},
+			ingressAuth: IngressAuthProxy,
+		},
+		{
+			name: "gateway through oauth2-proxy",
+			dir:  "gateway",
+			env: map[string]string{
+				"CNDE_MANAGER_NAMESPACE": "cnde-system",
+				"CNDE_GATEWAY":           "infra/public",
+			},
+			exposure: ExposureGateway,
+		},
+		{
+			name: "gateway with external auth",
+			dir:  "gateway-external-auth",
+			env: map[string]string{
+				"CNDE_MANAGER_NAMESPACE": "cnde-system",
+				"CNDE_GATEWAY":           "public",
+				"CNDE_GATEWAY_AUTH":      "external-auth",
+			},
+			exposure: ExposureGateway,
+		},
+	}
+	defer setRenderEnv(t, nil)
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setRenderEnv(t, c.env)
+			dir := filepath.Join("testdata", "render", c.dir)
+
+			devenv := &cndev1alpha1.DevEnv{}
+			readTestYAML(t, filepath.Join(dir, "devenv.yaml"), devenv)
+			opts := DefaultRenderOptions()
+			opts.SecretsRotated = time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+			if c.ingressAPI != "" {
+				opts.IngressAPI = c.ingressAPI
+			}
+			opts.Exposure = c.exposure
+			opts.IngressAuth = c.ingressAuth
+			if _, err := os.Stat(filepath.Join(dir, "builder.yaml")); err == nil {
+				opts.Builder = &cndev1alpha1.Builder{}
+				readTestYAML(t, filepath.Join(dir, "builder.yaml"), opts.Builder)
+			}
+
+			objs, err := Render(devenv, s, opts)
+			if err != nil {
+				t.Fatalf("Render: %v", err)
+			}
+			var got bytes.Buffer
+			if err = WriteYAML(&got, objs); err != nil {
+				t.Fatalf("WriteYAML: %v", err)
+			}
+
+			expectedFile := filepath.Join(dir, "expected.yaml")
+			if *update {
+				if err = ioutil.WriteFile(expectedFile, got.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := ioutil.ReadFile(expectedFile)
+			if err != nil {
+				t.Fatalf("%v, run go test ./controllers -run TestRender -update to create it", err)
+			}
+			if !bytes.Equal(got.Bytes(), expected) {
+				t.Errorf("rendered manifests differ from %s, review the diff after go test ./controllers -run TestRender -update", expectedFile)
+			}
+		})
+	}
+}
+
+func TestRenderRejectsAllowedGroups(t *testing.T) {
+	s := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(s)
+	_ = cndev1alpha1.AddToScheme(s)
+
+	cases := []struct {
+		name      string
+		env       map[string]string
+		wantError bool
+	}{
+		{"realm per DevEnv", map[string]string{}, true},
+		{"Dex", map[string]string{"CNDE_OAUTH_PROVIDERNAME": "dex"}, true},
+		{"shared realm", map[string]string{"CNDE_OAUTH_REALM_MODE": "shared", "CNDE_OAUTH_SHARED_REALM": "cnde"}, false},
+	}
+	defer setRenderEnv(t, nil)
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.env["CNDE_MANAGER_NAMESPACE"] = "cnde-system"
+			setRenderEnv(t, c.env)
+			devenv := &cndev1alpha1.DevEnv{}
+			readTestYAML(t, filepath.Join("testdata", "render", "minimal", "devenv.yaml"), devenv)
+			devenv.Spec.AllowedGroups = []string{"crew"}
+
+			_, err := Render(devenv, s, DefaultRenderOptions())
+			if c.wantError && err == nil {
+				t.Errorf("Render admitted allowedGroups the owner is no member of")
+			} else if !c.wantError && err != nil {
+				t.Errorf("Render: %v", err)
+			}
+		})
+	}
+}
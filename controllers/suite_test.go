@@ -23,6 +23,7 @@ import (
 	. "github.com/onsi/gomega"
 
 	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -40,6 +41,9 @@ var cfg *rest.Config
 var k8sClient client.Client
 var testEnv *envtest.Environment
 
+// ingressAPI is the Ingress API served by the API server of envtest
+var ingressAPI IngressAPI
+
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
 
@@ -73,6 +77,9 @@ var _ = BeforeSuite(func(done Done) {
 	Expect(err).ToNot(HaveOccurred())
 	Expect(k8sClient).ToNot(BeNil())
 
+	ingressAPI, err = DiscoverIngressAPI(discovery.NewDiscoveryClientForConfigOrDie(cfg))
+	Expect(err).ToNot(HaveOccurred())
+
 	close(done)
 }, 60)
 
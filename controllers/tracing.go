@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"context"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer of the spans of reconciles and OAUTH calls
+const TracerName = "cnde-operator.cloud-native-coding.dev/controllers"
+
+// attributes of the spans
+const (
+	devEnvNameKey    = attribute.Key("cnde.devenv.name")
+	devEnvUIDKey     = attribute.Key("cnde.devenv.uid")
+	devEnvPhaseKey   = attribute.Key("cnde.devenv.phase")
+	oauthMethodKey   = attribute.Key("cnde.oauth.method")
+	oauthProviderKey = attribute.Key("cnde.oauth.provider")
+)
+
+// tracer returns the tracer of the global TracerProvider, a no-op unless main or a test installed one
+func tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// devEnvLink links the spans of all reconciles of a DevEnv. Its trace id is the UID of the DevEnv,
+// so a search for the UID finds the reconciles of a DevEnv across requeues.
+func devEnvLink(devenv *cndev1alpha1.DevEnv) (trace.Link, bool) {
+	uid, err := uuid.Parse(string(devenv.UID))
+	if err != nil {
+		return trace.Link{}, false
+	}
+	var spanID trace.SpanID
+	copy(spanID[:], uid[:8])
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID(uid),
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	return trace.Link{SpanContext: sc, Attributes: []attribute.KeyValue{devEnvUIDKey.String(string(devenv.UID))}}, true
+}
+
+// reconcileTrace is the span of a reconcile and of the stage it is in. Reconcile returns in many places,
+// so a stage ends when the next one starts or the reconcile ends.
+type reconcileTrace struct {
+	ctx   context.Context
+	span  trace.Span
+	stage trace.Span
+}
+
+// startReconcileTrace starts the span of a reconcile of the DevEnv, linked to its other reconciles
+func startReconcileTrace(ctx context.Context, devenv *cndev1alpha1.DevEnv) *reconcileTrace {
+	opts := []trace.SpanStartOption{trace.WithAttributes(
+		devEnvNameKey.String(devenv.Name),
+		devEnvUIDKey.String(string(devenv.UID)),
+		devEnvPhaseKey.String(string(devenv.Status.Build)),
+	)}
+	if link, ok := devEnvLink(devenv); ok {
+		opts = append(opts, trace.WithLinks(link))
+	}
+	ctx, span := tracer().Start(ctx, "Reconcile", opts...)
+	return &reconcileTrace{ctx: ctx, span: span}
+}
+
+// startStage ends the current stage and starts the next one, the returned context belongs to the stage
+func (t *reconcileTrace) startStage(name string) context.Context {
+	t.endStage(nil)
+	ctx, stage := tracer().Start(t.ctx, name)
+	t.stage = stage
+	return ctx
+}
+
+func (t *reconcileTrace) endStage(err error) {
+	if t.stage == nil {
+		return
+	}
+	setSpanError(t.stage, err)
+	t.stage.End()
+	t.stage = nil
+}
+
+// end ends the current stage and the reconcile, err is recorded on both
+func (t *reconcileTrace) end(err error) {
+	t.endStage(err)
+	setSpanError(t.span, err)
+	t.span.End()
+}
+
+func setSpanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
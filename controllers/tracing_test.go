@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth/fake"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestReconcileTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	devenv := &cndev1alpha1.DevEnv{
+		ObjectMeta: metav1.ObjectMeta{Name: "thedeep", UID: types.UID("6ba7b810-9dad-11d1-80b4-00c04fd430c8")},
+		Spec:       cndev1alpha1.DevEnvSpec{UserEmail: "arthur@example.com", UserEnvDomain: "example.com"},
+		Status:     cndev1alpha1.DevEnvStatus{Build: cndev1alpha1.BuildPhaseInitial},
+	}
+	provider := instrumentOAUTH("fake", fake.NewOAUTHProvider(), 0)
+
+	tr := startReconcileTrace(context.Background(), devenv)
+	ctx := tr.startStage("Oauth")
+	if _, err := provider.EnsureRealm(ctx, devenv); err != nil {
+		t.Fatalf("EnsureRealm: %v", err)
+	}
+	tr.startStage("Build")
+	tr.end(fmt.Errorf("build failed"))
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	for _, name := range []string{"Reconcile", "Oauth", "OAUTH EnsureRealm", "Build"} {
+		if spans[name] == nil {
+			t.Fatalf("span %s not ended, ended spans: %v", name, spans)
+		}
+	}
+
+	reconcile := spans["Reconcile"]
+	if got := spans["Oauth"].Parent().SpanID(); got != reconcile.SpanContext().SpanID() {
+		t.Errorf("parent of stage Oauth = %v, want the reconcile", got)
+	}
+	if got := spans["OAUTH EnsureRealm"].Parent().SpanID(); got != spans["Oauth"].SpanContext().SpanID() {
+		t.Errorf("parent of the OAUTH call = %v, want stage Oauth", got)
+	}
+	if spans["Oauth"].EndTime().After(spans["Build"].StartTime()) {
+		t.Errorf("stage Oauth ended after stage Build started")
+	}
+
+	links := reconcile.Links()
+	if len(links) != 1 || links[0].SpanContext.TraceID().String() != "6ba7b8109dad11d180b400c04fd430c8" {
+		t.Errorf("links of the reconcile = %v, want the trace id of the UID", links)
+	}
+
+	for _, name := range []string{"Reconcile", "Build"} {
+		if spans[name].Status().Code != codes.Error {
+			t.Errorf("status of span %s = %v, want error", name, spans[name].Status())
+		}
+	}
+	if spans["Oauth"].Status().Code == codes.Error {
+		t.Errorf("stage Oauth has the error of stage Build")
+	}
+}
@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"fmt"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// traefikMiddlewaresAnnotation attaches Middlewares to the router of an Ingress
+	traefikMiddlewaresAnnotation = "traefik.ingress.kubernetes.io/router.middlewares"
+)
+
+// middlewareKind is served by Traefik since 2.10, the client-go of the operator does not know it
+var middlewareKind = schema.GroupVersionKind{Group: "traefik.io", Version: "v1alpha1", Kind: "Middleware"}
+
+// traefikBackend lets Traefik forward every request to oauth2-proxy for approval, those of the terminal to
+// its terminal container. The Ingresses of IDE and terminal and their Middlewares live in the DevEnv namespace
+// and route to the ClusterIP Service of the IDE, Traefik rejects ExternalName Services by default.
+type traefikBackend struct{ *devEnvConfig }
+
+func (b traefikBackend) proxyMode() proxyMode { return proxyModeApprove }
+
+func (b traefikBackend) kinds() []schema.GroupVersionKind {
+	return []schema.GroupVersionKind{middlewareKind}
+}
+
+func (b traefikBackend) objects(cr *cndev1alpha1.DevEnv) []runtime.Object {
+	auth := b.middlewareForDevEnv(cr, b.resourceName+"-auth", proxyPort)
+	terminalAuth := b.middlewareForDevEnv(cr, b.resourceName+"-terminal-auth", proxyTerminalPort)
+	return []runtime.Object{
+		auth,
+		terminalAuth,
+		b.ingressUIForDevEnv(cr, b.DevEnvNamespace, b.resourceName, idePort, traefikAnnotations(auth)),
+		b.ingressTerminalForDevEnv(cr, b.DevEnvNamespace, b.resourceName, ttydPort, traefikAnnotations(terminalAuth)),
+		b.ingressOauthForDevEnv(cr),
+	}
+}
+
+// middlewareForDevEnv forwards requests to the port of oauth2-proxy, which answers 202 if it admits them and
+// redirects to the sign in otherwise. The cookie it refreshes is passed on to the browser.
+func (r *devEnvConfig) middlewareForDevEnv(cr *cndev1alpha1.DevEnv, name string, port int) *unstructured.Unstructured {
+	mw := newUnstructured(middlewareKind)
+	mw.Object["spec"] = map[string]interface{}{
+		"forwardAuth": map[string]interface{}{
+			"address":             fmt.Sprintf("http://%s.%s.svc.%s:%d/", r.proxyPodName, r.ManagerNamespace, r.clusterDomain, port),
+			"trustForwardHeader":  true,
+			"authResponseHeaders": []interface{}{"X-Auth-Request-User", "X-Auth-Request-Email", "Set-Cookie"},
+		},
+	}
+	mw.SetName(name)
+	mw.SetNamespace(r.DevEnvNamespace)
+	mw.SetLabels(labelsForDevEnv(cr.Name))
+
+	controllerutil.SetControllerReference(cr, mw, r.scheme)
+	return mw
+}
+
+// traefikAnnotations attach the Middleware to the Ingress
+func traefikAnnotations(mw *unstructured.Unstructured) map[string]string {
+	return map[string]string{traefikMiddlewaresAnnotation: mw.GetNamespace() + "-" + mw.GetName() + "@kubernetescrd"}
+}
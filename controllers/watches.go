@@ -0,0 +1,21 @@
+package controllers
+
+import (
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// enqueueDevEnvForLabels enqueues the DevEnv an object is labelled with. Owner references do not enqueue
+// reliably for objects in the DevEnv and the manager namespace, labels are set on all objects of a DevEnv.
+var enqueueDevEnvForLabels = &handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(devEnvRequestForLabels)}
+
+// devEnvRequestForLabels maps an object created by the operator to the request of its DevEnv
+func devEnvRequestForLabels(o handler.MapObject) []reconcile.Request {
+	l := labels.Set(o.Meta.GetLabels())
+	if !selectorForDevEnv("").Matches(l) {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: l[userenvnameLabel]}}}
+}
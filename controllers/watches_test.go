@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+func TestDevEnvRequestForLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{"labelled", labelsForDevEnv("thedeep"), "thedeep"},
+		{"oauth2-proxy", map[string]string{userenvnameLabel: "thedeep", "app": "oauth2-proxy"}, "thedeep"},
+		{"other app", map[string]string{userenvnameLabel: "thedeep", "app": "other"}, ""},
+		{"unlabelled", nil, ""},
+	}
+	for _, tt := range tests {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "cnde-thedeep", Labels: tt.labels}}
+		reqs := devEnvRequestForLabels(handler.MapObject{Meta: pod, Object: pod})
+		if tt.want == "" {
+			if len(reqs) != 0 {
+				t.Errorf("%s: got requests %v, want none", tt.name, reqs)
+			}
+			continue
+		}
+		if len(reqs) != 1 || reqs[0].Name != tt.want || reqs[0].Namespace != "" {
+			t.Errorf("%s: got requests %v, want DevEnv %s", tt.name, reqs, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// reconcileDevEnvWorkload creates the StatefulSet of the IDE. The Pod of former versions is deleted first,
+// it uses the same volumes.
+func (r *DevEnvReconciler) reconcileDevEnvWorkload(ctx context.Context, devenv *cndev1alpha1.DevEnv) (ctrl.Result, error) {
+	exists, err := r.deleteLegacyPod(ctx, devenv, r.resourceName, r.DevEnvNamespace)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if exists {
+		return ctrl.Result{RequeueAfter: 2 * time.Second}, nil
+	}
+
+	found := &appsv1.StatefulSet{}
+	err = r.Get(ctx, types.NamespacedName{Name: r.resourceName, Namespace: r.DevEnvNamespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		sts := r.statefulSetForDevEnv(devenv)
+		r.Log.Info("Creating a new DevEnv StatefulSet.", "StatefulSet.Namespace", sts.Namespace, "StatefulSet.Name", sts.Name)
+		err = r.Create(ctx, sts)
+		r.recordCreate(devenv, "StatefulSet", objectName(sts.Namespace, sts.Name), err)
+		if err != nil {
+			r.Log.Error(err, "Failed to create new DevEnv StatefulSet.", "StatefulSet.Namespace", sts.Namespace, "StatefulSet.Name", sts.Name)
+			return ctrl.Result{}, err
+		}
+	} else if err != nil {
+		r.Log.Error(err, "Failed to get DevEnv StatefulSet.")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// reconcileDevEnvServices creates the Service of the IDE in the DevEnv namespace and the Service the Ingresses
+// use in the manager namespace. The latter replaces the Service of former versions, whose Endpoints were
+// copied from the IP of the DevEnv Pod. Kubernetes deletes these Endpoints with their Service.
+func (r *DevEnvReconciler) reconcileDevEnvServices(ctx context.Context, devenv *cndev1alpha1.DevEnv) error {
+	ideService := &corev1.Service{}
+	err := r.Get(ctx, types.NamespacedName{Name: r.resourceName, Namespace: r.DevEnvNamespace}, ideService)
+	if err != nil && errors.IsNotFound(err) {
+		ser := r.serviceForDevEnv(devenv)
+		r.Log.Info("Creating a new IDE Service.", "Service.Namespace", ser.Namespace, "Service.Name", ser.Name)
+		err = r.Create(ctx, ser)
+		r.recordCreate(devenv, "Service", objectName(ser.Namespace, ser.Name), err)
+		if err != nil {
+			r.Log.Error(err, "Failed to create new IDE Service.", "Service.Namespace", ser.Namespace, "Service.Name", ser.Name)
+			return err
+		}
+	} else if err != nil {
+		r.Log.Error(err, "Failed to get IDE Service.")
+		return err
+	}
+
+	proxyService := &corev1.Service{}
+	err = r.Get(ctx, types.NamespacedName{Name: r.resourceName, Namespace: r.ManagerNamespace}, proxyService)
+	if err == nil && proxyService.Spec.Type != corev1.ServiceTypeExternalName {
+		r.Log.Info("Replacing Proxy Service of a former version.", "Service.Namespace", proxyService.Namespace, "Service.Name", proxyService.Name)
+		if err = r.Delete(ctx, proxyService); err != nil && !errors.IsNotFound(err) {
+			r.Log.Error(err, "Failed to delete Proxy Service.")
+			return err
+		}
+		err = errors.NewNotFound(corev1.Resource("services"), proxyService.Name)
+	}
+	if err != nil && errors.IsNotFound(err) {
+		ser := r.serviceProxyForDevEnv(devenv)
+		r.Log.Info("Creating a new Proxy Service.", "Service.Namespace", ser.Namespace, "Service.Name", ser.Name)
+		err = r.Create(ctx, ser)
+		r.recordCreate(devenv, "Service", objectName(ser.Namespace, ser.Name), err)
+		if err != nil {
+			r.Log.Error(err, "Failed to create new Service.", "Service.Namespace", ser.Namespace, "Service.Name", ser.Name)
+			return err
+		}
+	} else if err != nil {
+		r.Log.Error(err, "Failed to get Service.")
+		return err
+	}
+	return nil
+}
+
+// deleteLegacyPod deletes a Pod of former versions, which ran the IDE and oauth2-proxy as bare Pods.
+// It reports whether the Pod still exists, e.g. because it is terminating.
+func (r *DevEnvReconciler) deleteLegacyPod(ctx context.Context, devenv *cndev1alpha1.DevEnv, name, namespace string) (bool, error) {
+	pod := &corev1.Pod{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, pod)
+	if errors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		r.Log.Error(err, "Failed to get Pod of a former version.")
+		return false, err
+	}
+	if pod.DeletionTimestamp == nil {
+		r.Log.Info("Deleting Pod of a former version, a workload controller replaces it.", "Pod.Namespace", namespace, "Pod.Name", name)
+		if err = r.Delete(ctx, pod); err != nil && !errors.IsNotFound(err) {
+			r.Log.Error(err, "Failed to delete Pod of a former version.")
+			r.eventf(devenv, corev1.EventTypeWarning, reasonDeleteFailed, "Failed to delete Pod %s of a former version: %v", objectName(namespace, name), err)
+			return true, err
+		}
+	}
+	return true, nil
+}
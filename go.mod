@@ -5,11 +5,20 @@ go 1.13
 require (
 	github.com/Nerzal/gocloak/v7 v7.5.0
 	github.com/go-logr/logr v0.1.0
+	github.com/go-resty/resty/v2 v2.3.0
+	github.com/google/uuid v1.1.2
 	github.com/onsi/ginkgo v1.14.0
 	github.com/onsi/gomega v1.10.1
+	github.com/prometheus/client_golang v1.0.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
 	k8s.io/api v0.17.8
 	k8s.io/apimachinery v0.17.8
 	k8s.io/client-go v0.17.8
 	sigs.k8s.io/controller-runtime v0.5.9
 	sigs.k8s.io/structured-merge-diff v0.0.0-20190525122527-15d366b2352e // indirect
+	sigs.k8s.io/yaml v1.1.0
 )
@@ -16,12 +16,19 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"time"
 
 	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
 	"cnde-operator.cloud-native-coding.dev/controllers"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	_ "cnde-operator.cloud-native-coding.dev/oauth/dex"
+	_ "cnde-operator.cloud-native-coding.dev/oauth/keycloak"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/discovery"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -42,6 +49,14 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		if err := render(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
@@ -53,6 +68,89 @@ func main() {
 		o.Development = true
 	}))
 
+	oauthProviderName, exists := os.LookupEnv("CNDE_OAUTH_PROVIDERNAME")
+	if !exists {
+		oauthProviderName = "keycloak"
+	}
+	if !oauth.IsRegistered(oauthProviderName) {
+		setupLog.Error(fmt.Errorf("unknown OAUTH provider %q", oauthProviderName), "unable to start manager",
+			"registered providers", oauth.Providers())
+		os.Exit(1)
+	}
+
+	if realmMode := os.Getenv("CNDE_OAUTH_REALM_MODE"); realmMode == oauth.RealmModeShared {
+		if os.Getenv("CNDE_OAUTH_SHARED_REALM") == "" {
+			setupLog.Error(fmt.Errorf("CNDE_OAUTH_SHARED_REALM unset"), "unable to start manager", "realm mode", realmMode)
+			os.Exit(1)
+		}
+	} else if realmMode != "" && realmMode != oauth.RealmModePerDevEnv {
+		setupLog.Error(fmt.Errorf("unknown realm mode %q", realmMode), "unable to start manager")
+		os.Exit(1)
+	}
+
+	if driftPolicy := os.Getenv("CNDE_OAUTH_DRIFT_POLICY"); driftPolicy != "" && driftPolicy != "repair" && driftPolicy != "report" {
+		setupLog.Error(fmt.Errorf("unknown drift policy %q", driftPolicy), "unable to start manager")
+		os.Exit(1)
+	}
+
+	exposure, err := controllers.ParseExposure(os.Getenv("CNDE_EXPOSURE"))
+	if err != nil {
+		setupLog.Error(err, "unable to start manager")
+		os.Exit(1)
+	}
+	ingressAuth, err := controllers.ParseIngressAuth(os.Getenv("CNDE_INGRESS_AUTH"))
+	if err != nil {
+		setupLog.Error(err, "unable to start manager")
+		os.Exit(1)
+	}
+	if exposure == controllers.ExposureGateway {
+		if os.Getenv("CNDE_GATEWAY") == "" {
+			setupLog.Error(fmt.Errorf("CNDE_GATEWAY unset"), "unable to start manager", "exposure", exposure)
+			os.Exit(1)
+		}
+		gatewayAuth, err := controllers.ParseGatewayAuth(os.Getenv("CNDE_GATEWAY_AUTH"))
+		if err != nil {
+			setupLog.Error(err, "unable to start manager")
+			os.Exit(1)
+		}
+		if gatewayAuth == controllers.GatewayAuthExternal {
+			setupLog.Info("CNDE_GATEWAY_AUTH=external-auth needs the experimental CRDs of the Gateway API, see condition RouteAccepted of the DevEnvs")
+		}
+	}
+
+	if _, _, err := controllers.TLSIssuerFromEnv(); err != nil {
+		setupLog.Error(err, "unable to start manager")
+		os.Exit(1)
+	}
+
+	var federation *oauth.FederationConfig
+	if federationFile, exists := os.LookupEnv("CNDE_OAUTH_FEDERATION_FILE"); exists {
+		if federation, err = oauth.LoadFederationConfig(federationFile); err != nil {
+			setupLog.Error(err, "unable to load federation config")
+			os.Exit(1)
+		}
+		if oauthProviderName != "keycloak" && !federation.IsEmpty() {
+			setupLog.Info("federation config is ignored, the OAUTH provider configures its connectors itself", "Oauth Provider", oauthProviderName)
+		}
+	}
+
+	realmPolicy := oauth.DefaultRealmPolicy()
+	if policyFile, exists := os.LookupEnv("CNDE_OAUTH_REALM_POLICY_FILE"); exists {
+		if realmPolicy, err = oauth.LoadRealmPolicy(policyFile); err != nil {
+			setupLog.Error(err, "unable to load realm policy")
+			os.Exit(1)
+		}
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		os.Exit(1)
+	}
+	if shutdownTracing != nil {
+		setupLog.Info("exporting traces by OTLP")
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
@@ -65,16 +163,90 @@ func main() {
 		os.Exit(1)
 	}
 
+	dc, err := discovery.NewDiscoveryClientForConfig(mgr.GetConfig())
+	if err != nil {
+		setupLog.Error(err, "unable to create discovery client")
+		os.Exit(1)
+	}
+	ingressAPI, err := controllers.DiscoverIngressAPI(dc)
+	if err != nil {
+		setupLog.Error(err, "unable to discover the Ingress API")
+		os.Exit(1)
+	}
+	setupLog.Info("exposing DevEnvs", "exposure", exposure, "Ingress API", ingressAPI, "Ingress auth", ingressAuth)
+
 	if err = (&controllers.DevEnvReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("DevEnv"),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("DevEnv"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("devenv-controller"),
+
+		Federation:  federation,
+		RealmPolicy: realmPolicy,
+		IngressAPI:  ingressAPI,
+		Exposure:    exposure,
+		IngressAuth: ingressAuth,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DevEnv")
 		os.Exit(1)
 	}
 
-	setupLog.Info("starting manager with the following settings:",
+	if interval, exists := os.LookupEnv("CNDE_OAUTH_ORPHAN_SCAN_INTERVAL"); exists {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			setupLog.Error(fmt.Errorf("invalid CNDE_OAUTH_ORPHAN_SCAN_INTERVAL %q", interval), "unable to start manager")
+			os.Exit(1)
+		}
+		// the scanner runs concurrently to reconciles, so it gets a reconciler of its own
+		scanner := &controllers.OauthOrphanScanner{
+			Reconciler: &controllers.DevEnvReconciler{
+				Client:      mgr.GetClient(),
+				Log:         ctrl.Log.WithName("controllers").WithName("OauthOrphanScanner"),
+				Scheme:      mgr.GetScheme(),
+				Federation:  federation,
+				RealmPolicy: realmPolicy,
+			},
+			Interval: d,
+		}
+		if err = mgr.Add(scanner); err != nil {
+			setupLog.Error(err, "unable to add OAUTH orphan scanner")
+			os.Exit(1)
+		}
+	}
+
+	if interval, exists := os.LookupEnv("CNDE_ORPHAN_GC_INTERVAL"); exists {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			setupLog.Error(fmt.Errorf("invalid CNDE_ORPHAN_GC_INTERVAL %q", interval), "unable to start manager")
+			os.Exit(1)
+		}
+		policy, err := controllers.ParseOrphanPolicy(os.Getenv("CNDE_ORPHAN_GC_POLICY"))
+		if err != nil {
+			setupLog.Error(err, "unable to start manager")
+			os.Exit(1)
+		}
+		collector := &controllers.OrphanCollector{
+			Reconciler: &controllers.DevEnvReconciler{
+				Client:      mgr.GetClient(),
+				Log:         ctrl.Log.WithName("controllers").WithName("OrphanCollector"),
+				Scheme:      mgr.GetScheme(),
+				IngressAPI:  ingressAPI,
+				Exposure:    exposure,
+				IngressAuth: ingressAuth,
+			},
+			Reader:   mgr.GetAPIReader(),
+			Interval: d,
+			Policy:   policy,
+		}
+		if err = mgr.Add(collector); err != nil {
+			setupLog.Error(err, "unable to add orphan collector")
+			os.Exit(1)
+		}
+		setupLog.Info("collecting orphaned objects", "interval", d, "policy", policy)
+	}
+
+	setupLog.Info("starting manager with the following settings:", "Oauth Provider", oauthProviderName,
+		"Oauth Realm Mode", os.Getenv("CNDE_OAUTH_REALM_MODE"), "Oauth Shared Realm", os.Getenv("CNDE_OAUTH_SHARED_REALM"),
 		"Oauth Admin Name", os.Getenv("CNDE_OAUTH_ADMIN_NAME"), "Oauth Admin Realm", os.Getenv("CNDE_OAUTH_ADMIN_REALM"),
 		"Oauth URL", os.Getenv("CNDE_OAUTH_URL"), "Manager Namespace", os.Getenv("CNDE_MANAGER_NAMESPACE"))
 
@@ -84,16 +256,16 @@ func main() {
 		setupLog.Info("CNDE_OAUTH_ADMIN_PASSWORD unset, but should be provided")
 	}
 
-	if _, b := os.LookupEnv("CNDE_OAUTH_INITIAL_PW"); b {
-		setupLog.Info("CNDE_OAUTH_INITIAL_PW is set")
-	} else {
-		setupLog.Info("CNDE_OAUTH_INITIAL_PW unset, but should be provided")
-	}
-
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	err = mgr.Start(ctrl.SetupSignalHandler())
+	if shutdownTracing != nil {
+		if err := shutdownTracing(context.Background()); err != nil {
+			setupLog.Error(err, "unable to flush traces")
+		}
+	}
+	if err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
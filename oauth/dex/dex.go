@@ -0,0 +1,383 @@
+package dex
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"hash/fnv"
+	"reflect"
+	"strings"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"github.com/go-logr/logr"
+	"golang.org/x/crypto/bcrypt"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Dex (https://dexidp.io) configured with the Kubernetes storage keeps its static
+// clients and passwords as custom resources. This provider manages these resources,
+// so it works with any Dex instance sharing the cluster with the operator.
+
+// +kubebuilder:rbac:groups=dex.coreos.com,resources=oauth2clients;passwords,verbs=get;list;watch;create;update;patch;delete
+
+var (
+	oauth2ClientGVK = schema.GroupVersionKind{Group: "dex.coreos.com", Version: "v1", Kind: "OAuth2Client"}
+	passwordGVK     = schema.GroupVersionKind{Group: "dex.coreos.com", Version: "v1", Kind: "Password"}
+
+	// encoding used by Dex for deriving resource names from ids
+	encoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567")
+)
+
+//OAUTHProvider data for Dex
+type OAUTHProvider struct {
+	oauth.BaseOAUTHProvider
+	log       logr.Logger
+	client    client.Client
+	namespace string
+	issuerURL string
+
+	devEnvName   string
+	resourceName string
+	ingressHost  string
+}
+
+func init() {
+	oauth.Register("dex", func(config *oauth.OAUTHProviderConfig) (oauth.OAUTHProvider, error) {
+		return NewDexOAUTHProvider(config), nil
+	})
+}
+
+//NewDexOAUTHProvider creates a new OAUTH Provider with Dex
+func NewDexOAUTHProvider(config *oauth.OAUTHProviderConfig) *OAUTHProvider {
+	p := &OAUTHProvider{
+		log:       config.Log,
+		client:    config.Client,
+		namespace: config.Namespace,
+		issuerURL: config.OauthIssuerURL,
+
+		ingressHost:  config.IngressHost,
+		devEnvName:   config.DevEnvName,
+		resourceName: config.ResourceName,
+	}
+	return p
+}
+
+// idToName mirrors the way Dex derives resource names from ids
+func idToName(s string) string {
+	return strings.TrimRight(encoding.EncodeToString(fnv.New64().Sum([]byte(s))), "=")
+}
+
+//ClientID returns the id of the static client of the DevEnv. Dex has no realms, so every DevEnv needs its own one
+func (r *OAUTHProvider) ClientID() string {
+	return r.resourceName
+}
+
+//IssuerURL returns the configured issuer of Dex
+func (r *OAUTHProvider) IssuerURL(cr *cndev1alpha1.DevEnv) string {
+	return r.issuerURL
+}
+
+//AllowedGroups returns no groups, Dex passwords have no group membership
+func (r *OAUTHProvider) AllowedGroups(cr *cndev1alpha1.DevEnv) []string {
+	return nil
+}
+
+//EnsureRealm does nothing but returning the name of the DevEnv, because Dex has only one issuer
+func (r *OAUTHProvider) EnsureRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	return r.resourceName, nil
+}
+
+//GetRealm does nothing but returning the name of the DevEnv, because Dex has only one issuer
+func (r *OAUTHProvider) GetRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	return r.resourceName, nil
+}
+
+//DeleteRealm does nothing, because Dex has only one issuer
+func (r *OAUTHProvider) DeleteRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) error {
+	return nil
+}
+
+//DeleteClient deletes the static client of the DevEnv
+func (r *OAUTHProvider) DeleteClient(ctx context.Context, cr *cndev1alpha1.DevEnv) error {
+	return r.deleteObject(ctx, oauth2ClientGVK, idToName(r.ClientID()))
+}
+
+//DeleteUser deletes the passwords of the owner and the collaborators, unless other DevEnvs use their emails
+func (r *OAUTHProvider) DeleteUser(ctx context.Context, cr *cndev1alpha1.DevEnv) error {
+	used, err := r.emailsInUse(ctx, cr.Name)
+	if err != nil {
+		return err
+	}
+
+	emails := []string{cr.Spec.UserEmail}
+	for _, c := range cr.Spec.Collaborators {
+		emails = append(emails, c.Email)
+	}
+	for _, email := range emails {
+		email = strings.ToLower(email)
+		if used[email] {
+			continue
+		}
+		if err = r.deleteObject(ctx, passwordGVK, idToName(email)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emailsInUse returns the emails of owners and collaborators of all DevEnvs but the given one
+func (r *OAUTHProvider) emailsInUse(ctx context.Context, except string) (map[string]bool, error) {
+	devenvs := &cndev1alpha1.DevEnvList{}
+	if err := r.client.List(ctx, devenvs); err != nil {
+		r.log.Error(err, "Failed to list DevEnvs.")
+		return nil, err
+	}
+
+	used := map[string]bool{}
+	for _, d := range devenvs.Items {
+		if d.Name == except {
+			continue
+		}
+		used[strings.ToLower(d.Spec.UserEmail)] = true
+		for _, c := range d.Spec.Collaborators {
+			used[strings.ToLower(c.Email)] = true
+		}
+	}
+	return used, nil
+}
+
+//ListTagged returns the static clients and passwords labelled with the name of a DevEnv
+func (r *OAUTHProvider) ListTagged(ctx context.Context) ([]oauth.TaggedObject, error) {
+	var tagged []oauth.TaggedObject
+	for _, gvk := range []schema.GroupVersionKind{oauth2ClientGVK, passwordGVK} {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		err := r.client.List(ctx, list, client.InNamespace(r.namespace), client.HasLabels{oauth.DevEnvTag})
+		if err != nil {
+			r.log.Error(err, "Failed to list tagged objects.", "Kind", gvk.Kind)
+			return nil, err
+		}
+		for _, item := range list.Items {
+			obj := oauth.TaggedObject{Kind: gvk.Kind, Name: item.GetName(), ID: item.GetName(), DevEnv: item.GetLabels()[oauth.DevEnvTag]}
+			obj.Email, _, _ = unstructured.NestedString(item.Object, "email")
+			tagged = append(tagged, obj)
+		}
+	}
+	return tagged, nil
+}
+
+//DeleteTagged deletes a static client or password returned by ListTagged
+func (r *OAUTHProvider) DeleteTagged(ctx context.Context, obj oauth.TaggedObject) error {
+	gvk := oauth2ClientGVK
+	if obj.Kind == passwordGVK.Kind {
+		gvk = passwordGVK
+	}
+	return r.deleteObject(ctx, gvk, obj.ID)
+}
+
+func (r *OAUTHProvider) deleteObject(ctx context.Context, gvk schema.GroupVersionKind, name string) error {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(gvk)
+	u.SetName(name)
+	u.SetNamespace(r.namespace)
+
+	err := r.client.Delete(ctx, u)
+	if err != nil && !errors.IsNotFound(err) {
+		r.log.Error(err, "Failed to delete "+gvk.Kind+".", "Dex.Namespace", r.namespace, "Name", name)
+		return err
+	}
+	return nil
+}
+
+//EnsureUser creates a static password for the email of the DevEnv, if there is none yet
+func (r *OAUTHProvider) EnsureUser(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc) (string, error) {
+	return r.reconcileUser(ctx, cr, password, true)
+}
+
+//GetUser verifies there is a static password for the email of the DevEnv
+func (r *OAUTHProvider) GetUser(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	return r.reconcileUser(ctx, cr, nil, false)
+}
+
+//ResetPassword replaces the hash of the static password. Dex has no temporary passwords, the user keeps it until it is reset again
+func (r *OAUTHProvider) ResetPassword(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc) error {
+	reqLogger := r.log.WithValues("Dex.Namespace", r.namespace)
+	email := strings.ToLower(cr.Spec.UserEmail)
+
+	p := &unstructured.Unstructured{}
+	p.SetGroupVersionKind(passwordGVK)
+	err := r.client.Get(ctx, types.NamespacedName{Name: idToName(email), Namespace: r.namespace}, p)
+	if err != nil {
+		reqLogger.Error(err, "Failed to get Password.")
+		return err
+	}
+
+	pw, err := password(ctx, email)
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	p.Object["hash"] = base64.StdEncoding.EncodeToString(hash)
+
+	err = r.client.Update(ctx, p)
+	if err != nil {
+		reqLogger.Error(err, "Failed to update Password.")
+	}
+	return err
+}
+
+func (r *OAUTHProvider) reconcileUser(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc, repair bool) (string, error) {
+	return r.reconcilePassword(ctx, cr.Spec.UserEmail, cr.Name, password, repair)
+}
+
+//EnsureCollaborators creates static passwords for the emails of the collaborators, if there are none yet.
+//Passwords of former collaborators are kept, they are keyed by email and may be used by other DevEnvs
+func (r *OAUTHProvider) EnsureCollaborators(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc) error {
+	for _, c := range cr.Spec.Collaborators {
+		if _, err := r.reconcilePassword(ctx, c.Email, c.Email, password, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcilePassword verifies there is a static password for the email, creates it if repair is set
+func (r *OAUTHProvider) reconcilePassword(ctx context.Context, email, username string, password oauth.PasswordFunc, repair bool) (string, error) {
+	reqLogger := r.log.WithValues("Dex.Namespace", r.namespace)
+	email = strings.ToLower(email)
+	name := idToName(email)
+
+	p := &unstructured.Unstructured{}
+	p.SetGroupVersionKind(passwordGVK)
+	err := r.client.Get(ctx, types.NamespacedName{Name: name, Namespace: r.namespace}, p)
+	if err == nil {
+		userID, _, _ := unstructured.NestedString(p.Object, "userID")
+		return userID, nil
+	} else if !errors.IsNotFound(err) {
+		reqLogger.Error(err, "Failed to get Password.")
+		return "", err
+	}
+	if !repair {
+		return "", &oauth.NotFoundError{Kind: "Password", Name: email}
+	}
+
+	pw, err := password(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	p.SetName(name)
+	p.SetNamespace(r.namespace)
+	p.SetLabels(map[string]string{oauth.DevEnvTag: r.devEnvName})
+	p.Object["email"] = email
+	p.Object["hash"] = base64.StdEncoding.EncodeToString(hash)
+	p.Object["username"] = username
+	p.Object["userID"] = name
+
+	err = r.client.Create(ctx, p)
+	if err != nil {
+		reqLogger.Error(err, "Failed to create Password.")
+		return "", err
+	}
+	return name, nil
+}
+
+//EnsureClient creates the static client of the DevEnv or repairs its redirect URIs and returns its secret
+func (r *OAUTHProvider) EnsureClient(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	return r.reconcileClient(ctx, true)
+}
+
+//GetClient verifies the static client of the DevEnv and returns its secret
+func (r *OAUTHProvider) GetClient(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	return r.reconcileClient(ctx, false)
+}
+
+func (r *OAUTHProvider) reconcileClient(ctx context.Context, repair bool) (string, error) {
+	reqLogger := r.log.WithValues("Dex.Namespace", r.namespace)
+	name := idToName(r.ClientID())
+	redirectURIs := []interface{}{"https://" + r.ingressHost + "/oauth2/callback"}
+
+	c := &unstructured.Unstructured{}
+	c.SetGroupVersionKind(oauth2ClientGVK)
+	err := r.client.Get(ctx, types.NamespacedName{Name: name, Namespace: r.namespace}, c)
+	if err == nil {
+		secret, _, _ := unstructured.NestedString(c.Object, "secret")
+		if reflect.DeepEqual(c.Object["redirectURIs"], redirectURIs) {
+			return secret, nil
+		}
+		if !repair {
+			return "", &oauth.DriftError{Kind: "OAuth2Client", Name: r.ClientID(), Field: "redirectURIs"}
+		}
+		reqLogger.Info("Repairing drifted OAuth2Client.", "OAuth2Client", r.ClientID())
+		c.Object["redirectURIs"] = redirectURIs
+		if err = r.client.Update(ctx, c); err != nil {
+			reqLogger.Error(err, "Failed to update OAuth2Client.")
+			return "", err
+		}
+		return secret, nil
+	} else if !errors.IsNotFound(err) {
+		reqLogger.Error(err, "Failed to get OAuth2Client.")
+		return "", err
+	}
+	if !repair {
+		return "", &oauth.NotFoundError{Kind: "OAuth2Client", Name: r.ClientID()}
+	}
+
+	secret, err := oauth.GenerateSecret(32)
+	if err != nil {
+		return "", err
+	}
+
+	c.SetName(name)
+	c.SetNamespace(r.namespace)
+	c.SetLabels(map[string]string{oauth.DevEnvTag: r.devEnvName})
+	c.Object["id"] = r.ClientID()
+	c.Object["name"] = r.ClientID()
+	c.Object["secret"] = secret
+	c.Object["redirectURIs"] = redirectURIs
+
+	err = r.client.Create(ctx, c)
+	if err != nil {
+		reqLogger.Error(err, "Failed to create OAuth2Client.")
+		return "", err
+	}
+	return secret, nil
+}
+
+//RotateClientSecret generates a new secret for the static client of the DevEnv
+func (r *OAUTHProvider) RotateClientSecret(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	reqLogger := r.log.WithValues("Dex.Namespace", r.namespace)
+
+	c := &unstructured.Unstructured{}
+	c.SetGroupVersionKind(oauth2ClientGVK)
+	err := r.client.Get(ctx, types.NamespacedName{Name: idToName(r.ClientID()), Namespace: r.namespace}, c)
+	if errors.IsNotFound(err) {
+		return "", &oauth.NotFoundError{Kind: "OAuth2Client", Name: r.ClientID()}
+	} else if err != nil {
+		reqLogger.Error(err, "Failed to get OAuth2Client.")
+		return "", err
+	}
+
+	secret, err := oauth.GenerateSecret(32)
+	if err != nil {
+		return "", err
+	}
+	c.Object["secret"] = secret
+	if err = r.client.Update(ctx, c); err != nil {
+		reqLogger.Error(err, "Failed to update OAuth2Client.")
+		return "", err
+	}
+	return secret, nil
+}
@@ -0,0 +1,203 @@
+package dex
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"golang.org/x/crypto/bcrypt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const testNamespace = "dex"
+
+func newTestClient(t *testing.T, objs ...runtime.Object) client.Client {
+	scheme := runtime.NewScheme()
+	if err := cndev1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	for _, gvk := range []schema.GroupVersionKind{oauth2ClientGVK, passwordGVK} {
+		scheme.AddKnownTypeWithName(gvk, &unstructured.Unstructured{})
+		scheme.AddKnownTypeWithName(gvk.GroupVersion().WithKind(gvk.Kind+"List"), &unstructured.UnstructuredList{})
+	}
+	return fakeclient.NewFakeClientWithScheme(scheme, objs...)
+}
+
+func newTestProvider(c client.Client, devenv string) *OAUTHProvider {
+	return NewDexOAUTHProvider(&oauth.OAUTHProviderConfig{
+		Log:            logf.NullLogger{},
+		OauthIssuerURL: "https://dex.example.com",
+		Client:         c,
+		Namespace:      testNamespace,
+		DevEnvName:     devenv,
+		ResourceName:   "cnde-" + devenv,
+		IngressHost:    devenv + ".example.com",
+	})
+}
+
+func newTestDevEnv(name, email string, collaborators ...string) *cndev1alpha1.DevEnv {
+	cr := &cndev1alpha1.DevEnv{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       cndev1alpha1.DevEnvSpec{UserEmail: email, UserEnvDomain: "example.com"},
+	}
+	for _, c := range collaborators {
+		cr.Spec.Collaborators = append(cr.Spec.Collaborators, cndev1alpha1.Collaborator{Email: c, Role: cndev1alpha1.CollaboratorRoleEditor})
+	}
+	return cr
+}
+
+func testPassword(ctx context.Context, username string) (string, error) {
+	return "pw-" + username, nil
+}
+
+func getObject(t *testing.T, c client.Client, gvk schema.GroupVersionKind, name string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(gvk)
+	if err := c.Get(context.Background(), types.NamespacedName{Name: name, Namespace: testNamespace}, u); err != nil {
+		t.Fatalf("get %s %s: %v", gvk.Kind, name, err)
+	}
+	return u
+}
+
+func TestIDToName(t *testing.T) {
+	// Dex appends the FNV-64 hash of nothing to the id instead of hashing it, the names are those
+	// Dex computes for the resources of its Kubernetes storage
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"admin@example.com", "mfsg22loibsxqylnobwgkltdn5w4x4u44scceizf"},
+		{"arthur@example.com", "mfzhi2dvojagk6dbnvygyzjomnxw3s7sttsiiirdeu"},
+		{"cnde-thedeep", "mnxgizjnorugkzdfmvymx4u44scceizf"},
+	}
+	for _, tt := range tests {
+		if got := idToName(tt.id); got != tt.want {
+			t.Errorf("idToName(%q) = %s, want %s", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestReconcileClient(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+	p := newTestProvider(c, "thedeep")
+	cr := newTestDevEnv("thedeep", "arthur@example.com")
+
+	if _, err := p.GetClient(ctx, cr); !oauth.IsNotFound(err) {
+		t.Fatalf("GetClient of a missing client = %v, want NotFoundError", err)
+	}
+	secret, err := p.EnsureClient(ctx, cr)
+	if err != nil || secret == "" {
+		t.Fatalf("EnsureClient = %q, %v, want the secret", secret, err)
+	}
+	obj := getObject(t, c, oauth2ClientGVK, "mnxgizjnorugkzdfmvymx4u44scceizf")
+	if id, _, _ := unstructured.NestedString(obj.Object, "id"); id != "cnde-thedeep" {
+		t.Errorf("client id = %s, want cnde-thedeep", id)
+	}
+	if obj.GetLabels()[oauth.DevEnvTag] != "thedeep" {
+		t.Errorf("client labels = %v, want tag of DevEnv thedeep", obj.GetLabels())
+	}
+
+	// drift of the redirect URIs is reported by GetClient and repaired by EnsureClient
+	obj.Object["redirectURIs"] = []interface{}{"https://evil.example.com/oauth2/callback"}
+	if err = c.Update(ctx, obj); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.GetClient(ctx, cr); !oauth.IsDrift(err) {
+		t.Fatalf("GetClient of a drifted client = %v, want DriftError", err)
+	}
+	repaired, err := p.EnsureClient(ctx, cr)
+	if err != nil || repaired != secret {
+		t.Fatalf("EnsureClient of a drifted client = %q, %v, want the secret %q", repaired, err, secret)
+	}
+	obj = getObject(t, c, oauth2ClientGVK, "mnxgizjnorugkzdfmvymx4u44scceizf")
+	uris, _, _ := unstructured.NestedStringSlice(obj.Object, "redirectURIs")
+	if len(uris) != 1 || uris[0] != "https://thedeep.example.com/oauth2/callback" {
+		t.Errorf("redirect URIs after repair = %v", uris)
+	}
+	if got, err := p.GetClient(ctx, cr); err != nil || got != secret {
+		t.Errorf("GetClient after repair = %q, %v, want the secret", got, err)
+	}
+}
+
+func TestReconcilePassword(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+	p := newTestProvider(c, "thedeep")
+	cr := newTestDevEnv("thedeep", "Arthur@example.com")
+
+	if _, err := p.GetUser(ctx, cr); !oauth.IsNotFound(err) {
+		t.Fatalf("GetUser of a missing password = %v, want NotFoundError", err)
+	}
+	id, err := p.EnsureUser(ctx, cr, testPassword)
+	if err != nil || id != "mfzhi2dvojagk6dbnvygyzjomnxw3s7sttsiiirdeu" {
+		t.Fatalf("EnsureUser = %q, %v, want the name of the password", id, err)
+	}
+	obj := getObject(t, c, passwordGVK, id)
+	if email, _, _ := unstructured.NestedString(obj.Object, "email"); email != "arthur@example.com" {
+		t.Errorf("email = %s, want it in lower case", email)
+	}
+	hash, _, _ := unstructured.NestedString(obj.Object, "hash")
+	raw, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil {
+		t.Fatalf("hash is not base64: %v", err)
+	}
+	if err = bcrypt.CompareHashAndPassword(raw, []byte("pw-arthur@example.com")); err != nil {
+		t.Errorf("hash does not match the password: %v", err)
+	}
+
+	// an existing password is kept
+	failing := func(ctx context.Context, username string) (string, error) {
+		t.Errorf("password of an existing user requested")
+		return "", nil
+	}
+	if got, err := p.EnsureUser(ctx, cr, failing); err != nil || got != id {
+		t.Errorf("EnsureUser of an existing password = %q, %v, want %q", got, err, id)
+	}
+	if got, err := p.GetUser(ctx, cr); err != nil || got != id {
+		t.Errorf("GetUser = %q, %v, want %q", got, err, id)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	thedeep := newTestDevEnv("thedeep", "arthur@example.com", "ford@example.com")
+	magrathea := newTestDevEnv("magrathea", "slartibartfast@example.com", "Arthur@example.com")
+	c := newTestClient(t, thedeep, magrathea)
+	p := newTestProvider(c, "thedeep")
+
+	if _, err := p.EnsureUser(ctx, thedeep, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.EnsureCollaborators(ctx, thedeep, testPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	// the email of the owner is still used by magrathea, only the password of the collaborator is deleted
+	if err := p.DeleteUser(ctx, thedeep); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	getObject(t, c, passwordGVK, idToName("arthur@example.com"))
+	if _, err := p.reconcilePassword(ctx, "ford@example.com", "ford@example.com", nil, false); !oauth.IsNotFound(err) {
+		t.Errorf("password of the collaborator = %v, want it deleted", err)
+	}
+
+	if err := c.Delete(ctx, magrathea); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DeleteUser(ctx, thedeep); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := p.GetUser(ctx, thedeep); !oauth.IsNotFound(err) {
+		t.Errorf("password of the owner = %v, want it deleted once no other DevEnv uses the email", err)
+	}
+}
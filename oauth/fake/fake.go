@@ -0,0 +1,383 @@
+// Package fake provides an in-memory OAUTHProvider for tests of the controllers.
+// It is not registered, tests inject it into the DevEnvReconciler.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+)
+
+// ClientID is the client id returned by the fake provider
+const ClientID = "c-n-d-e"
+
+// User is a user of the fake provider, shared by all DevEnvs using its email
+type User struct {
+	Name     string
+	Email    string
+	Password string
+	// DevEnvs the user is owner or collaborator of
+	DevEnvs map[string]bool
+}
+
+// OAUTHProvider keeps realms, clients and users of DevEnvs in memory. Realms and clients are keyed by
+// the name of the DevEnv, users by email. It is safe for concurrent use.
+type OAUTHProvider struct {
+	mu      sync.Mutex
+	realms  map[string]bool
+	clients map[string]string
+	users   map[string]*User
+	secrets int
+
+	// errors returned by the methods with the given names, calls records the names of the called methods
+	errors map[string]error
+	calls  []string
+}
+
+var _ oauth.OAUTHProvider = &OAUTHProvider{}
+
+// NewOAUTHProvider returns an empty fake provider
+func NewOAUTHProvider() *OAUTHProvider {
+	return &OAUTHProvider{
+		realms:  map[string]bool{},
+		clients: map[string]string{},
+		users:   map[string]*User{},
+		errors:  map[string]error{},
+	}
+}
+
+// SetError makes the method with the given name, e.g. "EnsureRealm", return err. A nil err resets it
+func (r *OAUTHProvider) SetError(method string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		delete(r.errors, method)
+		return
+	}
+	r.errors[method] = err
+}
+
+// call records the call of method and returns the error set for it. The caller holds mu
+func (r *OAUTHProvider) call(method string) error {
+	r.calls = append(r.calls, method)
+	return r.errors[method]
+}
+
+func (r *OAUTHProvider) nextSecret() string {
+	r.secrets++
+	return fmt.Sprintf("secret-%d", r.secrets)
+}
+
+//EnsureRealm creates the realm of the DevEnv
+func (r *OAUTHProvider) EnsureRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("EnsureRealm"); err != nil {
+		return "", err
+	}
+	r.realms[cr.Name] = true
+	return cr.Name, nil
+}
+
+//GetRealm verifies the realm of the DevEnv
+func (r *OAUTHProvider) GetRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("GetRealm"); err != nil {
+		return "", err
+	}
+	if !r.realms[cr.Name] {
+		return "", &oauth.NotFoundError{Kind: "Realm", Name: cr.Name}
+	}
+	return cr.Name, nil
+}
+
+//DeleteRealm deletes the realm of the DevEnv
+func (r *OAUTHProvider) DeleteRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("DeleteRealm"); err != nil {
+		return err
+	}
+	delete(r.realms, cr.Name)
+	return nil
+}
+
+// ensureUser creates the user with the given email or adds the DevEnv to an existing one. The caller holds mu
+func (r *OAUTHProvider) ensureUser(ctx context.Context, devenv, email string, password oauth.PasswordFunc) (*User, error) {
+	key := strings.ToLower(email)
+	u, ok := r.users[key]
+	if !ok {
+		pw, err := password(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		u = &User{Name: key, Email: email, Password: pw, DevEnvs: map[string]bool{}}
+		r.users[key] = u
+	}
+	u.DevEnvs[devenv] = true
+	return u, nil
+}
+
+//EnsureUser creates the user of the DevEnv
+func (r *OAUTHProvider) EnsureUser(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("EnsureUser"); err != nil {
+		return "", err
+	}
+	u, err := r.ensureUser(ctx, cr.Name, cr.Spec.UserEmail, password)
+	if err != nil {
+		return "", err
+	}
+	return u.Name, nil
+}
+
+//GetUser verifies the user of the DevEnv
+func (r *OAUTHProvider) GetUser(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("GetUser"); err != nil {
+		return "", err
+	}
+	u, ok := r.users[strings.ToLower(cr.Spec.UserEmail)]
+	if !ok {
+		return "", &oauth.NotFoundError{Kind: "User", Name: cr.Spec.UserEmail}
+	}
+	if !u.DevEnvs[cr.Name] {
+		return "", &oauth.DriftError{Kind: "User", Name: u.Name, Field: "devenv " + cr.Name}
+	}
+	return u.Name, nil
+}
+
+//DeleteUser removes the DevEnv from the users of owner and collaborators, users without DevEnvs are deleted
+func (r *OAUTHProvider) DeleteUser(ctx context.Context, cr *cndev1alpha1.DevEnv) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("DeleteUser"); err != nil {
+		return err
+	}
+	emails := []string{cr.Spec.UserEmail}
+	for _, c := range cr.Spec.Collaborators {
+		emails = append(emails, c.Email)
+	}
+	for _, email := range emails {
+		key := strings.ToLower(email)
+		if u, ok := r.users[key]; ok {
+			delete(u.DevEnvs, cr.Name)
+			if len(u.DevEnvs) == 0 {
+				delete(r.users, key)
+			}
+		}
+	}
+	return nil
+}
+
+//ResetPassword sets a new password of the user of the DevEnv
+func (r *OAUTHProvider) ResetPassword(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("ResetPassword"); err != nil {
+		return err
+	}
+	u, ok := r.users[strings.ToLower(cr.Spec.UserEmail)]
+	if !ok {
+		return &oauth.NotFoundError{Kind: "User", Name: cr.Spec.UserEmail}
+	}
+	pw, err := password(ctx, u.Name)
+	if err != nil {
+		return err
+	}
+	u.Password = pw
+	return nil
+}
+
+//EnsureCollaborators creates the users of the collaborators and removes the DevEnv from former ones
+func (r *OAUTHProvider) EnsureCollaborators(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("EnsureCollaborators"); err != nil {
+		return err
+	}
+	desired := map[string]bool{strings.ToLower(cr.Spec.UserEmail): true}
+	for _, c := range cr.Spec.Collaborators {
+		if _, err := r.ensureUser(ctx, cr.Name, c.Email, password); err != nil {
+			return err
+		}
+		desired[strings.ToLower(c.Email)] = true
+	}
+	for key, u := range r.users {
+		if u.DevEnvs[cr.Name] && !desired[key] {
+			delete(u.DevEnvs, cr.Name)
+			if len(u.DevEnvs) == 0 {
+				delete(r.users, key)
+			}
+		}
+	}
+	return nil
+}
+
+//EnsureClient creates the client of the DevEnv. Like Keycloak it returns an empty secret when the client is created
+func (r *OAUTHProvider) EnsureClient(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("EnsureClient"); err != nil {
+		return "", err
+	}
+	secret, ok := r.clients[cr.Name]
+	if !ok {
+		r.clients[cr.Name] = r.nextSecret()
+		return "", nil
+	}
+	return secret, nil
+}
+
+//GetClient verifies the client of the DevEnv
+func (r *OAUTHProvider) GetClient(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("GetClient"); err != nil {
+		return "", err
+	}
+	secret, ok := r.clients[cr.Name]
+	if !ok {
+		return "", &oauth.NotFoundError{Kind: "Client", Name: ClientID}
+	}
+	return secret, nil
+}
+
+//DeleteClient deletes the client of the DevEnv
+func (r *OAUTHProvider) DeleteClient(ctx context.Context, cr *cndev1alpha1.DevEnv) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("DeleteClient"); err != nil {
+		return err
+	}
+	delete(r.clients, cr.Name)
+	return nil
+}
+
+//RotateClientSecret sets a new secret of the client of the DevEnv
+func (r *OAUTHProvider) RotateClientSecret(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("RotateClientSecret"); err != nil {
+		return "", err
+	}
+	if _, ok := r.clients[cr.Name]; !ok {
+		return "", &oauth.NotFoundError{Kind: "Client", Name: ClientID}
+	}
+	r.clients[cr.Name] = r.nextSecret()
+	return r.clients[cr.Name], nil
+}
+
+//ListTagged returns all realms, clients and users, users are tagged with the first of their DevEnvs
+func (r *OAUTHProvider) ListTagged(ctx context.Context) ([]oauth.TaggedObject, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("ListTagged"); err != nil {
+		return nil, err
+	}
+	var tagged []oauth.TaggedObject
+	for name := range r.realms {
+		tagged = append(tagged, oauth.TaggedObject{Kind: "Realm", Name: name, ID: name, DevEnv: name})
+	}
+	for name := range r.clients {
+		tagged = append(tagged, oauth.TaggedObject{Kind: "Client", Name: name, ID: name, DevEnv: name})
+	}
+	for key, u := range r.users {
+		devenvs := make([]string, 0, len(u.DevEnvs))
+		for d := range u.DevEnvs {
+			devenvs = append(devenvs, d)
+		}
+		sort.Strings(devenvs)
+		obj := oauth.TaggedObject{Kind: "User", Name: u.Name, ID: key, Email: u.Email}
+		if len(devenvs) > 0 {
+			obj.DevEnv = devenvs[0]
+		}
+		tagged = append(tagged, obj)
+	}
+	return tagged, nil
+}
+
+//DeleteTagged deletes an object returned by ListTagged
+func (r *OAUTHProvider) DeleteTagged(ctx context.Context, obj oauth.TaggedObject) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("DeleteTagged"); err != nil {
+		return err
+	}
+	switch obj.Kind {
+	case "Realm":
+		delete(r.realms, obj.ID)
+	case "Client":
+		delete(r.clients, obj.ID)
+	case "User":
+		delete(r.users, obj.ID)
+	}
+	return nil
+}
+
+//ClientID returns the client id of all DevEnvs
+func (r *OAUTHProvider) ClientID() string {
+	return ClientID
+}
+
+//IssuerURL returns a fake issuer of the DevEnv
+func (r *OAUTHProvider) IssuerURL(cr *cndev1alpha1.DevEnv) string {
+	return "https://oauth." + cr.Spec.UserEnvDomain + "/" + cr.Name
+}
+
+//AllowedGroups returns no groups
+func (r *OAUTHProvider) AllowedGroups(cr *cndev1alpha1.DevEnv) []string {
+	return nil
+}
+
+// HasRealm reports whether the realm of the DevEnv with the given name exists
+func (r *OAUTHProvider) HasRealm(devenv string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.realms[devenv]
+}
+
+// ClientSecret returns the secret of the client of the DevEnv with the given name, false if there is no client
+func (r *OAUTHProvider) ClientSecret(devenv string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	secret, ok := r.clients[devenv]
+	return secret, ok
+}
+
+// User returns a copy of the user with the given email, nil if there is none
+func (r *OAUTHProvider) User(email string) *User {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[strings.ToLower(email)]
+	if !ok {
+		return nil
+	}
+	c := *u
+	c.DevEnvs = map[string]bool{}
+	for d := range u.DevEnvs {
+		c.DevEnvs[d] = true
+	}
+	return &c
+}
+
+// Called reports how often the method with the given name was called
+func (r *OAUTHProvider) Called(method string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, c := range r.calls {
+		if c == method {
+			n++
+		}
+	}
+	return n
+}
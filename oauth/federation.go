@@ -0,0 +1,101 @@
+package oauth
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"sigs.k8s.io/yaml"
+)
+
+// identity provider types supported by the FederationConfig
+const (
+	IdentityProviderOIDC   = "oidc"
+	IdentityProviderSAML   = "saml"
+	IdentityProviderGitHub = "github"
+
+	UserFederationLDAP = "ldap"
+)
+
+// FederationConfig declares the identity providers and user federations every realm of the operator gets.
+// It is read from the file named by CNDE_OAUTH_FEDERATION_FILE, which should be mounted from a Secret.
+type FederationConfig struct {
+	IdentityProviders []IdentityProvider `json:"identityProviders,omitempty"`
+	UserFederations   []UserFederation   `json:"userFederations,omitempty"`
+}
+
+// IdentityProvider users can log in with instead of a local password, e.g. the corporate SSO or GitHub
+type IdentityProvider struct {
+	// Alias is the unique name of the identity provider in the realm
+	Alias string `json:"alias"`
+	// Type is one of oidc, saml or github
+	Type        string `json:"type"`
+	DisplayName string `json:"displayName,omitempty"`
+	// Config is passed to the OAUTH provider as is, e.g. clientId, clientSecret, authorizationUrl, tokenUrl
+	Config map[string]string `json:"config,omitempty"`
+}
+
+// UserFederation imports users from an external user store
+type UserFederation struct {
+	// Name is the unique name of the user federation in the realm
+	Name string `json:"name"`
+	// Type is ldap
+	Type string `json:"type"`
+	// Config is passed to the OAUTH provider as is, e.g. connectionUrl, usersDn, bindDn, bindCredential
+	Config map[string][]string `json:"config,omitempty"`
+}
+
+// IsEmpty reports whether neither identity providers nor user federations are declared
+func (c *FederationConfig) IsEmpty() bool {
+	return c == nil || (len(c.IdentityProviders) == 0 && len(c.UserFederations) == 0)
+}
+
+// Validate checks names and types of the declared identity providers and user federations
+func (c *FederationConfig) Validate() error {
+	aliases := map[string]bool{}
+	for _, idp := range c.IdentityProviders {
+		if idp.Alias == "" {
+			return fmt.Errorf("identity provider without alias")
+		}
+		if aliases[idp.Alias] {
+			return fmt.Errorf("identity provider %q declared twice", idp.Alias)
+		}
+		aliases[idp.Alias] = true
+		switch idp.Type {
+		case IdentityProviderOIDC, IdentityProviderSAML, IdentityProviderGitHub:
+		default:
+			return fmt.Errorf("identity provider %q has unknown type %q", idp.Alias, idp.Type)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, uf := range c.UserFederations {
+		if uf.Name == "" {
+			return fmt.Errorf("user federation without name")
+		}
+		if names[uf.Name] {
+			return fmt.Errorf("user federation %q declared twice", uf.Name)
+		}
+		names[uf.Name] = true
+		if uf.Type != UserFederationLDAP {
+			return fmt.Errorf("user federation %q has unknown type %q", uf.Name, uf.Type)
+		}
+	}
+	return nil
+}
+
+// LoadFederationConfig reads and validates the FederationConfig in the given YAML or JSON file
+func LoadFederationConfig(path string) (*FederationConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &FederationConfig{}
+	if err = yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err = config.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
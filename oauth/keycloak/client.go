@@ -0,0 +1,223 @@
+package keycloak
+
+import (
+	"context"
+	"reflect"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"github.com/Nerzal/gocloak/v7"
+)
+
+const (
+	protocolOIDC = "openid-connect"
+	groupsMapper = "groups"
+)
+
+// groupsProtocolMapper adds the groups of the user to the tokens. oauth2-proxy checks the
+// membership of the group of the DevEnv in a shared realm and of allowedGroups using this claim
+func groupsProtocolMapper() gocloak.ProtocolMapperRepresentation {
+	protocol := protocolOIDC
+	mapperName := groupsMapper
+	mapperType := "oidc-group-membership-mapper"
+	return gocloak.ProtocolMapperRepresentation{
+		Name:           &mapperName,
+		Protocol:       &protocol,
+		ProtocolMapper: &mapperType,
+		Config: &map[string]string{
+			"claim.name":           "groups",
+			"full.path":            "false",
+			"id.token.claim":       "true",
+			"access.token.claim":   "true",
+			"userinfo.token.claim": "true",
+		},
+	}
+}
+
+func (r *OAUTHProvider) desiredClient() gocloak.Client {
+	TRUE := true
+	FALSE := false
+
+	protocol := protocolOIDC
+	url := "https://" + r.ingressHost
+	clientID := r.ClientID()
+
+	c := gocloak.Client{
+		ClientID:            &clientID,
+		Name:                &clientID,
+		RootURL:             &url,
+		RedirectURIs:        &[]string{url + "/oauth2/callback"},
+		Enabled:             &TRUE,
+		Protocol:            &protocol,
+		PublicClient:        &FALSE,
+		StandardFlowEnabled: &TRUE,
+		ProtocolMappers:     &[]gocloak.ProtocolMapperRepresentation{groupsProtocolMapper()},
+		Attributes:          &map[string]string{oauth.DevEnvTag: r.devEnvName},
+	}
+	return c
+}
+
+//EnsureClient creates the client of the DevEnv or repairs its root URL and redirect URIs
+func (r *OAUTHProvider) EnsureClient(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	return r.reconcileClient(ctx, true)
+}
+
+//GetClient verifies the client of the DevEnv
+func (r *OAUTHProvider) GetClient(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	return r.reconcileClient(ctx, false)
+}
+
+func (r *OAUTHProvider) reconcileClient(ctx context.Context, repair bool) (string, error) {
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+	desired := r.desiredClient()
+	realm := r.realm()
+	clientID := r.ClientID()
+
+	client, token, err := r.login(ctx)
+	if err != nil {
+		reqLogger.Error(err, "Failed to connect to Keycloak.")
+		return "", err
+	}
+
+	if r.isShared() && repair {
+		if _, err = r.ensureGroup(ctx, client, token); err != nil {
+			return "", err
+		}
+	}
+
+	clients, err := client.GetClients(ctx,
+		token.AccessToken,
+		realm,
+		gocloak.GetClientsParams{
+			ClientID: &clientID,
+		},
+	)
+	if err != nil {
+		reqLogger.Error(err, "Failed to get clients.")
+		return "", err
+	}
+
+	if len(clients) == 0 {
+		if !repair {
+			return "", &oauth.NotFoundError{Kind: "Client", Name: clientID}
+		}
+		_, err = client.CreateClient(ctx, token.AccessToken, realm, desired)
+		if err != nil {
+			reqLogger.Error(err, "Failed to createClient.")
+			return "", err
+		}
+		return "", nil // reconsile
+	}
+
+	c := clients[0]
+	var drift string
+	if c.Enabled == nil || !*c.Enabled {
+		drift = "enabled"
+	} else if c.RootURL == nil || *c.RootURL != *desired.RootURL {
+		drift = "rootUrl"
+	} else if c.RedirectURIs == nil || !reflect.DeepEqual(*c.RedirectURIs, *desired.RedirectURIs) {
+		drift = "redirectUris"
+	}
+
+	if drift != "" {
+		if !repair {
+			return "", &oauth.DriftError{Kind: "Client", Name: clientID, Field: drift}
+		}
+		reqLogger.Info("Repairing drifted Client.", "Client", clientID, "Field", drift)
+		c.Enabled = desired.Enabled
+		c.RootURL = desired.RootURL
+		c.RedirectURIs = desired.RedirectURIs
+		err = client.UpdateClient(ctx, token.AccessToken, realm, *c)
+		if err != nil {
+			reqLogger.Error(err, "Failed to update client.")
+			return "", err
+		}
+	}
+
+	if !hasProtocolMapper(c, groupsMapper) {
+		if !repair {
+			return "", &oauth.DriftError{Kind: "Client", Name: clientID, Field: "protocolMappers"}
+		}
+		reqLogger.Info("Repairing drifted Client.", "Client", clientID, "Field", "protocolMappers")
+		_, err = client.CreateClientProtocolMapper(ctx, token.AccessToken, realm, *c.ID, groupsProtocolMapper())
+		if err != nil {
+			reqLogger.Error(err, "Failed to create protocol mapper.")
+			return "", err
+		}
+	}
+
+	repr, err := client.GetClientSecret(ctx, token.AccessToken, realm, *c.ID)
+	if err != nil {
+		reqLogger.Error(err, "Failed to get client secret.")
+		return "", err
+	}
+	return *repr.Value, nil
+}
+
+//DeleteClient deletes the client of the DevEnv
+func (r *OAUTHProvider) DeleteClient(ctx context.Context, cr *cndev1alpha1.DevEnv) error {
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+	clientID := r.ClientID()
+
+	client, token, err := r.login(ctx)
+	if err != nil {
+		reqLogger.Error(err, "Failed to connect to Keycloak.")
+		return err
+	}
+
+	clients, err := client.GetClients(ctx, token.AccessToken, r.realm(), gocloak.GetClientsParams{ClientID: &clientID})
+	if isNotFound(err) {
+		return nil // the realm is gone
+	} else if err != nil {
+		reqLogger.Error(err, "Failed to get clients.")
+		return err
+	}
+	for _, c := range clients {
+		err = client.DeleteClient(ctx, token.AccessToken, r.realm(), *c.ID)
+		if err != nil && !isNotFound(err) {
+			reqLogger.Error(err, "Failed to delete client.")
+			return err
+		}
+	}
+	return nil
+}
+
+//RotateClientSecret lets Keycloak regenerate the secret of the client of the DevEnv
+func (r *OAUTHProvider) RotateClientSecret(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+	clientID := r.ClientID()
+
+	client, token, err := r.login(ctx)
+	if err != nil {
+		reqLogger.Error(err, "Failed to connect to Keycloak.")
+		return "", err
+	}
+
+	clients, err := client.GetClients(ctx, token.AccessToken, r.realm(), gocloak.GetClientsParams{ClientID: &clientID})
+	if err != nil {
+		reqLogger.Error(err, "Failed to get clients.")
+		return "", err
+	}
+	if len(clients) == 0 {
+		return "", &oauth.NotFoundError{Kind: "Client", Name: clientID}
+	}
+
+	repr, err := client.RegenerateClientSecret(ctx, token.AccessToken, r.realm(), *clients[0].ID)
+	if err != nil {
+		reqLogger.Error(err, "Failed to regenerate client secret.")
+		return "", err
+	}
+	return *repr.Value, nil
+}
+
+func hasProtocolMapper(c *gocloak.Client, name string) bool {
+	if c.ProtocolMappers == nil {
+		return false
+	}
+	for _, m := range *c.ProtocolMappers {
+		if m.Name != nil && *m.Name == name {
+			return true
+		}
+	}
+	return false
+}
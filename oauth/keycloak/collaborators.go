@@ -0,0 +1,129 @@
+package keycloak
+
+import (
+	"context"
+	"strings"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"github.com/Nerzal/gocloak/v7"
+)
+
+const (
+	// collaboratorAttribute marks users created for collaborators in a realm of a DevEnv, only these are deleted
+	collaboratorAttribute = "cnde-collaborator"
+	// listMax limits lists of users, Keycloak returns 100 by default
+	listMax = 10000
+)
+
+//EnsureCollaborators creates the users of the collaborators, keyed by email, or links existing ones with the same email.
+//In a realm of its own users of former collaborators are deleted, in a shared realm they are removed from the group of the DevEnv
+func (r *OAUTHProvider) EnsureCollaborators(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc) error {
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+
+	client, token, err := r.login(ctx)
+	if err != nil {
+		reqLogger.Error(err, "Failed to connect to Keycloak.")
+		return err
+	}
+
+	desired := map[string]bool{}
+	for _, c := range cr.Spec.Collaborators {
+		email := strings.ToLower(c.Email)
+		desired[email] = true
+
+		user, err := r.findUser(ctx, client, token, email)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			if user, err = r.findUserByEmail(ctx, client, token, email); err != nil {
+				return err
+			}
+		}
+
+		var id string
+		if user == nil {
+			reqLogger.Info("Creating collaborator.", "Email", email)
+			id, err = r.createUser(ctx, client, token, email, email, map[string][]string{collaboratorAttribute: {"true"}}, password)
+			if err != nil {
+				return err
+			}
+		} else {
+			id = *user.ID
+		}
+		if err = r.reconcileMembership(ctx, client, token, id, true); err != nil {
+			return err
+		}
+	}
+
+	if r.isShared() {
+		return r.removeFormerMembers(ctx, client, token, cr, desired)
+	}
+	return r.deleteFormerCollaborators(ctx, client, token, desired)
+}
+
+// deleteFormerCollaborators deletes the users created for collaborators no longer listed in the DevEnv
+func (r *OAUTHProvider) deleteFormerCollaborators(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT, desired map[string]bool) error {
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+
+	max := listMax
+	users, err := client.GetUsers(ctx, token.AccessToken, r.realm(), gocloak.GetUsersParams{Max: &max})
+	if err != nil {
+		reqLogger.Error(err, "Failed to get users.")
+		return err
+	}
+	for _, u := range users {
+		if !isCollaborator(u) || u.Email == nil || desired[strings.ToLower(*u.Email)] {
+			continue
+		}
+		reqLogger.Info("Deleting former collaborator.", "Email", *u.Email)
+		err = client.DeleteUser(ctx, token.AccessToken, r.realm(), *u.ID)
+		if err != nil && !isNotFound(err) {
+			reqLogger.Error(err, "Failed to delete user.")
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFormerMembers removes users other than the owner and the collaborators from the group of the DevEnv.
+// The users are kept, they may own or collaborate in other DevEnvs of the shared realm
+func (r *OAUTHProvider) removeFormerMembers(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT, cr *cndev1alpha1.DevEnv, desired map[string]bool) error {
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.sharedRealm)
+
+	group, err := r.getGroup(ctx, client, token)
+	if err != nil || group == nil {
+		return err
+	}
+	max := listMax
+	members, err := client.GetGroupMembers(ctx, token.AccessToken, r.sharedRealm, *group.ID, gocloak.GetGroupsParams{Max: &max})
+	if err != nil {
+		reqLogger.Error(err, "Failed to get group members.")
+		return err
+	}
+	for _, u := range members {
+		if u.Email == nil || desired[strings.ToLower(*u.Email)] || strings.EqualFold(*u.Email, cr.Spec.UserEmail) {
+			continue
+		}
+		reqLogger.Info("Removing former collaborator from group.", "Email", *u.Email, "Group", r.resourceName)
+		err = client.DeleteUserFromGroup(ctx, token.AccessToken, r.sharedRealm, *u.ID, *group.ID)
+		if err != nil && !isNotFound(err) {
+			reqLogger.Error(err, "Failed to remove user from group.")
+			return err
+		}
+	}
+	return nil
+}
+
+func isCollaborator(u *gocloak.User) bool {
+	if u.Attributes == nil {
+		return false
+	}
+	for _, v := range (*u.Attributes)[collaboratorAttribute] {
+		if v == "true" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"github.com/Nerzal/gocloak/v7"
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	// autoLinkFlow is the first broker login flow of federated identity providers. It links
+	// identities to the existing user with the same email, so a DevEnv user logs in by SSO at once
+	autoLinkFlow = "cnde-auto-link"
+
+	userStorageProviderType = "org.keycloak.storage.UserStorageProvider"
+)
+
+// flowExecution is an execution of an authentication flow, gocloak lacks these admin APIs
+type flowExecution struct {
+	ID          string `json:"id,omitempty"`
+	ProviderID  string `json:"providerId,omitempty"`
+	Requirement string `json:"requirement,omitempty"`
+}
+
+// component is a user federation, gocloak.Component does not carry arbitrary config
+type component struct {
+	ID           string              `json:"id,omitempty"`
+	Name         string              `json:"name"`
+	ProviderID   string              `json:"providerId"`
+	ProviderType string              `json:"providerType"`
+	ParentID     string              `json:"parentId"`
+	Config       map[string][]string `json:"config,omitempty"`
+}
+
+// adminRequest returns a request to the admin API of the realm for calls gocloak does not provide
+func (r *OAUTHProvider) adminRequest(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT) *resty.Request {
+	return client.RestyClient().R().
+		SetContext(ctx).
+		SetAuthToken(token.AccessToken).
+		SetHeader("Content-Type", "application/json")
+}
+
+func (r *OAUTHProvider) adminURL(path ...string) string {
+	return strings.TrimRight(r.oauthURL, "/") + "/auth/admin/realms/" + r.realm() + "/" + strings.Join(path, "/")
+}
+
+func checkResponse(resp *resty.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("%s %s: %d %s", resp.Request.Method, resp.Request.URL, resp.StatusCode(), resp.Status())
+	}
+	return nil
+}
+
+// reconcileFederation verifies the identity providers and user federations of the FederationConfig in the realm.
+// Only their existence is verified, Keycloak does not return secrets of their config.
+func (r *OAUTHProvider) reconcileFederation(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT, realmID string, repair bool) error {
+	if r.federation.IsEmpty() {
+		return nil
+	}
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+
+	if len(r.federation.IdentityProviders) > 0 {
+		if err := r.reconcileAutoLinkFlow(ctx, client, token, repair); err != nil {
+			reqLogger.Error(err, "Failed to reconcile authentication flow.", "Flow", autoLinkFlow)
+			return err
+		}
+	}
+
+	existing, err := client.GetIdentityProviders(ctx, token.AccessToken, r.realm())
+	if err != nil {
+		reqLogger.Error(err, "Failed to get identity providers.")
+		return err
+	}
+	for _, idp := range r.federation.IdentityProviders {
+		if hasIdentityProvider(existing, idp.Alias) {
+			continue
+		}
+		if !repair {
+			return &oauth.NotFoundError{Kind: "IdentityProvider", Name: idp.Alias}
+		}
+		reqLogger.Info("Creating identity provider.", "IdentityProvider", idp.Alias)
+		if _, err = client.CreateIdentityProvider(ctx, token.AccessToken, r.realm(), desiredIdentityProvider(idp)); err != nil {
+			reqLogger.Error(err, "Failed to create identity provider.", "IdentityProvider", idp.Alias)
+			return err
+		}
+	}
+
+	for _, uf := range r.federation.UserFederations {
+		var components []component
+		err = checkResponse(r.adminRequest(ctx, client, token).
+			SetQueryParams(map[string]string{"type": userStorageProviderType, "name": uf.Name}).
+			SetResult(&components).
+			Get(r.adminURL("components")))
+		if err != nil {
+			reqLogger.Error(err, "Failed to get user federations.")
+			return err
+		}
+		if len(components) > 0 {
+			continue
+		}
+		if !repair {
+			return &oauth.NotFoundError{Kind: "UserFederation", Name: uf.Name}
+		}
+		reqLogger.Info("Creating user federation.", "UserFederation", uf.Name)
+		err = checkResponse(r.adminRequest(ctx, client, token).
+			SetBody(component{
+				Name:         uf.Name,
+				ProviderID:   uf.Type,
+				ProviderType: userStorageProviderType,
+				ParentID:     realmID,
+				Config:       uf.Config,
+			}).
+			Post(r.adminURL("components")))
+		if err != nil {
+			reqLogger.Error(err, "Failed to create user federation.", "UserFederation", uf.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+func desiredIdentityProvider(idp oauth.IdentityProvider) gocloak.IdentityProviderRepresentation {
+	TRUE := true
+	alias := idp.Alias
+	providerID := idp.Type
+	displayName := idp.DisplayName
+	flow := autoLinkFlow
+	config := idp.Config
+	if config == nil {
+		config = map[string]string{}
+	}
+
+	return gocloak.IdentityProviderRepresentation{
+		Alias:                     &alias,
+		ProviderID:                &providerID,
+		DisplayName:               &displayName,
+		Enabled:                   &TRUE,
+		TrustEmail:                &TRUE,
+		FirstBrokerLoginFlowAlias: &flow,
+		Config:                    &config,
+	}
+}
+
+func hasIdentityProvider(idps []*gocloak.IdentityProviderRepresentation, alias string) bool {
+	for _, idp := range idps {
+		if idp.Alias != nil && *idp.Alias == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileAutoLinkFlow creates the first broker login flow creating unknown users and linking known ones by email
+func (r *OAUTHProvider) reconcileAutoLinkFlow(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT, repair bool) error {
+	var flows []map[string]interface{}
+	err := checkResponse(r.adminRequest(ctx, client, token).SetResult(&flows).Get(r.adminURL("authentication", "flows")))
+	if err != nil {
+		return err
+	}
+	for _, f := range flows {
+		if f["alias"] == autoLinkFlow {
+			return nil
+		}
+	}
+	if !repair {
+		return &oauth.NotFoundError{Kind: "AuthenticationFlow", Name: autoLinkFlow}
+	}
+
+	err = checkResponse(r.adminRequest(ctx, client, token).
+		SetBody(map[string]interface{}{
+			"alias":       autoLinkFlow,
+			"description": "links identities to existing users with the same email",
+			"providerId":  "basic-flow",
+			"topLevel":    true,
+			"builtIn":     false,
+		}).
+		Post(r.adminURL("authentication", "flows")))
+	if err != nil {
+		return err
+	}
+
+	for _, provider := range []string{"idp-create-user-if-unique", "idp-auto-link"} {
+		err = checkResponse(r.adminRequest(ctx, client, token).
+			SetBody(map[string]string{"provider": provider}).
+			Post(r.adminURL("authentication", "flows", autoLinkFlow, "executions", "execution")))
+		if err != nil {
+			return err
+		}
+	}
+
+	var executions []flowExecution
+	err = checkResponse(r.adminRequest(ctx, client, token).
+		SetResult(&executions).
+		Get(r.adminURL("authentication", "flows", autoLinkFlow, "executions")))
+	if err != nil {
+		return err
+	}
+	for _, e := range executions {
+		e.Requirement = "ALTERNATIVE"
+		err = checkResponse(r.adminRequest(ctx, client, token).
+			SetBody(e).
+			Put(r.adminURL("authentication", "flows", autoLinkFlow, "executions")))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findUserByEmail returns the user with the given email, including users of user federations, nil if there is none
+func (r *OAUTHProvider) findUserByEmail(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT, email string) (*gocloak.User, error) {
+	users, err := client.GetUsers(ctx, token.AccessToken, r.realm(), gocloak.GetUsersParams{Email: &email})
+	if err != nil {
+		r.log.Error(err, "Failed to get users.", "Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+		return nil, err
+	}
+	for _, u := range users {
+		if u.Email != nil && strings.EqualFold(*u.Email, email) {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
@@ -3,11 +3,13 @@ package keycloak
 import (
 	"context"
 	"strings"
+	"time"
 
 	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
 	"cnde-operator.cloud-native-coding.dev/oauth"
 	"github.com/Nerzal/gocloak/v7"
 	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 //OAUTHProvider data for Keycloak
@@ -19,163 +21,313 @@ type OAUTHProvider struct {
 	oauthAdminPassword string
 	oauthAdminRealm    string
 
+	realmMode   string
+	sharedRealm string
+	timeout     time.Duration
+	federation  *oauth.FederationConfig
+	policy      *oauth.RealmPolicy
+
+	devEnvName   string
 	resourceName string
 	ingressHost  string
 
-	oauthClientID        string
-	oauthInitialPassword string
+	oauthClientID string
+}
+
+func init() {
+	oauth.Register("keycloak", func(config *oauth.OAUTHProviderConfig) (oauth.OAUTHProvider, error) {
+		return NewKeycloakOAUTHProvider(config), nil
+	})
 }
 
 //NewKeycloakOAUTHProvider creates a new OAUTH Provider with Keycloak
 func NewKeycloakOAUTHProvider(config *oauth.OAUTHProviderConfig) *OAUTHProvider {
 	p := &OAUTHProvider{
-		log:                  config.Log,
-		oauthURL:             config.OauthURL,
-		oauthAdminName:       config.OauthAdminName,
-		oauthAdminPassword:   config.OauthAdminPassword,
-		oauthAdminRealm:      config.OauthAdminRealm,
-		oauthClientID:        config.OauthClientID,
-		oauthInitialPassword: config.OauthInitialPassword,
+		log:                config.Log,
+		oauthURL:           config.OauthURL,
+		oauthAdminName:     config.OauthAdminName,
+		oauthAdminPassword: config.OauthAdminPassword,
+		oauthAdminRealm:    config.OauthAdminRealm,
+		oauthClientID:      config.OauthClientID,
+
+		realmMode:   config.OauthRealmMode,
+		sharedRealm: config.OauthSharedRealm,
+		timeout:     config.Timeout,
+		federation:  config.Federation,
+		policy:      config.RealmPolicy,
 
 		ingressHost:  config.IngressHost,
+		devEnvName:   config.DevEnvName,
 		resourceName: config.ResourceName,
 	}
+	if p.policy == nil {
+		p.policy = oauth.DefaultRealmPolicy()
+	}
 	return p
 }
 
-func (r *OAUTHProvider) NewRealm(cr *cndev1alpha1.DevEnv) (string, error) {
-	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL)
-	TRUE := true
-	accessTokenLifespan := 23 * 60 * 60
+// login returns the shared client of the Keycloak instance and a valid admin token
+func (r *OAUTHProvider) login(ctx context.Context) (gocloak.GoCloak, *gocloak.JWT, error) {
+	s := sessionFor(r.oauthURL, r.oauthAdminName, r.oauthAdminRealm, r.timeout)
+	token, err := s.accessToken(ctx, r.oauthAdminName, r.oauthAdminPassword, r.oauthAdminRealm)
+	return s.client, token, err
+}
 
-	client := gocloak.NewClient(r.oauthURL)
-	ctx := context.Background()
-	//reqLogger.Info("Login", "name", r.OauthAdminName, "pw", "****", "realm", r.OauthAdminRealm)
-	token, err := client.LoginAdmin(ctx, r.oauthAdminName, r.oauthAdminPassword, r.oauthAdminRealm)
-	if err != nil {
-		reqLogger.Error(err, "Failed to connect to Keycloak.")
-		return "", err
-	}
+func (r *OAUTHProvider) isShared() bool {
+	return r.realmMode == oauth.RealmModeShared
+}
 
-	_, err = client.GetRealm(ctx, token.AccessToken, r.resourceName)
-	if err != nil {
-		if strings.Contains(err.Error(), "404") {
-			rp := gocloak.RealmRepresentation{
-				Realm:               &r.resourceName,
-				Enabled:             &TRUE,
-				ID:                  &r.resourceName,
-				AccessTokenLifespan: &accessTokenLifespan,
-			}
-			_, err = client.CreateRealm(ctx, token.AccessToken, rp)
-			if err != nil {
-				reqLogger.Error(err, "Failed to create Realm.")
-				return "", err
-			}
-		} else {
-			reqLogger.Error(err, "Failed to get Realm")
-			return "", err
-		}
+// appliesPolicy reports whether the RealmPolicy applies to the realm of the DevEnv, to the shared realm only by opt-in
+func (r *OAUTHProvider) appliesPolicy() bool {
+	return !r.isShared() || r.policy.ApplyToSharedRealm
+}
+
+// realm returns the name of the realm the DevEnv lives in
+func (r *OAUTHProvider) realm() string {
+	if r.isShared() {
+		return r.sharedRealm
 	}
-	return r.resourceName, nil
+	return r.resourceName
 }
 
-func (r *OAUTHProvider) DeleteRealm(cr *cndev1alpha1.DevEnv) error {
-	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL)
+//ClientID returns the client id created in the realm of the DevEnv
+func (r *OAUTHProvider) ClientID() string {
+	if r.isShared() {
+		return r.resourceName
+	}
+	return r.oauthClientID
+}
 
-	client := gocloak.NewClient(r.oauthURL)
-	ctx := context.Background()
+//IssuerURL returns the URL of the realm of the DevEnv
+func (r *OAUTHProvider) IssuerURL(cr *cndev1alpha1.DevEnv) string {
+	return "https://keycloak." + cr.Spec.UserEnvDomain + "/auth/realms/" + r.realm()
+}
 
-	token, err := client.LoginAdmin(ctx, r.oauthAdminName, r.oauthAdminPassword, r.oauthAdminRealm)
-	if err != nil {
-		reqLogger.Error(err, "Failed to connect to Keycloak.")
-		return err
+//AllowedGroups returns the group of the DevEnv in a shared realm. A realm of its own needs no group.
+func (r *OAUTHProvider) AllowedGroups(cr *cndev1alpha1.DevEnv) []string {
+	if r.isShared() {
+		return []string{r.resourceName}
 	}
+	return nil
+}
 
-	err = client.DeleteRealm(ctx, token.AccessToken, r.resourceName)
-	if err != nil {
-		reqLogger.Error(err, "Failed to delete Realm.")
-		return err
+// isNotFound reports whether Keycloak answered with 404
+func isNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "404")
+}
+
+// seconds returns the duration in seconds, nil for 0 to keep the default of Keycloak
+func seconds(d metav1.Duration) *int {
+	if d.Duration == 0 {
+		return nil
 	}
-	return nil
+	s := int(d.Duration / time.Second)
+	return &s
 }
 
-func (r *OAUTHProvider) CreateUser(cr *cndev1alpha1.DevEnv) (string, error) {
-	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL)
+func (r *OAUTHProvider) desiredRealm() gocloak.RealmRepresentation {
 	TRUE := true
+	realm := r.realm()
+
+	rp := gocloak.RealmRepresentation{
+		Realm:                 &realm,
+		Enabled:               &TRUE,
+		AccessTokenLifespan:   seconds(r.policy.AccessTokenLifespan),
+		SsoSessionIdleTimeout: seconds(r.policy.SSOSessionIdleTimeout),
+		SsoSessionMaxLifespan: seconds(r.policy.SSOSessionMaxLifespan),
+	}
+	if !r.isShared() {
+		rp.ID = &realm
+		rp.Attributes = &map[string]string{oauth.DevEnvTag: r.devEnvName}
+	}
+	if r.policy.PasswordPolicy != "" {
+		rp.PasswordPolicy = &r.policy.PasswordPolicy
+	}
+	if b := r.policy.BruteForceProtection; b != nil {
+		rp.BruteForceProtected = &TRUE
+		if b.FailureFactor > 0 {
+			rp.FailureFactor = &b.FailureFactor
+		}
+		rp.WaitIncrementSeconds = seconds(b.WaitIncrement)
+		rp.MaxFailureWaitSeconds = seconds(b.MaxFailureWait)
+		rp.MaxDeltaTimeSeconds = seconds(b.MaxDeltaTime)
+	}
+	return rp
+}
+
+// realmDrift returns the first setting of the realm differing from the desired one, "" if there is none
+func realmDrift(desired, actual *gocloak.RealmRepresentation) string {
+	if actual.Enabled == nil || !*actual.Enabled {
+		return "enabled"
+	}
 
-	client := gocloak.NewClient(r.oauthURL)
-	ctx := context.Background()
+	ints := []struct {
+		field           string
+		desired, actual *int
+	}{
+		{"accessTokenLifespan", desired.AccessTokenLifespan, actual.AccessTokenLifespan},
+		{"ssoSessionIdleTimeout", desired.SsoSessionIdleTimeout, actual.SsoSessionIdleTimeout},
+		{"ssoSessionMaxLifespan", desired.SsoSessionMaxLifespan, actual.SsoSessionMaxLifespan},
+		{"failureFactor", desired.FailureFactor, actual.FailureFactor},
+		{"waitIncrementSeconds", desired.WaitIncrementSeconds, actual.WaitIncrementSeconds},
+		{"maxFailureWaitSeconds", desired.MaxFailureWaitSeconds, actual.MaxFailureWaitSeconds},
+		{"maxDeltaTimeSeconds", desired.MaxDeltaTimeSeconds, actual.MaxDeltaTimeSeconds},
+	}
+	for _, i := range ints {
+		if i.desired != nil && (i.actual == nil || *i.actual != *i.desired) {
+			return i.field
+		}
+	}
 
-	token, err := client.LoginAdmin(ctx, r.oauthAdminName, r.oauthAdminPassword, r.oauthAdminRealm)
+	if desired.PasswordPolicy != nil && (actual.PasswordPolicy == nil || *actual.PasswordPolicy != *desired.PasswordPolicy) {
+		return "passwordPolicy"
+	}
+	if desired.BruteForceProtected != nil && (actual.BruteForceProtected == nil || !*actual.BruteForceProtected) {
+		return "bruteForceProtected"
+	}
+	return ""
+}
+
+//EnsureRealm creates the realm of the DevEnv or repairs its settings. The shared realm belongs to the administrators
+//of Keycloak, it is only verified to exist unless the RealmPolicy applies to it.
+func (r *OAUTHProvider) EnsureRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	return r.reconcileRealm(ctx, true)
+}
+
+//GetRealm verifies the realm of the DevEnv
+func (r *OAUTHProvider) GetRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	return r.reconcileRealm(ctx, false)
+}
+
+func (r *OAUTHProvider) reconcileRealm(ctx context.Context, repair bool) (string, error) {
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL)
+	desired := r.desiredRealm()
+	realm := r.realm()
+
+	client, token, err := r.login(ctx)
 	if err != nil {
 		reqLogger.Error(err, "Failed to connect to Keycloak.")
 		return "", err
 	}
 
-	u := gocloak.User{
-		Username:      &cr.Name,
-		Enabled:       &TRUE,
-		Email:         &cr.Spec.UserEmail,
-		EmailVerified: &TRUE,
+	rp, err := client.GetRealm(ctx, token.AccessToken, realm)
+	if isNotFound(err) {
+		if !repair || r.isShared() {
+			return "", &oauth.NotFoundError{Kind: "Realm", Name: realm}
+		}
+		_, err = client.CreateRealm(ctx, token.AccessToken, desired)
+		if err != nil {
+			reqLogger.Error(err, "Failed to create Realm.")
+			return "", err
+		}
+		return realm, r.reconcileFederation(ctx, client, token, *desired.ID, repair)
+	} else if err != nil {
+		reqLogger.Error(err, "Failed to get Realm")
+		return "", err
+	}
+
+	realmID := realm
+	if rp.ID != nil {
+		realmID = *rp.ID
+	}
+	if err = r.reconcileFederation(ctx, client, token, realmID, repair); err != nil {
+		return "", err
+	}
+
+	if !r.appliesPolicy() {
+		// the settings of the shared realm are left to its administrators
+		return realm, nil
+	}
+	drift := realmDrift(&desired, rp)
+	if drift == "" {
+		return realm, nil
+	}
+	if !repair {
+		return "", &oauth.DriftError{Kind: "Realm", Name: realm, Field: drift}
 	}
 
-	user, err := client.CreateUser(ctx, token.AccessToken, r.resourceName, u)
+	reqLogger.Info("Repairing drifted Realm.", "Realm", realm, "Field", drift)
+	err = client.UpdateRealm(ctx, token.AccessToken, desired)
 	if err != nil {
+		reqLogger.Error(err, "Failed to update Realm.")
 		return "", err
 	}
-
-	err = client.SetPassword(ctx, token.AccessToken, user, r.resourceName, r.oauthInitialPassword, true)
-	return user, err
+	return realm, nil
 }
 
-func (r *OAUTHProvider) CreateClient(cr *cndev1alpha1.DevEnv) (string, error) {
+//DeleteRealm deletes the realm of the DevEnv. In a shared realm only the group of the DevEnv is deleted
+func (r *OAUTHProvider) DeleteRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) error {
 	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL)
-	TRUE := true
-	FALSE := false
-
-	protocol := "openid-connect"
-	url := "https://" + r.ingressHost
 
-	client := gocloak.NewClient(r.oauthURL)
-	ctx := context.Background()
-	token, err := client.LoginAdmin(ctx, r.oauthAdminName, r.oauthAdminPassword, r.oauthAdminRealm)
+	client, token, err := r.login(ctx)
 	if err != nil {
 		reqLogger.Error(err, "Failed to connect to Keycloak.")
-		return "", err
+		return err
 	}
 
-	c := gocloak.Client{
-		ClientID:            &r.oauthClientID,
-		Name:                &r.oauthClientID,
-		RootURL:             &url,
-		RedirectURIs:        &[]string{"*"},
-		Enabled:             &TRUE,
-		Protocol:            &protocol,
-		PublicClient:        &FALSE,
-		StandardFlowEnabled: &TRUE,
+	if r.isShared() {
+		return r.deleteGroup(ctx, client, token, r.resourceName)
 	}
 
-	_, err = client.CreateClient(ctx, token.AccessToken, r.resourceName, c)
-	if err != nil && !strings.Contains(err.Error(), "409") {
-		reqLogger.Error(err, "Failed to createClient.")
-		return "", err
+	err = client.DeleteRealm(ctx, token.AccessToken, r.resourceName)
+	if err != nil && !isNotFound(err) {
+		reqLogger.Error(err, "Failed to delete Realm.")
+		return err
+	}
+	return nil
+}
+
+// deleteGroup deletes the group with the given name in the shared realm, if there is one
+func (r *OAUTHProvider) deleteGroup(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT, name string) error {
+	groups, err := client.GetGroups(ctx, token.AccessToken, r.sharedRealm, gocloak.GetGroupsParams{Search: &name})
+	if isNotFound(err) {
+		return nil // the realm is gone
+	} else if err != nil {
+		r.log.Error(err, "Failed to get groups.", "Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.sharedRealm)
+		return err
+	}
+	for _, g := range groups {
+		if g.Name == nil || *g.Name != name {
+			continue
+		}
+		err = client.DeleteGroup(ctx, token.AccessToken, r.sharedRealm, *g.ID)
+		if err != nil && !isNotFound(err) {
+			r.log.Error(err, "Failed to delete group.", "Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.sharedRealm)
+			return err
+		}
 	}
+	return nil
+}
 
-	clients, err := client.GetClients(ctx,
-		token.AccessToken,
-		r.resourceName,
-		gocloak.GetClientsParams{
-			ClientID: &r.oauthClientID,
-		},
-	)
+// getGroup returns the group of the DevEnv in the shared realm, nil if there is none
+func (r *OAUTHProvider) getGroup(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT) (*gocloak.Group, error) {
+	groups, err := client.GetGroups(ctx, token.AccessToken, r.sharedRealm, gocloak.GetGroupsParams{Search: &r.resourceName})
+	if err != nil {
+		r.log.Error(err, "Failed to get groups.", "Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.sharedRealm)
+		return nil, err
+	}
+	for _, g := range groups {
+		if g.Name != nil && *g.Name == r.resourceName {
+			return g, nil
+		}
+	}
+	return nil, nil
+}
 
-	if len(clients) == 0 {
-		return "", nil // reconsile
+// ensureGroup creates the group of the DevEnv in the shared realm and returns its id
+func (r *OAUTHProvider) ensureGroup(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT) (string, error) {
+	group, err := r.getGroup(ctx, client, token)
+	if err != nil {
+		return "", err
+	}
+	if group != nil {
+		return *group.ID, nil
 	}
 
-	repr, err := client.GetClientSecret(ctx, token.AccessToken, r.resourceName, *clients[0].ID)
+	id, err := client.CreateGroup(ctx, token.AccessToken, r.sharedRealm, gocloak.Group{Name: &r.resourceName})
 	if err != nil {
-		reqLogger.Error(err, "Failed to get client secret.")
+		r.log.Error(err, "Failed to create group.", "Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.sharedRealm)
+		return "", err
 	}
-	return *repr.Value, nil
+	return id, nil
 }
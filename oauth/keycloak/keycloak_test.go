@@ -0,0 +1,397 @@
+package keycloak
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"github.com/Nerzal/gocloak/v7"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func newTestProvider(k *fakeKeycloak, realmMode, devenv string) *OAUTHProvider {
+	return NewKeycloakOAUTHProvider(&oauth.OAUTHProviderConfig{
+		Log:                logf.NullLogger{},
+		OauthURL:           k.URL,
+		OauthAdminName:     "admin",
+		OauthAdminPassword: "admin",
+		OauthAdminRealm:    "master",
+		OauthRealmMode:     realmMode,
+		OauthSharedRealm:   "cnde",
+		OauthClientID:      "c-n-d-e",
+		Timeout:            5 * time.Second,
+		DevEnvName:         devenv,
+		ResourceName:       "cnde-" + devenv,
+		IngressHost:        devenv + ".example.com",
+	})
+}
+
+func newTestDevEnv(name, email string) *cndev1alpha1.DevEnv {
+	return &cndev1alpha1.DevEnv{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       cndev1alpha1.DevEnvSpec{UserEmail: email, UserEnvDomain: "example.com"},
+	}
+}
+
+func testPassword(ctx context.Context, username string) (string, error) {
+	return "pw-" + username, nil
+}
+
+// addSharedRealm adds the shared realm of newTestProvider, like the administrators of Keycloak do
+func addSharedRealm(k *fakeKeycloak) {
+	realm, enabled := "cnde", true
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.addRealm(gocloak.RealmRepresentation{ID: &realm, Realm: &realm, Enabled: &enabled})
+}
+
+func TestEnsurePerDevEnv(t *testing.T) {
+	k := newFakeKeycloak()
+	defer k.Close()
+	ctx := context.Background()
+	p := newTestProvider(k, oauth.RealmModePerDevEnv, "thedeep")
+	cr := newTestDevEnv("thedeep", "arthur@example.com")
+
+	if _, err := p.EnsureRealm(ctx, cr); err != nil {
+		t.Fatalf("EnsureRealm: %v", err)
+	}
+	if secret, err := p.EnsureClient(ctx, cr); err != nil || secret != "" {
+		t.Fatalf("EnsureClient of a new client = %q, %v, want empty secret", secret, err)
+	}
+	secret, err := p.EnsureClient(ctx, cr)
+	if err != nil || secret == "" {
+		t.Fatalf("EnsureClient = %q, %v, want the secret", secret, err)
+	}
+	id, err := p.EnsureUser(ctx, cr, testPassword)
+	if err != nil {
+		t.Fatalf("EnsureUser: %v", err)
+	}
+	if pw := k.realm("cnde-thedeep").passwords[id]; pw != "pw-thedeep" {
+		t.Errorf("password of user = %q, want pw-thedeep", pw)
+	}
+
+	if _, err = p.GetRealm(ctx, cr); err != nil {
+		t.Errorf("GetRealm: %v", err)
+	}
+	if s, err := p.GetClient(ctx, cr); err != nil || s != secret {
+		t.Errorf("GetClient = %q, %v, want %q", s, err, secret)
+	}
+	if _, err = p.GetUser(ctx, cr); err != nil {
+		t.Errorf("GetUser: %v", err)
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	k := newFakeKeycloak()
+	defer k.Close()
+	ctx := context.Background()
+	p := newTestProvider(k, oauth.RealmModePerDevEnv, "thedeep")
+	cr := newTestDevEnv("thedeep", "arthur@example.com")
+
+	if _, err := p.GetRealm(ctx, cr); !oauth.IsNotFound(err) {
+		t.Errorf("GetRealm of a missing realm = %v, want NotFoundError", err)
+	}
+	if k.requested(http.MethodPost, "admin/realms") != 0 {
+		t.Errorf("GetRealm created the realm")
+	}
+
+	if _, err := p.EnsureRealm(ctx, cr); err != nil {
+		t.Fatalf("EnsureRealm: %v", err)
+	}
+	if _, err := p.GetClient(ctx, cr); !oauth.IsNotFound(err) {
+		t.Errorf("GetClient of a missing client = %v, want NotFoundError", err)
+	}
+	if _, err := p.GetUser(ctx, cr); !oauth.IsNotFound(err) {
+		t.Errorf("GetUser of a missing user = %v, want NotFoundError", err)
+	}
+}
+
+func TestClientDrift(t *testing.T) {
+	k := newFakeKeycloak()
+	defer k.Close()
+	ctx := context.Background()
+	p := newTestProvider(k, oauth.RealmModePerDevEnv, "thedeep")
+	cr := newTestDevEnv("thedeep", "arthur@example.com")
+
+	if _, err := p.EnsureRealm(ctx, cr); err != nil {
+		t.Fatalf("EnsureRealm: %v", err)
+	}
+	if _, err := p.EnsureClient(ctx, cr); err != nil {
+		t.Fatalf("EnsureClient: %v", err)
+	}
+
+	wrong := "https://elsewhere.example.com"
+	for _, c := range k.realm("cnde-thedeep").clients {
+		c.RootURL = &wrong
+	}
+	if _, err := p.GetClient(ctx, cr); !oauth.IsDrift(err) {
+		t.Fatalf("GetClient of a drifted client = %v, want DriftError", err)
+	}
+	if _, err := p.EnsureClient(ctx, cr); err != nil {
+		t.Fatalf("EnsureClient: %v", err)
+	}
+	if _, err := p.GetClient(ctx, cr); err != nil {
+		t.Errorf("GetClient of the repaired client: %v", err)
+	}
+}
+
+func TestConflict(t *testing.T) {
+	k := newFakeKeycloak()
+	defer k.Close()
+	ctx := context.Background()
+	p := newTestProvider(k, oauth.RealmModePerDevEnv, "thedeep")
+	cr := newTestDevEnv("thedeep", "arthur@example.com")
+
+	// the realm was created concurrently after it was not found
+	k.fail(http.MethodPost, "admin/realms", http.StatusConflict)
+	if _, err := p.EnsureRealm(ctx, cr); err == nil || oauth.IsNotFound(err) {
+		t.Errorf("EnsureRealm with conflict = %v, want error", err)
+	}
+
+	k.fail(http.MethodPost, "admin/realms", 0)
+	if _, err := p.EnsureRealm(ctx, cr); err != nil {
+		t.Fatalf("EnsureRealm: %v", err)
+	}
+	k.fail(http.MethodPost, "admin/realms/cnde-thedeep/users", http.StatusConflict)
+	if _, err := p.EnsureUser(ctx, cr, testPassword); err == nil {
+		t.Errorf("EnsureUser with conflict succeeded")
+	}
+}
+
+func TestServerError(t *testing.T) {
+	k := newFakeKeycloak()
+	defer k.Close()
+	ctx := context.Background()
+	p := newTestProvider(k, oauth.RealmModePerDevEnv, "thedeep")
+	cr := newTestDevEnv("thedeep", "arthur@example.com")
+
+	k.fail(http.MethodGet, "admin/realms/cnde-thedeep", http.StatusInternalServerError)
+	if _, err := p.EnsureRealm(ctx, cr); err == nil || oauth.IsNotFound(err) {
+		t.Errorf("EnsureRealm with server error = %v, want error", err)
+	}
+	if k.requested(http.MethodPost, "admin/realms") != 0 {
+		t.Errorf("EnsureRealm created the realm although getting it failed")
+	}
+
+	k.fail(http.MethodPost, "realms/master/protocol/openid-connect/token", http.StatusUnauthorized)
+	p = newTestProvider(k, oauth.RealmModePerDevEnv, "other")
+	p.oauthAdminName = "other-admin" // a session of its own
+	if _, err := p.EnsureRealm(ctx, newTestDevEnv("other", "ford@example.com")); err == nil {
+		t.Errorf("EnsureRealm with failed login succeeded")
+	}
+}
+
+func TestDeleteMissing(t *testing.T) {
+	k := newFakeKeycloak()
+	defer k.Close()
+	ctx := context.Background()
+	cr := newTestDevEnv("thedeep", "arthur@example.com")
+
+	for _, mode := range []string{oauth.RealmModePerDevEnv, oauth.RealmModeShared} {
+		p := newTestProvider(k, mode, "thedeep")
+		if err := p.DeleteUser(ctx, cr); err != nil {
+			t.Errorf("%s: DeleteUser of a missing realm: %v", mode, err)
+		}
+		if err := p.DeleteClient(ctx, cr); err != nil {
+			t.Errorf("%s: DeleteClient of a missing realm: %v", mode, err)
+		}
+		if err := p.DeleteRealm(ctx, cr); err != nil {
+			t.Errorf("%s: DeleteRealm of a missing realm: %v", mode, err)
+		}
+	}
+}
+
+func TestSharedRealm(t *testing.T) {
+	k := newFakeKeycloak()
+	defer k.Close()
+	ctx := context.Background()
+	p := newTestProvider(k, oauth.RealmModeShared, "thedeep")
+	cr := newTestDevEnv("thedeep", "arthur@example.com")
+
+	if _, err := p.EnsureRealm(ctx, cr); !oauth.IsNotFound(err) {
+		t.Errorf("EnsureRealm of a missing shared realm = %v, want NotFoundError", err)
+	}
+	if k.requested(http.MethodPost, "admin/realms") != 0 {
+		t.Errorf("EnsureRealm created the shared realm")
+	}
+
+	// settings of the shared realm differing from the RealmPolicy are kept
+	addSharedRealm(k)
+	if name, err := p.EnsureRealm(ctx, cr); err != nil || name != "cnde" {
+		t.Fatalf("EnsureRealm = %q, %v, want the shared realm", name, err)
+	}
+	if _, err := p.GetRealm(ctx, cr); err != nil {
+		t.Errorf("GetRealm: %v", err)
+	}
+	if k.requested(http.MethodPut, "admin/realms/cnde") != 0 {
+		t.Errorf("EnsureRealm updated the shared realm")
+	}
+
+	// by opt-in the RealmPolicy applies to the shared realm
+	p.policy = &oauth.RealmPolicy{AccessTokenLifespan: metav1.Duration{Duration: 8 * time.Hour}, ApplyToSharedRealm: true}
+	if _, err := p.GetRealm(ctx, cr); !oauth.IsDrift(err) {
+		t.Errorf("GetRealm of a shared realm differing from the RealmPolicy = %v, want DriftError", err)
+	}
+	if _, err := p.EnsureRealm(ctx, cr); err != nil {
+		t.Fatalf("EnsureRealm: %v", err)
+	}
+	rep := k.realm("cnde").rep
+	if rep.AccessTokenLifespan == nil || *rep.AccessTokenLifespan != 8*60*60 {
+		t.Errorf("accessTokenLifespan of the shared realm = %v, want 8h", rep.AccessTokenLifespan)
+	}
+	if rep.ID == nil || *rep.ID != "cnde" {
+		t.Errorf("id of the shared realm = %v, want it kept", rep.ID)
+	}
+}
+
+func TestSharedDeleteUser(t *testing.T) {
+	k := newFakeKeycloak()
+	defer k.Close()
+	ctx := context.Background()
+
+	a, b := newTestDevEnv("a", "arthur@example.com"), newTestDevEnv("b", "Arthur@example.com")
+	addSharedRealm(k)
+	pa, pb := newTestProvider(k, oauth.RealmModeShared, "a"), newTestProvider(k, oauth.RealmModeShared, "b")
+	for _, c := range []struct {
+		p  *OAUTHProvider
+		cr *cndev1alpha1.DevEnv
+	}{{pa, a}, {pb, b}} {
+		if _, err := c.p.EnsureRealm(ctx, c.cr); err != nil {
+			t.Fatalf("EnsureRealm: %v", err)
+		}
+		if _, err := c.p.EnsureClient(ctx, c.cr); err != nil {
+			t.Fatalf("EnsureClient: %v", err)
+		}
+		if _, err := c.p.EnsureUser(ctx, c.cr, testPassword); err != nil {
+			t.Fatalf("EnsureUser: %v", err)
+		}
+	}
+	if n := len(k.realm("cnde").users); n != 1 {
+		t.Fatalf("%d users in the shared realm, want 1", n)
+	}
+
+	for _, del := range []func(context.Context, *cndev1alpha1.DevEnv) error{pa.DeleteUser, pa.DeleteClient, pa.DeleteRealm} {
+		if err := del(ctx, a); err != nil {
+			t.Fatalf("deleting DevEnv a: %v", err)
+		}
+	}
+	if _, err := pb.GetUser(ctx, b); err != nil {
+		t.Errorf("user of DevEnv b after deleting a: %v", err)
+	}
+	if _, err := pb.GetClient(ctx, b); err != nil {
+		t.Errorf("client of DevEnv b after deleting a: %v", err)
+	}
+
+	if err := pb.DeleteUser(ctx, b); err != nil {
+		t.Fatalf("DeleteUser of b: %v", err)
+	}
+	if n := len(k.realm("cnde").users); n != 0 {
+		t.Errorf("%d users in the shared realm after deleting all DevEnvs, want 0", n)
+	}
+}
+
+func TestListTagged(t *testing.T) {
+	k := newFakeKeycloak()
+	defer k.Close()
+	ctx := context.Background()
+	p := newTestProvider(k, oauth.RealmModePerDevEnv, "thedeep")
+	cr := newTestDevEnv("thedeep", "arthur@example.com")
+
+	if _, err := p.EnsureRealm(ctx, cr); err != nil {
+		t.Fatalf("EnsureRealm: %v", err)
+	}
+	tagged, err := p.ListTagged(ctx)
+	if err != nil {
+		t.Fatalf("ListTagged: %v", err)
+	}
+	if len(tagged) != 1 || tagged[0].Kind != "Realm" || tagged[0].DevEnv != "thedeep" {
+		t.Fatalf("ListTagged = %+v, want the realm of thedeep", tagged)
+	}
+	if err = p.DeleteTagged(ctx, tagged[0]); err != nil {
+		t.Fatalf("DeleteTagged: %v", err)
+	}
+	if k.realm("cnde-thedeep") != nil {
+		t.Errorf("realm still exists after DeleteTagged")
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	s := sessionFor("https://keycloak.example.com", "admin", "master", 5*time.Second)
+	if sessionFor("https://keycloak.example.com", "admin", "master", 5*time.Second) != s {
+		t.Errorf("sessionFor created a second session for the same timeout")
+	}
+	changed := sessionFor("https://keycloak.example.com", "admin", "master", 30*time.Second)
+	if changed == s {
+		t.Fatalf("sessionFor returned the session of a former timeout")
+	}
+	if timeout := changed.client.RestyClient().GetClient().Timeout; timeout != 30*time.Second {
+		t.Errorf("timeout of the session = %v, want 30s", timeout)
+	}
+}
+
+func TestEnsureUserPasswordFailure(t *testing.T) {
+	k := newFakeKeycloak()
+	defer k.Close()
+	ctx := context.Background()
+	p := newTestProvider(k, oauth.RealmModePerDevEnv, "thedeep")
+	cr := newTestDevEnv("thedeep", "arthur@example.com")
+
+	if _, err := p.EnsureRealm(ctx, cr); err != nil {
+		t.Fatalf("EnsureRealm: %v", err)
+	}
+	// setting the password of the new user fails once, the user must not be left without password
+	resetPassword := "admin/realms/cnde-thedeep/users/id-1/reset-password"
+	k.fail(http.MethodPut, resetPassword, http.StatusInternalServerError)
+	id, err := p.EnsureUser(ctx, cr, testPassword)
+	if err != nil || id != "id-1" {
+		t.Fatalf("EnsureUser = %q, %v, want the new user id-1", id, err)
+	}
+	k.fail(http.MethodPut, resetPassword, 0)
+	if pw := k.realm("cnde-thedeep").passwords[id]; pw != "pw-thedeep" {
+		t.Errorf("password of user = %q, want pw-thedeep", pw)
+	}
+
+	failing := func(ctx context.Context, username string) (string, error) {
+		t.Errorf("password of an existing user requested")
+		return "", nil
+	}
+	if got, err := p.EnsureUser(ctx, cr, failing); err != nil || got != id {
+		t.Errorf("EnsureUser of the existing user = %q, %v, want %q", got, err, id)
+	}
+}
+
+func TestSharedDeleteUserOfOthers(t *testing.T) {
+	k := newFakeKeycloak()
+	defer k.Close()
+	ctx := context.Background()
+	addSharedRealm(k)
+	p := newTestProvider(k, oauth.RealmModeShared, "thedeep")
+	cr := newTestDevEnv("thedeep", "arthur@example.com")
+
+	if _, err := p.EnsureRealm(ctx, cr); err != nil {
+		t.Fatalf("EnsureRealm: %v", err)
+	}
+	// the user exists before the DevEnv, e.g. synchronized from LDAP, it is untagged
+	name, email, enabled := "arthur@example.com", "arthur@example.com", true
+	id := k.addUser("cnde", gocloak.User{Username: &name, Email: &email, Enabled: &enabled})
+	if got, err := p.EnsureUser(ctx, cr, testPassword); err != nil || got != id {
+		t.Fatalf("EnsureUser = %q, %v, want the existing user %q", got, err, id)
+	}
+	if len(k.realm("cnde").members[id]) != 1 {
+		t.Fatalf("existing user is no member of the group of the DevEnv")
+	}
+
+	if err := p.DeleteUser(ctx, cr); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, ok := k.realm("cnde").users[id]; !ok {
+		t.Fatalf("DeleteUser deleted a user the operator did not create")
+	}
+	if len(k.realm("cnde").members[id]) != 0 {
+		t.Errorf("user is still member of the group of the deleted DevEnv")
+	}
+}
@@ -0,0 +1,165 @@
+package keycloak
+
+import (
+	"context"
+	"strings"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"github.com/Nerzal/gocloak/v7"
+)
+
+//DeleteUser deletes the users of the owner and the collaborators. In a shared realm users are removed from the group of the DevEnv
+//and deleted only if the operator created them for this DevEnv or a collaborator and they are no member of any other group,
+//i.e. no other DevEnv uses them. Users of others, e.g. from SSO or LDAP, only lose the membership
+func (r *OAUTHProvider) DeleteUser(ctx context.Context, cr *cndev1alpha1.DevEnv) error {
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+
+	client, token, err := r.login(ctx)
+	if err != nil {
+		reqLogger.Error(err, "Failed to connect to Keycloak.")
+		return err
+	}
+
+	names := []string{r.userName(cr)}
+	for _, c := range cr.Spec.Collaborators {
+		names = append(names, strings.ToLower(c.Email))
+	}
+
+	var group *gocloak.Group
+	if r.isShared() {
+		group, err = r.getGroup(ctx, client, token)
+		if isNotFound(err) {
+			return nil // the realm is gone
+		} else if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		user, err := r.findUser(ctx, client, token, name)
+		if isNotFound(err) {
+			return nil // the realm is gone
+		} else if err != nil {
+			return err
+		}
+		if user == nil {
+			continue
+		}
+
+		if r.isShared() {
+			if group != nil {
+				err = client.DeleteUserFromGroup(ctx, token.AccessToken, r.sharedRealm, *user.ID, *group.ID)
+				if err != nil && !isNotFound(err) {
+					reqLogger.Error(err, "Failed to remove user from group.")
+					return err
+				}
+			}
+			groups, err := client.GetUserGroups(ctx, token.AccessToken, r.sharedRealm, *user.ID, gocloak.GetGroupsParams{})
+			if err != nil {
+				reqLogger.Error(err, "Failed to get groups of user.")
+				return err
+			}
+			if len(groups) > 0 {
+				continue // used by other DevEnvs
+			}
+			if !r.ownsUser(user) {
+				reqLogger.Info("Keeping user the operator did not create for the DevEnv.", "User", name)
+				continue
+			}
+		}
+
+		reqLogger.Info("Deleting user.", "User", name)
+		err = client.DeleteUser(ctx, token.AccessToken, r.realm(), *user.ID)
+		if err != nil && !isNotFound(err) {
+			reqLogger.Error(err, "Failed to delete user.")
+			return err
+		}
+	}
+	return nil
+}
+
+//ListTagged returns the realms of DevEnvs, in a shared realm the clients and users of DevEnvs
+func (r *OAUTHProvider) ListTagged(ctx context.Context) ([]oauth.TaggedObject, error) {
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL)
+
+	client, token, err := r.login(ctx)
+	if err != nil {
+		reqLogger.Error(err, "Failed to connect to Keycloak.")
+		return nil, err
+	}
+
+	var tagged []oauth.TaggedObject
+	if !r.isShared() {
+		realms, err := client.GetRealms(ctx, token.AccessToken)
+		if err != nil {
+			reqLogger.Error(err, "Failed to get realms.")
+			return nil, err
+		}
+		for _, rp := range realms {
+			if rp.Realm == nil || rp.Attributes == nil || (*rp.Attributes)[oauth.DevEnvTag] == "" {
+				continue
+			}
+			tagged = append(tagged, oauth.TaggedObject{Kind: "Realm", Name: *rp.Realm, ID: *rp.Realm, DevEnv: (*rp.Attributes)[oauth.DevEnvTag]})
+		}
+		return tagged, nil
+	}
+
+	clients, err := client.GetClients(ctx, token.AccessToken, r.sharedRealm, gocloak.GetClientsParams{})
+	if err != nil {
+		reqLogger.Error(err, "Failed to get clients.")
+		return nil, err
+	}
+	for _, c := range clients {
+		if c.ClientID == nil || c.Attributes == nil || (*c.Attributes)[oauth.DevEnvTag] == "" {
+			continue
+		}
+		tagged = append(tagged, oauth.TaggedObject{Kind: "Client", Name: *c.ClientID, ID: *c.ID, DevEnv: (*c.Attributes)[oauth.DevEnvTag]})
+	}
+
+	max := listMax
+	users, err := client.GetUsers(ctx, token.AccessToken, r.sharedRealm, gocloak.GetUsersParams{Max: &max})
+	if err != nil {
+		reqLogger.Error(err, "Failed to get users.")
+		return nil, err
+	}
+	for _, u := range users {
+		if u.Username == nil || u.Attributes == nil || len((*u.Attributes)[oauth.DevEnvTag]) == 0 {
+			continue
+		}
+		obj := oauth.TaggedObject{Kind: "User", Name: *u.Username, ID: *u.ID, DevEnv: (*u.Attributes)[oauth.DevEnvTag][0]}
+		if u.Email != nil {
+			obj.Email = *u.Email
+		}
+		tagged = append(tagged, obj)
+	}
+	return tagged, nil
+}
+
+//DeleteTagged deletes a realm, or a client and its group, or a user returned by ListTagged
+func (r *OAUTHProvider) DeleteTagged(ctx context.Context, obj oauth.TaggedObject) error {
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL, "Kind", obj.Kind, "Name", obj.Name)
+
+	client, token, err := r.login(ctx)
+	if err != nil {
+		reqLogger.Error(err, "Failed to connect to Keycloak.")
+		return err
+	}
+
+	switch obj.Kind {
+	case "Realm":
+		err = client.DeleteRealm(ctx, token.AccessToken, obj.ID)
+	case "Client":
+		err = client.DeleteClient(ctx, token.AccessToken, r.sharedRealm, obj.ID)
+		if err == nil || isNotFound(err) {
+			err = r.deleteGroup(ctx, client, token, obj.Name)
+		}
+	case "User":
+		err = client.DeleteUser(ctx, token.AccessToken, r.sharedRealm, obj.ID)
+	}
+	if err != nil && !isNotFound(err) {
+		reqLogger.Error(err, "Failed to delete tagged object.")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package keycloak
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/Nerzal/gocloak/v7"
+)
+
+// fakeRealm is the state of a realm in the fakeKeycloak
+type fakeRealm struct {
+	rep       gocloak.RealmRepresentation
+	clients   map[string]*gocloak.Client
+	secrets   map[string]string
+	users     map[string]*gocloak.User
+	passwords map[string]string
+	groups    map[string]*gocloak.Group
+	// members maps user ids to the ids of their groups
+	members map[string]map[string]bool
+}
+
+// fakeKeycloak is an in-memory stand-in for the parts of the Keycloak admin API the provider uses.
+// Like Keycloak it answers 404 for unknown realms and objects and 409 for duplicates.
+type fakeKeycloak struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	realms map[string]*fakeRealm
+	nextID int
+	// failures maps "METHOD path" to the status the request is answered with, path is relative to /auth/
+	failures map[string]int
+	requests []string
+}
+
+// newFakeKeycloak starts a fakeKeycloak, the caller closes it
+func newFakeKeycloak() *fakeKeycloak {
+	k := &fakeKeycloak{realms: map[string]*fakeRealm{}, failures: map[string]int{}}
+	k.Server = httptest.NewServer(http.HandlerFunc(k.serveHTTP))
+	return k
+}
+
+// fail answers requests with the given method and path, e.g. "admin/realms/thedeep/users", with status.
+// Status 0 serves them again
+func (k *fakeKeycloak) fail(method, path string, status int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if status == 0 {
+		delete(k.failures, method+" "+path)
+		return
+	}
+	k.failures[method+" "+path] = status
+}
+
+// requested reports how often a request with the given method and path was served
+func (k *fakeKeycloak) requested(method, path string) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	n := 0
+	for _, r := range k.requests {
+		if r == method+" "+path {
+			n++
+		}
+	}
+	return n
+}
+
+func (k *fakeKeycloak) realm(name string) *fakeRealm {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.realms[name]
+}
+
+func (k *fakeKeycloak) id() string {
+	k.nextID++
+	return fmt.Sprintf("id-%d", k.nextID)
+}
+
+func (k *fakeKeycloak) addRealm(rep gocloak.RealmRepresentation) {
+	k.realms[*rep.Realm] = &fakeRealm{
+		rep:       rep,
+		clients:   map[string]*gocloak.Client{},
+		secrets:   map[string]string{},
+		users:     map[string]*gocloak.User{},
+		passwords: map[string]string{},
+		groups:    map[string]*gocloak.Group{},
+		members:   map[string]map[string]bool{},
+	}
+}
+
+// addUser adds a user created by others, e.g. by SSO or LDAP, to the realm and returns its id
+func (k *fakeKeycloak) addUser(realm string, u gocloak.User) string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	id := k.id()
+	u.ID = &id
+	k.realms[realm].users[id] = &u
+	k.realms[realm].members[id] = map[string]bool{}
+	return id
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (k *fakeKeycloak) created(w http.ResponseWriter, req *http.Request, id string) {
+	w.Header().Set("Location", k.URL+req.URL.Path+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (k *fakeKeycloak) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/auth/"), "/")
+	k.requests = append(k.requests, req.Method+" "+path)
+	if status, ok := k.failures[req.Method+" "+path]; ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	p := strings.Split(path, "/")
+	switch {
+	case len(p) == 5 && p[0] == "realms" && p[4] == "token":
+		writeJSON(w, gocloak.JWT{AccessToken: "token", ExpiresIn: 300, RefreshToken: "refresh", RefreshExpiresIn: 1800})
+	case len(p) >= 2 && p[0] == "admin" && p[1] == "realms":
+		k.serveAdmin(w, req, p[2:])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (k *fakeKeycloak) serveAdmin(w http.ResponseWriter, req *http.Request, p []string) {
+	if len(p) == 0 {
+		switch req.Method {
+		case http.MethodGet:
+			list := []gocloak.RealmRepresentation{}
+			for _, r := range k.realms {
+				list = append(list, r.rep)
+			}
+			writeJSON(w, list)
+		case http.MethodPost:
+			var rep gocloak.RealmRepresentation
+			_ = json.NewDecoder(req.Body).Decode(&rep)
+			if _, ok := k.realms[*rep.Realm]; ok {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			k.addRealm(rep)
+			k.created(w, req, *rep.Realm)
+		}
+		return
+	}
+
+	realm, ok := k.realms[p[0]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(p) == 1 {
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, realm.rep)
+		case http.MethodPut:
+			_ = json.NewDecoder(req.Body).Decode(&realm.rep)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			delete(k.realms, p[0])
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	switch p[1] {
+	case "clients":
+		k.serveClients(w, req, realm, p[2:])
+	case "users":
+		k.serveUsers(w, req, realm, p[2:])
+	case "groups":
+		k.serveGroups(w, req, realm, p[2:])
+	case "identity-provider":
+		writeJSON(w, []interface{}{})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (k *fakeKeycloak) serveClients(w http.ResponseWriter, req *http.Request, realm *fakeRealm, p []string) {
+	if len(p) == 0 {
+		switch req.Method {
+		case http.MethodGet:
+			clientID := req.URL.Query().Get("clientId")
+			list := []*gocloak.Client{}
+			for _, c := range realm.clients {
+				if clientID == "" || *c.ClientID == clientID {
+					list = append(list, c)
+				}
+			}
+			writeJSON(w, list)
+		case http.MethodPost:
+			c := &gocloak.Client{}
+			_ = json.NewDecoder(req.Body).Decode(c)
+			for _, e := range realm.clients {
+				if *e.ClientID == *c.ClientID {
+					w.WriteHeader(http.StatusConflict)
+					return
+				}
+			}
+			id := k.id()
+			c.ID = &id
+			realm.clients[id] = c
+			realm.secrets[id] = "secret-" + id
+			k.created(w, req, id)
+		}
+		return
+	}
+
+	c, ok := realm.clients[p[0]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(p) == 1 && req.Method == http.MethodGet:
+		writeJSON(w, c)
+	case len(p) == 1 && req.Method == http.MethodPut:
+		_ = json.NewDecoder(req.Body).Decode(c)
+		w.WriteHeader(http.StatusNoContent)
+	case len(p) == 1 && req.Method == http.MethodDelete:
+		delete(realm.clients, p[0])
+		w.WriteHeader(http.StatusNoContent)
+	case len(p) == 2 && p[1] == "client-secret":
+		if req.Method == http.MethodPost {
+			realm.secrets[p[0]] = realm.secrets[p[0]] + "-rotated"
+		}
+		value := realm.secrets[p[0]]
+		writeJSON(w, gocloak.CredentialRepresentation{Value: &value})
+	case len(p) == 3 && p[1] == "protocol-mappers":
+		var m gocloak.ProtocolMapperRepresentation
+		_ = json.NewDecoder(req.Body).Decode(&m)
+		mappers := []gocloak.ProtocolMapperRepresentation{m}
+		if c.ProtocolMappers != nil {
+			mappers = append(*c.ProtocolMappers, m)
+		}
+		c.ProtocolMappers = &mappers
+		k.created(w, req, k.id())
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (k *fakeKeycloak) serveUsers(w http.ResponseWriter, req *http.Request, realm *fakeRealm, p []string) {
+	if len(p) == 0 {
+		switch req.Method {
+		case http.MethodGet:
+			// like Keycloak username and email are searched for substrings
+			username := strings.ToLower(req.URL.Query().Get("username"))
+			email := strings.ToLower(req.URL.Query().Get("email"))
+			list := []*gocloak.User{}
+			for _, u := range realm.users {
+				if username != "" && !strings.Contains(*u.Username, username) {
+					continue
+				}
+				if email != "" && (u.Email == nil || !strings.Contains(strings.ToLower(*u.Email), email)) {
+					continue
+				}
+				list = append(list, u)
+			}
+			writeJSON(w, list)
+		case http.MethodPost:
+			u := &gocloak.User{}
+			_ = json.NewDecoder(req.Body).Decode(u)
+			name := strings.ToLower(*u.Username)
+			for _, e := range realm.users {
+				if *e.Username == name {
+					w.WriteHeader(http.StatusConflict)
+					return
+				}
+			}
+			id := k.id()
+			u.ID = &id
+			u.Username = &name
+			// like Keycloak the password of the credentials is set, they are not returned
+			if u.Credentials != nil {
+				for _, c := range *u.Credentials {
+					if c.Type != nil && *c.Type == "password" && c.Value != nil {
+						realm.passwords[id] = *c.Value
+					}
+				}
+				u.Credentials = nil
+			}
+			realm.users[id] = u
+			realm.members[id] = map[string]bool{}
+			k.created(w, req, id)
+		}
+		return
+	}
+
+	u, ok := realm.users[p[0]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(p) == 1 && req.Method == http.MethodGet:
+		writeJSON(w, u)
+	case len(p) == 1 && req.Method == http.MethodPut:
+		_ = json.NewDecoder(req.Body).Decode(u)
+		w.WriteHeader(http.StatusNoContent)
+	case len(p) == 1 && req.Method == http.MethodDelete:
+		delete(realm.users, p[0])
+		delete(realm.members, p[0])
+		w.WriteHeader(http.StatusNoContent)
+	case len(p) == 2 && p[1] == "reset-password":
+		var c gocloak.CredentialRepresentation
+		_ = json.NewDecoder(req.Body).Decode(&c)
+		realm.passwords[p[0]] = *c.Value
+		w.WriteHeader(http.StatusNoContent)
+	case len(p) == 2 && p[1] == "credentials":
+		writeJSON(w, []interface{}{})
+	case len(p) == 2 && p[1] == "groups":
+		list := []*gocloak.Group{}
+		for id := range realm.members[p[0]] {
+			list = append(list, realm.groups[id])
+		}
+		writeJSON(w, list)
+	case len(p) == 3 && p[1] == "groups":
+		if _, ok := realm.groups[p[2]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Method == http.MethodPut {
+			realm.members[p[0]][p[2]] = true
+		} else {
+			delete(realm.members[p[0]], p[2])
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (k *fakeKeycloak) serveGroups(w http.ResponseWriter, req *http.Request, realm *fakeRealm, p []string) {
+	if len(p) == 0 {
+		switch req.Method {
+		case http.MethodGet:
+			search := req.URL.Query().Get("search")
+			list := []*gocloak.Group{}
+			for _, g := range realm.groups {
+				if strings.Contains(*g.Name, search) {
+					list = append(list, g)
+				}
+			}
+			writeJSON(w, list)
+		case http.MethodPost:
+			g := &gocloak.Group{}
+			_ = json.NewDecoder(req.Body).Decode(g)
+			for _, e := range realm.groups {
+				if *e.Name == *g.Name {
+					w.WriteHeader(http.StatusConflict)
+					return
+				}
+			}
+			id := k.id()
+			g.ID = &id
+			realm.groups[id] = g
+			k.created(w, req, id)
+		}
+		return
+	}
+
+	if _, ok := realm.groups[p[0]]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(p) == 1 && req.Method == http.MethodDelete:
+		delete(realm.groups, p[0])
+		for _, groups := range realm.members {
+			delete(groups, p[0])
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(p) == 2 && p[1] == "members":
+		list := []*gocloak.User{}
+		for id, groups := range realm.members {
+			if groups[p[0]] {
+				list = append(list, realm.users[id])
+			}
+		}
+		writeJSON(w, list)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
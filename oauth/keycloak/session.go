@@ -0,0 +1,77 @@
+package keycloak
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Nerzal/gocloak/v7"
+)
+
+const (
+	// adminClientID is the client used by gocloak for admin logins
+	adminClientID = "admin-cli"
+	// expiryMargin is subtracted from the lifespan of tokens to refresh them before they expire
+	expiryMargin = 10 * time.Second
+)
+
+// adminSession holds a gocloak client and the admin token of one Keycloak instance.
+// Sessions are shared by all DevEnvs, so the operator logs in once instead of for every call.
+type adminSession struct {
+	mu             sync.Mutex
+	client         gocloak.GoCloak
+	token          *gocloak.JWT
+	expires        time.Time
+	refreshExpires time.Time
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = make(map[string]*adminSession)
+)
+
+// sessionFor returns the session for the given Keycloak instance, admin and request timeout, creating it if
+// needed. The timeout is part of the key, the client of a session is shared by concurrent calls.
+func sessionFor(url, adminName, adminRealm string, timeout time.Duration) *adminSession {
+	key := url + "|" + adminRealm + "|" + adminName + "|" + timeout.String()
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[key]
+	if !ok {
+		client := gocloak.NewClient(url)
+		client.RestyClient().SetTimeout(timeout)
+		s = &adminSession{client: client}
+		sessions[key] = s
+	}
+	return s
+}
+
+// accessToken returns a valid admin token, refreshing it or logging in again if the cached one expires
+func (s *adminSession) accessToken(ctx context.Context, adminName, adminPassword, adminRealm string) (*gocloak.JWT, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.token != nil && now.Before(s.expires) {
+		return s.token, nil
+	}
+
+	var token *gocloak.JWT
+	var err error
+	if s.token != nil && s.token.RefreshToken != "" && now.Before(s.refreshExpires) {
+		token, err = s.client.RefreshToken(ctx, s.token.RefreshToken, adminClientID, "", adminRealm)
+	}
+	if token == nil || err != nil {
+		token, err = s.client.LoginAdmin(ctx, adminName, adminPassword, adminRealm)
+		if err != nil {
+			s.token = nil
+			return nil, err
+		}
+	}
+
+	s.token = token
+	s.expires = now.Add(time.Duration(token.ExpiresIn)*time.Second - expiryMargin)
+	s.refreshExpires = now.Add(time.Duration(token.RefreshExpiresIn)*time.Second - expiryMargin)
+	return token, nil
+}
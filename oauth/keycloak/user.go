@@ -0,0 +1,270 @@
+package keycloak
+
+import (
+	"context"
+	"strings"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"github.com/Nerzal/gocloak/v7"
+)
+
+// configureOTPAction makes a user configure an OTP authenticator at the next login
+const configureOTPAction = "CONFIGURE_TOTP"
+
+// userName returns the name of the user of the DevEnv. In a shared realm users are keyed by email
+func (r *OAUTHProvider) userName(cr *cndev1alpha1.DevEnv) string {
+	if r.isShared() {
+		return strings.ToLower(cr.Spec.UserEmail)
+	}
+	return cr.Name
+}
+
+//EnsureUser creates the user of the DevEnv or repairs it. In a shared realm the user is keyed by email,
+//created once and added to the group of the DevEnv. With federation an existing user with the email of the DevEnv is used
+func (r *OAUTHProvider) EnsureUser(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc) (string, error) {
+	return r.reconcileUser(ctx, cr, password, true)
+}
+
+//GetUser verifies the user of the DevEnv
+func (r *OAUTHProvider) GetUser(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error) {
+	return r.reconcileUser(ctx, cr, nil, false)
+}
+
+//ResetPassword sets a new temporary password, the user has to change it at the next login
+func (r *OAUTHProvider) ResetPassword(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc) error {
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+
+	client, token, err := r.login(ctx)
+	if err != nil {
+		reqLogger.Error(err, "Failed to connect to Keycloak.")
+		return err
+	}
+
+	user, err := r.findUser(ctx, client, token, r.userName(cr))
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return &oauth.NotFoundError{Kind: "User", Name: r.userName(cr)}
+	}
+
+	pw, err := password(ctx, *user.Username)
+	if err != nil {
+		return err
+	}
+
+	err = client.SetPassword(ctx, token.AccessToken, *user.ID, r.realm(), pw, true)
+	if err != nil {
+		reqLogger.Error(err, "Failed to set password.")
+	}
+	return err
+}
+
+func (r *OAUTHProvider) reconcileUser(ctx context.Context, cr *cndev1alpha1.DevEnv, password oauth.PasswordFunc, repair bool) (string, error) {
+	reqLogger := r.log.WithValues("Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+	TRUE := true
+	realm := r.realm()
+	name := r.userName(cr)
+
+	client, token, err := r.login(ctx)
+	if err != nil {
+		reqLogger.Error(err, "Failed to connect to Keycloak.")
+		return "", err
+	}
+
+	user, err := r.findUser(ctx, client, token, name)
+	if err != nil {
+		return "", err
+	}
+	if user == nil && !r.federation.IsEmpty() {
+		// the user may come from a user federation or has logged in by an identity provider before
+		if user, err = r.findUserByEmail(ctx, client, token, cr.Spec.UserEmail); err != nil {
+			return "", err
+		}
+	}
+
+	if user == nil {
+		if !repair {
+			return "", &oauth.NotFoundError{Kind: "User", Name: name}
+		}
+		id, err := r.createUser(ctx, client, token, name, cr.Spec.UserEmail, nil, password)
+		if err != nil {
+			return "", err
+		}
+		return id, r.reconcileMembership(ctx, client, token, id, true)
+	}
+
+	if user.Enabled == nil || !*user.Enabled || user.Email == nil || !strings.EqualFold(*user.Email, cr.Spec.UserEmail) {
+		if !repair {
+			return "", &oauth.DriftError{Kind: "User", Name: name, Field: "enabled or email"}
+		}
+		reqLogger.Info("Repairing drifted User.", "User", name)
+		user.Enabled = &TRUE
+		user.Email = &cr.Spec.UserEmail
+		err = client.UpdateUser(ctx, token.AccessToken, realm, *user)
+		if err != nil {
+			reqLogger.Error(err, "Failed to update user.")
+			return "", err
+		}
+	}
+
+	if err = r.reconcileOTP(ctx, client, token, user, repair); err != nil {
+		return "", err
+	}
+
+	if repair && r.isShared() && isTagged(user) && !r.ownsUser(user) {
+		// the operator created the user for another DevEnv, tag it for this one too so it is deleted with
+		// the last of them
+		reqLogger.Info("Tagging user with the DevEnv.", "User", name)
+		attributes := *user.Attributes
+		attributes[oauth.DevEnvTag] = append(attributes[oauth.DevEnvTag], r.devEnvName)
+		if err = client.UpdateUser(ctx, token.AccessToken, realm, *user); err != nil {
+			reqLogger.Error(err, "Failed to update user.")
+			return "", err
+		}
+	}
+
+	return *user.ID, r.reconcileMembership(ctx, client, token, *user.ID, repair)
+}
+
+// reconcileOTP verifies users without OTP authenticator have to configure one, if the RealmPolicy requires OTP
+func (r *OAUTHProvider) reconcileOTP(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT, user *gocloak.User, repair bool) error {
+	if !r.policy.RequireOTP || !r.appliesPolicy() {
+		return nil
+	}
+	if user.RequiredActions != nil {
+		for _, a := range *user.RequiredActions {
+			if a == configureOTPAction {
+				return nil
+			}
+		}
+	}
+
+	credentials, err := client.GetCredentials(ctx, token.AccessToken, r.realm(), *user.ID)
+	if err != nil {
+		r.log.Error(err, "Failed to get credentials of user.", "Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+		return err
+	}
+	for _, c := range credentials {
+		if c.Type != nil && *c.Type == "otp" {
+			return nil
+		}
+	}
+	if !repair {
+		return &oauth.DriftError{Kind: "User", Name: *user.Username, Field: "requiredActions"}
+	}
+
+	r.log.Info("Requiring OTP of User.", "User", *user.Username)
+	actions := []string{configureOTPAction}
+	if user.RequiredActions != nil {
+		actions = append(*user.RequiredActions, configureOTPAction)
+	}
+	user.RequiredActions = &actions
+	err = client.UpdateUser(ctx, token.AccessToken, r.realm(), *user)
+	if err != nil {
+		r.log.Error(err, "Failed to update user.", "Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+	}
+	return err
+}
+
+// createUser creates an enabled user with a temporary password returned by password and returns its id. The
+// password is created with the user, a user without password could not log in and would never get one.
+func (r *OAUTHProvider) createUser(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT, name, email string, attributes map[string][]string, password oauth.PasswordFunc) (string, error) {
+	TRUE := true
+	if attributes == nil {
+		attributes = map[string][]string{}
+	}
+	attributes[oauth.DevEnvTag] = []string{r.devEnvName}
+	u := gocloak.User{
+		Username:      &name,
+		Enabled:       &TRUE,
+		Email:         &email,
+		EmailVerified: &TRUE,
+		Attributes:    &attributes,
+	}
+	if r.policy.RequireOTP && r.appliesPolicy() {
+		u.RequiredActions = &[]string{configureOTPAction}
+	}
+
+	pw, err := password(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	credentialType := "password"
+	u.Credentials = &[]gocloak.CredentialRepresentation{{Type: &credentialType, Value: &pw, Temporary: &TRUE}}
+	id, err := client.CreateUser(ctx, token.AccessToken, r.realm(), u)
+	if err != nil {
+		r.log.Error(err, "Failed to create user.", "Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+		return "", err
+	}
+	return id, nil
+}
+
+// isTagged reports whether the operator created the user for a DevEnv
+func isTagged(u *gocloak.User) bool {
+	return u.Attributes != nil && len((*u.Attributes)[oauth.DevEnvTag]) > 0
+}
+
+// ownsUser reports whether the operator created the user for a collaborator or it is tagged with the DevEnv
+func (r *OAUTHProvider) ownsUser(u *gocloak.User) bool {
+	if isCollaborator(u) {
+		return true
+	}
+	if u.Attributes == nil {
+		return false
+	}
+	for _, v := range (*u.Attributes)[oauth.DevEnvTag] {
+		if v == r.devEnvName {
+			return true
+		}
+	}
+	return false
+}
+
+// findUser returns the user with the given name, nil if there is none
+func (r *OAUTHProvider) findUser(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT, name string) (*gocloak.User, error) {
+	users, err := client.GetUsers(ctx, token.AccessToken, r.realm(), gocloak.GetUsersParams{Username: &name})
+	if err != nil {
+		r.log.Error(err, "Failed to get users.", "Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.realm())
+		return nil, err
+	}
+	for _, u := range users {
+		if u.Username != nil && strings.EqualFold(*u.Username, name) {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
+
+// reconcileMembership verifies the user is member of the group of the DevEnv in a shared realm
+func (r *OAUTHProvider) reconcileMembership(ctx context.Context, client gocloak.GoCloak, token *gocloak.JWT, user string, repair bool) error {
+	if !r.isShared() {
+		return nil
+	}
+
+	groups, err := client.GetUserGroups(ctx, token.AccessToken, r.sharedRealm, user, gocloak.GetGroupsParams{})
+	if err != nil {
+		r.log.Error(err, "Failed to get groups of user.", "Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.sharedRealm)
+		return err
+	}
+	for _, g := range groups {
+		if g.Name != nil && *g.Name == r.resourceName {
+			return nil
+		}
+	}
+	if !repair {
+		return &oauth.DriftError{Kind: "User", Name: user, Field: "group " + r.resourceName}
+	}
+
+	groupID, err := r.ensureGroup(ctx, client, token)
+	if err != nil {
+		return err
+	}
+	err = client.AddUserToGroup(ctx, token.AccessToken, r.sharedRealm, user, groupID)
+	if err != nil {
+		r.log.Error(err, "Failed to add user to group.", "Keycloak.URI", r.oauthURL, "Keycloak.Realm", r.sharedRealm)
+		return err
+	}
+	return nil
+}
@@ -1,17 +1,126 @@
 package oauth
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
 	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
 	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// OAUTHProvider manages realm, client and user of DevEnvs.
+// Ensure methods create missing objects and repair drifted ones. Get methods only verify them and
+// return a NotFoundError or DriftError if the provider does not match the DevEnv.
 type OAUTHProvider interface {
-	NewRealm(cr *cndev1alpha1.DevEnv) (string, error)
-	DeleteRealm(cr *cndev1alpha1.DevEnv) error
-	CreateUser(cr *cndev1alpha1.DevEnv) (string, error)
-	CreateClient(cr *cndev1alpha1.DevEnv) (string, error)
+	EnsureRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error)
+	GetRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error)
+	// DeleteRealm deletes the realm of the DevEnv, in a shared realm only what belongs to the DevEnv
+	DeleteRealm(ctx context.Context, cr *cndev1alpha1.DevEnv) error
+
+	// EnsureUser and GetUser return the id of the user. EnsureUser calls password for the
+	// initial password only if it creates the user
+	EnsureUser(ctx context.Context, cr *cndev1alpha1.DevEnv, password PasswordFunc) (string, error)
+	GetUser(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error)
+	// DeleteUser deletes the users of the owner and the collaborators of the DevEnv, unless other DevEnvs use them
+	DeleteUser(ctx context.Context, cr *cndev1alpha1.DevEnv) error
+	// ResetPassword sets a new temporary password, returned by password, for the user of the DevEnv
+	ResetPassword(ctx context.Context, cr *cndev1alpha1.DevEnv, password PasswordFunc) error
+	// EnsureCollaborators creates or links the users of the collaborators of the DevEnv and revokes the access of
+	// former ones. password is called for every user created
+	EnsureCollaborators(ctx context.Context, cr *cndev1alpha1.DevEnv, password PasswordFunc) error
+
+	// EnsureClient and GetClient return the client secret, an empty secret if the client is not available yet
+	EnsureClient(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error)
+	GetClient(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error)
+	// DeleteClient deletes the client of the DevEnv
+	DeleteClient(ctx context.Context, cr *cndev1alpha1.DevEnv) error
+	// RotateClientSecret regenerates the client secret and returns the new one
+	RotateClientSecret(ctx context.Context, cr *cndev1alpha1.DevEnv) (string, error)
+
+	// ListTagged returns the realms, clients and users tagged with the name of a DevEnv, used to find orphans
+	ListTagged(ctx context.Context) ([]TaggedObject, error)
+	// DeleteTagged deletes an object returned by ListTagged
+	DeleteTagged(ctx context.Context, obj TaggedObject) error
+
+	// ClientID returns the OAUTH client id oauth2-proxy has to use
+	ClientID() string
+	// IssuerURL returns the OIDC issuer oauth2-proxy has to use
+	IssuerURL(cr *cndev1alpha1.DevEnv) string
+	// AllowedGroups returns the groups a user needs to be member of to access the DevEnv
+	AllowedGroups(cr *cndev1alpha1.DevEnv) []string
+}
+
+// DevEnvTag is the attribute or label objects created by OAUTH providers are tagged with, its value is the name of the DevEnv
+const DevEnvTag = "c-n-d-e.kube-platform.dev/devenv"
+
+// TaggedObject is a realm, client or user at the OAUTH provider tagged with the name of a DevEnv
+type TaggedObject struct {
+	Kind string
+	// Name of the object, ID identifies it at the OAUTH provider
+	Name string
+	ID   string
+	// DevEnv the object is tagged with
+	DevEnv string
+	// Email of users, they are orphans only if no DevEnv uses the email
+	Email string
+}
+
+// PasswordFunc returns the initial password for a new user with the given name
+type PasswordFunc func(ctx context.Context, username string) (string, error)
+
+// NotFoundError is returned by Get methods if an object does not exist at the OAUTH provider
+type NotFoundError struct {
+	Kind string
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %q not found", e.Kind, e.Name)
+}
+
+// DriftError is returned by Get methods if an object at the OAUTH provider differs from the DevEnv
+type DriftError struct {
+	Kind  string
+	Name  string
+	Field string
+}
+
+func (e *DriftError) Error() string {
+	return fmt.Sprintf("%s %q has drifted: %s", e.Kind, e.Name, e.Field)
+}
+
+// IsNotFound reports whether err is a NotFoundError
+func IsNotFound(err error) bool {
+	var e *NotFoundError
+	return errors.As(err, &e)
+}
+
+// IsDrift reports whether err is a DriftError
+func IsDrift(err error) bool {
+	var e *DriftError
+	return errors.As(err, &e)
 }
 
+// DefaultTimeout is used for requests to the OAUTH provider if no other timeout is configured
+const DefaultTimeout = 10 * time.Second
+
+// DefaultCallTimeout is used for calls of provider methods if no other timeout is configured
+const DefaultCallTimeout = time.Minute
+
+const (
+	// RealmModePerDevEnv creates a realm for every DevEnv
+	RealmModePerDevEnv = "per-devenv"
+	// RealmModeShared uses one configured realm for all DevEnvs
+	RealmModeShared = "shared"
+)
+
 type BaseOAUTHProvider struct {
 }
 
@@ -21,10 +130,89 @@ type OAUTHProviderConfig struct {
 	OauthAdminName     string
 	OauthAdminPassword string
 	OauthAdminRealm    string
+	OauthIssuerURL     string
+	OauthRealmMode     string
+	OauthSharedRealm   string
 
+	DevEnvName   string
 	ResourceName string
 	IngressHost  string
 
-	OauthClientID        string
-	OauthInitialPassword string
+	OauthClientID string
+
+	// Timeout limits every single request to the OAUTH provider
+	Timeout time.Duration
+	// CallTimeout limits every call of a provider method, which may send several requests
+	CallTimeout time.Duration
+
+	// Client and Namespace are used by providers storing their state in Kubernetes resources
+	Client    client.Client
+	Namespace string
+
+	// Federation declares identity providers and user federations of every realm, nil if there are none
+	Federation *FederationConfig
+	// RealmPolicy of every realm, nil for DefaultRealmPolicy
+	RealmPolicy *RealmPolicy
+}
+
+// ProviderFactory creates a new OAUTHProvider for the given configuration
+type ProviderFactory func(config *OAUTHProviderConfig) (OAUTHProvider, error)
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]ProviderFactory)
+)
+
+// Register makes an OAUTHProvider available under the given name.
+// It panics if Register is called twice with the same name or if factory is nil.
+func Register(name string, factory ProviderFactory) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if factory == nil {
+		panic("oauth: Register factory is nil")
+	}
+	if _, dup := providers[name]; dup {
+		panic("oauth: Register called twice for provider " + name)
+	}
+	providers[name] = factory
+}
+
+// IsRegistered reports whether a provider with the given name is registered
+func IsRegistered(name string) bool {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	_, ok := providers[name]
+	return ok
+}
+
+// Providers returns a sorted list of the names of the registered providers
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	list := make([]string, 0, len(providers))
+	for name := range providers {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// NewOAUTHProvider creates an instance of the provider registered with the given name
+func NewOAUTHProvider(name string, config *OAUTHProviderConfig) (OAUTHProvider, error) {
+	providersMu.RLock()
+	factory, ok := providers[name]
+	providersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown OAUTH provider %q (registered: %v)", name, Providers())
+	}
+	return factory(config)
+}
+
+// GenerateSecret returns a random URL safe string build from length random bytes
+func GenerateSecret(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
@@ -0,0 +1,97 @@
+package oauth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// DefaultAccessTokenLifespan is the access token lifespan of realms without a RealmPolicy
+	DefaultAccessTokenLifespan = 23 * time.Hour
+	// minAccessTokenLifespan leaves oauth2-proxy time to refresh the access token before it expires
+	minAccessTokenLifespan = 2 * time.Minute
+	// cookieRefreshMargin lets oauth2-proxy refresh the access token before it expires
+	cookieRefreshMargin = time.Minute
+)
+
+// RealmPolicy declares token and session lifespans, MFA, password policy and brute-force protection of the realms.
+// It is read from the file named by CNDE_OAUTH_REALM_POLICY_FILE. Zero values keep the defaults of the OAUTH provider.
+type RealmPolicy struct {
+	AccessTokenLifespan   metav1.Duration `json:"accessTokenLifespan,omitempty"`
+	SSOSessionIdleTimeout metav1.Duration `json:"ssoSessionIdleTimeout,omitempty"`
+	SSOSessionMaxLifespan metav1.Duration `json:"ssoSessionMaxLifespan,omitempty"`
+
+	// RequireOTP makes users configure an OTP authenticator at their next login
+	RequireOTP bool `json:"requireOTP,omitempty"`
+	// PasswordPolicy in the syntax of the OAUTH provider, e.g. "length(12) and notUsername(undefined)" for Keycloak
+	PasswordPolicy string `json:"passwordPolicy,omitempty"`
+
+	BruteForceProtection *BruteForceProtection `json:"bruteForceProtection,omitempty"`
+
+	// ApplyToSharedRealm applies the policy to the shared realm too. It belongs to the administrators of the OAUTH
+	// provider, by default the policy applies to the realms of DevEnvs only.
+	ApplyToSharedRealm bool `json:"applyToSharedRealm,omitempty"`
+}
+
+// BruteForceProtection locks users out temporarily after failed logins
+type BruteForceProtection struct {
+	// FailureFactor is the number of failed logins until the user is locked out
+	FailureFactor  int             `json:"failureFactor,omitempty"`
+	WaitIncrement  metav1.Duration `json:"waitIncrement,omitempty"`
+	MaxFailureWait metav1.Duration `json:"maxFailureWait,omitempty"`
+	MaxDeltaTime   metav1.Duration `json:"maxDeltaTime,omitempty"`
+}
+
+// DefaultRealmPolicy returns the policy of realms if no file is configured
+func DefaultRealmPolicy() *RealmPolicy {
+	return &RealmPolicy{AccessTokenLifespan: metav1.Duration{Duration: DefaultAccessTokenLifespan}}
+}
+
+// Validate checks the lifespans of the RealmPolicy
+func (p *RealmPolicy) Validate() error {
+	if p.AccessTokenLifespan.Duration < minAccessTokenLifespan {
+		return fmt.Errorf("accessTokenLifespan %v is shorter than %v", p.AccessTokenLifespan.Duration, minAccessTokenLifespan)
+	}
+	if p.SSOSessionIdleTimeout.Duration < 0 || p.SSOSessionMaxLifespan.Duration < 0 {
+		return fmt.Errorf("negative session lifespan")
+	}
+	if p.SSOSessionMaxLifespan.Duration > 0 && p.SSOSessionMaxLifespan.Duration < p.AccessTokenLifespan.Duration {
+		return fmt.Errorf("ssoSessionMaxLifespan %v is shorter than accessTokenLifespan %v",
+			p.SSOSessionMaxLifespan.Duration, p.AccessTokenLifespan.Duration)
+	}
+	if b := p.BruteForceProtection; b != nil && b.FailureFactor < 0 {
+		return fmt.Errorf("negative bruteForceProtection.failureFactor")
+	}
+	return nil
+}
+
+// CookieRefresh returns the interval oauth2-proxy refreshes the access token in, shortly before it expires
+func (p *RealmPolicy) CookieRefresh() time.Duration {
+	return p.AccessTokenLifespan.Duration - cookieRefreshMargin
+}
+
+// CookieExpire returns the lifetime of the oauth2-proxy cookie, 0 if the session lifespan is not limited by the policy
+func (p *RealmPolicy) CookieExpire() time.Duration {
+	return p.SSOSessionMaxLifespan.Duration
+}
+
+// LoadRealmPolicy reads and validates the RealmPolicy in the given YAML or JSON file
+func LoadRealmPolicy(path string) (*RealmPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := DefaultRealmPolicy()
+	if err = yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err = policy.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return policy, nil
+}
@@ -0,0 +1,87 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	cndev1alpha1 "cnde-operator.cloud-native-coding.dev/api/v1alpha1"
+	"cnde-operator.cloud-native-coding.dev/controllers"
+	"cnde-operator.cloud-native-coding.dev/oauth"
+	"sigs.k8s.io/yaml"
+)
+
+// render prints the manifests the manager would create for a DevEnv, configured by the same environment
+func render(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	devEnvFile := fs.String("f", "", "The YAML file of the DevEnv.")
+	builderFile := fs.String("builder", "", "The YAML file of the Builder of the DevEnv, if it has one.")
+	ingressAPI := fs.String("ingress-api", string(controllers.IngressAPINetworkingV1), "The API of the Ingresses, networking.k8s.io/v1 or extensions/v1beta1.")
+	_ = fs.Parse(args)
+	if *devEnvFile == "" {
+		return fmt.Errorf("no DevEnv given, use -f")
+	}
+
+	devenv := &cndev1alpha1.DevEnv{}
+	if err := readYAML(*devEnvFile, devenv); err != nil {
+		return err
+	}
+
+	opts := controllers.DefaultRenderOptions()
+	opts.IngressAPI = controllers.IngressAPI(*ingressAPI)
+	if opts.IngressAPI != controllers.IngressAPINetworkingV1 && opts.IngressAPI != controllers.IngressAPIExtensionsV1beta1 {
+		return fmt.Errorf("unknown Ingress API %q", *ingressAPI)
+	}
+	exposure, err := controllers.ParseExposure(os.Getenv("CNDE_EXPOSURE"))
+	if err != nil {
+		return err
+	}
+	opts.Exposure = exposure
+	if opts.IngressAuth, err = controllers.ParseIngressAuth(os.Getenv("CNDE_INGRESS_AUTH")); err != nil {
+		return err
+	}
+	if *builderFile != "" {
+		opts.Builder = &cndev1alpha1.Builder{}
+		if err := readYAML(*builderFile, opts.Builder); err != nil {
+			return err
+		}
+	}
+	if policyFile, exists := os.LookupEnv("CNDE_OAUTH_REALM_POLICY_FILE"); exists {
+		if opts.RealmPolicy, err = oauth.LoadRealmPolicy(policyFile); err != nil {
+			return err
+		}
+	}
+
+	objs, err := controllers.Render(devenv, scheme, opts)
+	if err != nil {
+		return err
+	}
+	return controllers.WriteYAML(os.Stdout, objs)
+}
+
+func readYAML(file string, obj interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err = yaml.UnmarshalStrict(data, obj); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}